@@ -0,0 +1,29 @@
+// Sorts the tables with the malt-sortable class when clicking on their headers
+$(document).on('click', 'table.malt-sortable th', function () {
+  var $th = $(this),
+    $tbody = $th.closest('table').find('tbody'),
+    index = $th.index(),
+    numeric = $th.data('sort') === 'number',
+    ascending = !$th.hasClass('mdl-data-table__header--sorted-ascending');
+
+  $th.siblings().removeClass('mdl-data-table__header--sorted-ascending mdl-data-table__header--sorted-descending');
+  $th.toggleClass('mdl-data-table__header--sorted-ascending', ascending).toggleClass('mdl-data-table__header--sorted-descending', !ascending);
+
+  var rows = $tbody.find('tr').get().sort(function (a, b) {
+    var x = $(a).children().eq(index).text().trim(),
+      y = $(b).children().eq(index).text().trim();
+    var result = numeric ? parseFloat(x) - parseFloat(y) : x.localeCompare(y);
+    return ascending ? result : -result;
+  });
+  $tbody.append(rows);
+});
+
+// Reloads the pages with a data-malt-refresh attribute every given seconds, as the containers board
+$(function () {
+  var seconds = parseInt($('[data-malt-refresh]').data('malt-refresh'), 10);
+  if (seconds > 0) {
+    setTimeout(function () {
+      window.location.reload();
+    }, seconds * 1000);
+  }
+});
@@ -192,3 +192,15 @@ func GetUser(r *http.Request) (User, error) {
 	user.IsAdmin = user.IsMemberOf(os.Getenv("ADMIN_GROUP"))
 	return user, nil
 }
+
+// ValidateAuth lets the request through only if an user is logged in
+func ValidateAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := GetUser(r)
+		if err != nil || user.Login == "" {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,213 @@
+// Package beerjson reads and writes recipes in the BeerJSON 1.0 format (https://github.com/beerjson/beerjson), plus batches as an extension
+package beerjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Version is the supported BeerJSON version
+const Version = 1.0
+
+// Document is a BeerJSON document
+type Document struct {
+	BeerJSON BeerJSON `json:"beerjson"`
+}
+
+// BeerJSON is the content of a BeerJSON document
+type BeerJSON struct {
+	Version float64  `json:"version"`
+	Recipes []Recipe `json:"recipes,omitempty"`
+	Batches []Batch  `json:"batches,omitempty"` // extension, BeerJSON 1.0 has no batch record
+}
+
+// Quantity is a value with its unit, as the BeerJSON unit types
+type Quantity struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+// Recipe is a BeerJSON recipe
+type Recipe struct {
+	Name        string       `json:"name"`
+	Type        string       `json:"type"`
+	Author      string       `json:"author"`
+	BatchSize   *Quantity    `json:"batch_size"`
+	Efficiency  *Efficiency  `json:"efficiency"`
+	IBUEstimate *IBUEstimate `json:"ibu_estimate,omitempty"`
+	Ingredients *Ingredients `json:"ingredients"`
+	Mash        *Mash        `json:"mash,omitempty"`
+	Boil        *Boil        `json:"boil,omitempty"`
+}
+
+// Efficiency is a recipe efficiency
+type Efficiency struct {
+	Brewhouse *Quantity `json:"brewhouse"`
+}
+
+// IBUEstimate tells how the recipe bitterness is estimated
+type IBUEstimate struct {
+	Method string `json:"method"`
+}
+
+// Ingredients are the ingredients of a recipe
+type Ingredients struct {
+	FermentableAdditions []FermentableAddition `json:"fermentable_additions"`
+	HopAdditions         []HopAddition         `json:"hop_additions,omitempty"`
+	CultureAdditions     []CultureAddition     `json:"culture_additions,omitempty"`
+}
+
+// FermentableAddition is a fermentable of a recipe
+type FermentableAddition struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	GrainGroup string    `json:"grain_group,omitempty"`
+	Yield      *Yield    `json:"yield"`
+	Color      *Quantity `json:"color"`
+	Amount     *Quantity `json:"amount"`
+}
+
+// Yield is the extract yield of a fermentable
+type Yield struct {
+	Potential *Quantity `json:"potential,omitempty"`
+	FineGrind *Quantity `json:"fine_grind,omitempty"`
+}
+
+// HopAddition is a hop addition of a recipe
+type HopAddition struct {
+	Name      string    `json:"name"`
+	AlphaAcid *Quantity `json:"alpha_acid"`
+	Amount    *Quantity `json:"amount"`
+	Timing    *Timing   `json:"timing"`
+}
+
+// Timing tells when an ingredient is added
+type Timing struct {
+	Use      string    `json:"use,omitempty"`
+	Time     *Quantity `json:"time,omitempty"`
+	Duration *Quantity `json:"duration,omitempty"`
+}
+
+// CultureAddition is a yeast of a recipe
+type CultureAddition struct {
+	Name             string            `json:"name"`
+	Type             string            `json:"type"`
+	Form             string            `json:"form"`
+	Attenuation      *Quantity         `json:"attenuation,omitempty"`
+	TemperatureRange *TemperatureRange `json:"temperature_range,omitempty"`
+}
+
+// TemperatureRange is a temperature range
+type TemperatureRange struct {
+	Minimum *Quantity `json:"minimum"`
+	Maximum *Quantity `json:"maximum"`
+}
+
+// Mash is a mash procedure
+type Mash struct {
+	Name      string     `json:"name"`
+	MashSteps []MashStep `json:"mash_steps"`
+}
+
+// MashStep is a mash step
+type MashStep struct {
+	Name            string    `json:"name"`
+	Type            string    `json:"type"`
+	StepTemperature *Quantity `json:"step_temperature"`
+	StepTime        *Quantity `json:"step_time"`
+}
+
+// Boil is a boil procedure
+type Boil struct {
+	BoilTime *Quantity `json:"boil_time"`
+}
+
+// Batch is a brewed batch of a recipe of the document
+type Batch struct {
+	Recipe       string        `json:"recipe"`
+	Date         string        `json:"date"`
+	Step         string        `json:"step"`
+	StartVolume  *Quantity     `json:"start_volume"`
+	Events       []Event       `json:"events,omitempty"`
+	Measurements []Measurement `json:"measurements,omitempty"`
+}
+
+// Event is a volume change of a batch
+type Event struct {
+	Name   string    `json:"name"`
+	Date   string    `json:"date"`
+	Volume *Quantity `json:"volume"`
+}
+
+// Measurement is a reading of a batch, such as its gravity or temperature
+type Measurement struct {
+	Date   string  `json:"date"`
+	Kind   string  `json:"kind"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit"`
+	Source string  `json:"source,omitempty"`
+}
+
+// Encode writes a BeerJSON document
+func Encode(w io.Writer, doc BeerJSON) error {
+	doc.Version = Version
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(Document{BeerJSON: doc})
+}
+
+// Decode reads a BeerJSON document and validates it, the validation errors are given as Errors
+func Decode(r io.Reader) (BeerJSON, error) {
+	var doc Document
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return BeerJSON{}, Errors{{Path: fieldPath(typeErr.Field), Message: fmt.Sprintf("must be a %v", typeErr.Type)}}
+		}
+		return BeerJSON{}, err
+	}
+	if errs := Validate(doc); len(errs) > 0 {
+		return BeerJSON{}, errs
+	}
+	return doc.BeerJSON, nil
+}
+
+// fieldPath writes the path of a JSON decoding error as the validation paths, with the indexes between brackets
+func fieldPath(field string) string {
+	var path string
+	for _, part := range strings.Split(field, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			path += "[" + part + "]"
+		} else if path == "" {
+			path = part
+		} else {
+			path += "." + part
+		}
+	}
+	return path
+}
+
+// FieldError is a validation error of a document field
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// Errors are the validation errors of a document
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	var messages []string
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,68 @@
+package beerjson
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want []string
+	}{
+		{"wrong_version", `{"beerjson": {"version": 2}}`, []string{"beerjson.version"}},
+		{"wrong_type", `{"beerjson": {"version": 1, "recipes": [{"name": 12}]}}`, []string{"beerjson.recipes[0].name"}},
+		{"missing_fields", `{"beerjson": {"version": 1, "recipes": [{"name": "IPA", "type": "all grain", "batch_size": {"unit": "l", "value": 20},
+			"efficiency": {"brewhouse": {"unit": "%", "value": 75}},
+			"ingredients": {"fermentable_additions": [{"name": "Pale", "type": "grain", "yield": {"potential": {"unit": "sg", "value": 1.037}}, "color": {"unit": "EBC", "value": 6}, "amount": {"unit": "stone", "value": 1}}],
+			"hop_additions": [{"name": "Cascade", "alpha_acid": {"unit": "%", "value": 6}, "amount": {"unit": "g", "value": 40}}]}}]}}`,
+			[]string{"beerjson.recipes[0].ingredients.fermentable_additions[0].amount.unit", "beerjson.recipes[0].ingredients.hop_additions[0].timing"}},
+		{"unknown_batch_recipe", `{"beerjson": {"version": 1, "batches": [{"recipe": "IPA", "date": "2026-01-31", "step": "planned", "start_volume": {"unit": "l", "value": 20}}]}}`,
+			[]string{"beerjson.batches[0].recipe"}},
+		{"ambiguous_batch_recipe", `{"beerjson": {"version": 1, "recipes": [
+			{"name": "IPA", "type": "all grain", "batch_size": {"unit": "l", "value": 20}, "efficiency": {"brewhouse": {"unit": "%", "value": 75}}, "ingredients": {}},
+			{"name": "IPA", "type": "all grain", "batch_size": {"unit": "l", "value": 40}, "efficiency": {"brewhouse": {"unit": "%", "value": 75}}, "ingredients": {}}],
+			"batches": [{"recipe": "IPA", "date": "2026-01-31", "step": "planned", "start_volume": {"unit": "l", "value": 20}}]}}`,
+			[]string{"beerjson.recipes[1].name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(tt.doc))
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("Decode() error = %v, want validation errors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got errors on %v, want on %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuantity_In(t *testing.T) {
+	tests := []struct {
+		q     Quantity
+		units Units
+		want  float64
+	}{
+		{Quantity{"g", 500}, Mass, 0.5},
+		{Quantity{"lb", 1}, Mass, 0.454},
+		{Quantity{"gal", 5}, Volume, 18.927},
+		{Quantity{"F", 152}, Temperature, 66.667},
+		{Quantity{"hr", 1.5}, Time, 90},
+		{Quantity{"SRM", 5}, Color, 9.85},
+		{Quantity{"plato", 12}, Gravity, 1.048},
+	}
+	for _, tt := range tests {
+		if got := math.Round(tt.q.In(tt.units)*1000) / 1000; got != tt.want {
+			t.Errorf("%+v.In() = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package beerjson
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+)
+
+// Units converts the values of the units of a kind into the unit we work with
+type Units map[string]func(float64) float64
+
+func same(v float64) float64 { return v }
+
+// Units of the BeerJSON kinds, converted into kg, L, °C, min, %, EBC and specific gravity
+var (
+	Mass = Units{
+		"kg": same,
+		"g":  func(v float64) float64 { return v / 1000 },
+		"mg": func(v float64) float64 { return v / 1000000 },
+		"lb": func(v float64) float64 { return v * 0.45359237 },
+		"oz": func(v float64) float64 { return v * 0.028349523125 },
+	}
+	Volume = Units{
+		"l":    same,
+		"ml":   func(v float64) float64 { return v / 1000 },
+		"gal":  func(v float64) float64 { return v * 3.785411784 },
+		"qt":   func(v float64) float64 { return v * 0.946352946 },
+		"bbl":  func(v float64) float64 { return v * 117.347765304 },
+		"igal": func(v float64) float64 { return v * 4.54609 },
+	}
+	Temperature = Units{
+		"C": same,
+		"F": func(v float64) float64 { return (v - 32) * 5 / 9 },
+	}
+	Time = Units{
+		"min":  same,
+		"sec":  func(v float64) float64 { return v / 60 },
+		"hr":   func(v float64) float64 { return v * 60 },
+		"day":  func(v float64) float64 { return v * 1440 },
+		"week": func(v float64) float64 { return v * 10080 },
+	}
+	Percent = Units{"%": same}
+	Color   = Units{
+		"EBC":  same,
+		"SRM":  func(v float64) float64 { return v * 1.97 },
+		"Lovi": func(v float64) float64 { return (1.3546*v - 0.76) * 1.97 },
+	}
+	Gravity = Units{
+		"sg":    same,
+		"plato": brewcalc.PlatoToGravity,
+		"brix":  brewcalc.PlatoToGravity,
+	}
+)
+
+// In gives the quantity value converted with the given units, the quantity must be valid
+func (q *Quantity) In(units Units) float64 {
+	if q == nil {
+		return 0
+	}
+	if convert, ok := units[q.Unit]; ok {
+		return convert(q.Value)
+	}
+	return q.Value
+}
+
+// Enumerations of the BeerJSON schema
+var (
+	RecipeTypes      = []string{"all grain", "partial mash", "extract", "cider", "kombucha", "soda", "mead", "wine", "other"}
+	FermentableTypes = []string{"grain", "sugar", "extract", "dry extract", "fruit", "juice", "honey", "other"}
+	GrainGroups      = []string{"base", "caramel", "flaked", "roasted", "specialty", "smoked", "adjunct"}
+	Uses             = []string{"add_to_mash", "add_to_boil", "add_to_fermentation", "add_to_package"}
+	CultureTypes     = []string{"ale", "lager", "kveik", "wine", "champagne", "brett", "lacto", "pedio", "malolactic", "mixed-culture", "spontaneous", "bacteria", "other"}
+	CultureForms     = []string{"liquid", "dry", "slant", "culture", "dregs"}
+	MashStepTypes    = []string{"infusion", "temperature", "decoction", "souring mash", "souring wort", "drain mash tun", "sparge"}
+	IBUMethods       = []string{"Tinseth", "Rager", "Garetz", "Other"}
+)
+
+// DateLayout is the layout of the BeerJSON dates
+const DateLayout = "2006-01-02"
+
+// validator gathers the errors of a document with their path
+type validator struct {
+	errs Errors
+}
+
+func (v *validator) add(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) required(path string, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(path, "is required")
+		return false
+	}
+	return true
+}
+
+func (v *validator) oneOf(path string, value string, values []string) {
+	if !v.required(path, value) {
+		return
+	}
+	for _, allowed := range values {
+		if value == allowed {
+			return
+		}
+	}
+	v.add(path, "must be one of %q", values)
+}
+
+func (v *validator) quantity(path string, q *Quantity, units Units, required bool) {
+	if q == nil {
+		if required {
+			v.add(path, "is required")
+		}
+		return
+	}
+	if _, ok := units[q.Unit]; !ok {
+		var allowed []string
+		for unit := range units {
+			allowed = append(allowed, unit)
+		}
+		sort.Strings(allowed)
+		v.add(path+".unit", "must be one of %q", allowed)
+	}
+}
+
+func (v *validator) date(path string, value string) {
+	if !v.required(path, value) {
+		return
+	}
+	if _, err := time.Parse(DateLayout, value); err != nil {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			v.add(path, "must be a date as YYYY-MM-DD")
+		}
+	}
+}
+
+// Validate checks a document against the parts of the BeerJSON schema that we use, and gives the errors with their field path
+func Validate(doc Document) Errors {
+	v := &validator{}
+	if doc.BeerJSON.Version != Version {
+		v.add("beerjson.version", "must be %v", Version)
+	}
+	recipes := map[string]bool{}
+	for i, r := range doc.BeerJSON.Recipes {
+		path := fmt.Sprintf("beerjson.recipes[%d]", i)
+		v.recipe(path, r)
+		// The batches reference their recipe by name
+		if recipes[r.Name] && len(doc.BeerJSON.Batches) > 0 {
+			v.add(path+".name", "is the name of another recipe of the document")
+		}
+		recipes[r.Name] = true
+	}
+	for i, b := range doc.BeerJSON.Batches {
+		path := fmt.Sprintf("beerjson.batches[%d]", i)
+		if v.required(path+".recipe", b.Recipe) && !recipes[b.Recipe] {
+			v.add(path+".recipe", "no recipe named %q in the document", b.Recipe)
+		}
+		v.date(path+".date", b.Date)
+		v.required(path+".step", b.Step)
+		v.quantity(path+".start_volume", b.StartVolume, Volume, true)
+		for j, e := range b.Events {
+			eventPath := fmt.Sprintf("%s.events[%d]", path, j)
+			v.date(eventPath+".date", e.Date)
+			v.quantity(eventPath+".volume", e.Volume, Volume, true)
+		}
+		for j, m := range b.Measurements {
+			measurementPath := fmt.Sprintf("%s.measurements[%d]", path, j)
+			v.date(measurementPath+".date", m.Date)
+			v.required(measurementPath+".kind", m.Kind)
+			v.required(measurementPath+".unit", m.Unit)
+		}
+	}
+	return v.errs
+}
+
+func (v *validator) recipe(path string, r Recipe) {
+	v.required(path+".name", r.Name)
+	v.oneOf(path+".type", r.Type, RecipeTypes)
+	v.quantity(path+".batch_size", r.BatchSize, Volume, true)
+	if r.Efficiency == nil {
+		v.add(path+".efficiency", "is required")
+	} else {
+		v.quantity(path+".efficiency.brewhouse", r.Efficiency.Brewhouse, Percent, true)
+	}
+	if r.IBUEstimate != nil {
+		v.oneOf(path+".ibu_estimate.method", r.IBUEstimate.Method, IBUMethods)
+	}
+	if r.Boil != nil {
+		v.quantity(path+".boil.boil_time", r.Boil.BoilTime, Time, true)
+	}
+	if r.Mash != nil {
+		for i, s := range r.Mash.MashSteps {
+			stepPath := fmt.Sprintf("%s.mash.mash_steps[%d]", path, i)
+			v.required(stepPath+".name", s.Name)
+			v.oneOf(stepPath+".type", s.Type, MashStepTypes)
+			v.quantity(stepPath+".step_temperature", s.StepTemperature, Temperature, true)
+			v.quantity(stepPath+".step_time", s.StepTime, Time, true)
+		}
+	}
+	if r.Ingredients == nil {
+		v.add(path+".ingredients", "is required")
+		return
+	}
+	for i, f := range r.Ingredients.FermentableAdditions {
+		fPath := fmt.Sprintf("%s.ingredients.fermentable_additions[%d]", path, i)
+		v.required(fPath+".name", f.Name)
+		v.oneOf(fPath+".type", f.Type, FermentableTypes)
+		if f.GrainGroup != "" {
+			v.oneOf(fPath+".grain_group", f.GrainGroup, GrainGroups)
+		}
+		if f.Yield == nil || (f.Yield.Potential == nil && f.Yield.FineGrind == nil) {
+			v.add(fPath+".yield", "needs a potential or a fine_grind")
+		} else {
+			v.quantity(fPath+".yield.potential", f.Yield.Potential, Gravity, false)
+			v.quantity(fPath+".yield.fine_grind", f.Yield.FineGrind, Percent, false)
+		}
+		v.quantity(fPath+".color", f.Color, Color, true)
+		v.quantity(fPath+".amount", f.Amount, Mass, true)
+	}
+	for i, h := range r.Ingredients.HopAdditions {
+		hPath := fmt.Sprintf("%s.ingredients.hop_additions[%d]", path, i)
+		v.required(hPath+".name", h.Name)
+		v.quantity(hPath+".alpha_acid", h.AlphaAcid, Percent, true)
+		v.quantity(hPath+".amount", h.Amount, Mass, true)
+		if h.Timing == nil {
+			v.add(hPath+".timing", "is required")
+			continue
+		}
+		v.oneOf(hPath+".timing.use", h.Timing.Use, Uses)
+		v.quantity(hPath+".timing.time", h.Timing.Time, Time, false)
+		v.quantity(hPath+".timing.duration", h.Timing.Duration, Time, false)
+	}
+	for i, c := range r.Ingredients.CultureAdditions {
+		cPath := fmt.Sprintf("%s.ingredients.culture_additions[%d]", path, i)
+		v.required(cPath+".name", c.Name)
+		v.oneOf(cPath+".type", c.Type, CultureTypes)
+		v.oneOf(cPath+".form", c.Form, CultureForms)
+		v.quantity(cPath+".attenuation", c.Attenuation, Percent, false)
+		if c.TemperatureRange != nil {
+			v.quantity(cPath+".temperature_range.minimum", c.TemperatureRange.Minimum, Temperature, true)
+			v.quantity(cPath+".temperature_range.maximum", c.TemperatureRange.Maximum, Temperature, true)
+		}
+	}
+}
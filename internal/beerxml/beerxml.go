@@ -0,0 +1,176 @@
+// Package beerxml reads and writes recipes in the BeerXML 1.0 format (http://www.beerxml.com/)
+package beerxml
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Recipes is the root element of a BeerXML document
+type Recipes struct {
+	XMLName xml.Name `xml:"RECIPES"`
+	Recipes []Recipe `xml:"RECIPE"`
+}
+
+// Recipe is a BeerXML recipe, with amounts in kg and L, temperatures in °C and times in minutes
+type Recipe struct {
+	Name         string        `xml:"NAME"`
+	Version      int           `xml:"VERSION"`
+	Type         string        `xml:"TYPE"`
+	Brewer       string        `xml:"BREWER"`
+	BatchSize    float64       `xml:"BATCH_SIZE"`
+	BoilSize     float64       `xml:"BOIL_SIZE"`
+	BoilTime     float64       `xml:"BOIL_TIME"`
+	Efficiency   float64       `xml:"EFFICIENCY"`
+	IBUMethod    string        `xml:"IBU_METHOD,omitempty"`
+	PrimaryAge   float64       `xml:"PRIMARY_AGE,omitempty"` // days
+	Age          float64       `xml:"AGE,omitempty"`         // days
+	Hops         []Hop         `xml:"HOPS>HOP"`
+	Fermentables []Fermentable `xml:"FERMENTABLES>FERMENTABLE"`
+	Yeasts       []Yeast       `xml:"YEASTS>YEAST"`
+	Mash         Mash          `xml:"MASH"`
+}
+
+// Hop is a BeerXML hop
+type Hop struct {
+	Name    string  `xml:"NAME"`
+	Version int     `xml:"VERSION"`
+	Alpha   float64 `xml:"ALPHA"`
+	Amount  float64 `xml:"AMOUNT"`
+	Use     string  `xml:"USE"`
+	Time    float64 `xml:"TIME"`
+}
+
+// Fermentable is a BeerXML fermentable, with its color in SRM and its potential as a specific gravity (extension tag)
+type Fermentable struct {
+	Name      string  `xml:"NAME"`
+	Version   int     `xml:"VERSION"`
+	Type      string  `xml:"TYPE"`
+	Amount    float64 `xml:"AMOUNT"`
+	Yield     float64 `xml:"YIELD"`
+	Color     float64 `xml:"COLOR"`
+	Potential float64 `xml:"POTENTIAL,omitempty"`
+}
+
+// Yeast is a BeerXML yeast
+type Yeast struct {
+	Name           string  `xml:"NAME"`
+	Version        int     `xml:"VERSION"`
+	Type           string  `xml:"TYPE,omitempty"`
+	Form           string  `xml:"FORM,omitempty"`
+	Amount         float64 `xml:"AMOUNT"`
+	Attenuation    float64 `xml:"ATTENUATION,omitempty"`
+	MinTemperature float64 `xml:"MIN_TEMPERATURE,omitempty"`
+	MaxTemperature float64 `xml:"MAX_TEMPERATURE,omitempty"`
+}
+
+// Mash is a BeerXML mash profile
+type Mash struct {
+	Name      string     `xml:"NAME"`
+	Version   int        `xml:"VERSION"`
+	GrainTemp float64    `xml:"GRAIN_TEMP"`
+	MashSteps []MashStep `xml:"MASH_STEPS>MASH_STEP"`
+}
+
+// MashStep is a BeerXML mash step
+type MashStep struct {
+	Name     string  `xml:"NAME"`
+	Version  int     `xml:"VERSION"`
+	Type     string  `xml:"TYPE"`
+	StepTemp float64 `xml:"STEP_TEMP"`
+	StepTime float64 `xml:"STEP_TIME"`
+}
+
+// YieldToPotential converts a fermentable yield in % into its potential specific gravity, relatively to sucrose (1.046)
+func YieldToPotential(yield float64) float64 {
+	return 1 + yield/100*0.046
+}
+
+// PotentialToYield converts a fermentable potential specific gravity into its yield in %
+func PotentialToYield(potential float64) float64 {
+	return (potential - 1) / 0.046 * 100
+}
+
+// Decode reads the recipes of a BeerXML document, which may be encoded in UTF-8 or ISO-8859-1
+func Decode(r io.Reader) ([]Recipe, error) {
+	var doc Recipes
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "iso-8859-1", "latin1", "windows-1252":
+			return &latin1Reader{r: bufio.NewReader(input)}, nil
+		}
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc.Recipes, nil
+}
+
+// Encode writes the recipes as a BeerXML document
+func Encode(w io.Writer, recipes []Recipe) error {
+	for i := range recipes {
+		setVersions(&recipes[i])
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(Recipes{Recipes: recipes}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// setVersions sets the records version, which is always 1 in BeerXML 1.0
+func setVersions(r *Recipe) {
+	r.Version = 1
+	r.Mash.Version = 1
+	for i := range r.Hops {
+		r.Hops[i].Version = 1
+	}
+	for i := range r.Fermentables {
+		r.Fermentables[i].Version = 1
+	}
+	for i := range r.Yeasts {
+		r.Yeasts[i].Version = 1
+	}
+	for i := range r.Mash.MashSteps {
+		r.Mash.MashSteps[i].Version = 1
+	}
+}
+
+// latin1Reader converts an ISO-8859-1 stream into UTF-8
+type latin1Reader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(l.buf) > 0 {
+			c := copy(p[n:], l.buf)
+			l.buf = l.buf[c:]
+			n += c
+			continue
+		}
+		b, err := l.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		var encoded [utf8.UTFMax]byte
+		l.buf = encoded[:utf8.EncodeRune(encoded[:], rune(b))]
+	}
+	return n, nil
+}
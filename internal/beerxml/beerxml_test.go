@@ -0,0 +1,25 @@
+package beerxml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	// A standard ISO-8859-1 file, without the potential extension
+	doc := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		"<RECIPES><RECIPE><NAME>Bi\xe8re de garde</NAME><VERSION>1</VERSION><BATCH_SIZE>20</BATCH_SIZE>" +
+		"<FERMENTABLES><FERMENTABLE><NAME>Pilsner</NAME><AMOUNT>5</AMOUNT><YIELD>80.4</YIELD><COLOR>2</COLOR></FERMENTABLE></FERMENTABLES>" +
+		"<HOPS><HOP><NAME>Strisselspalt</NAME><AMOUNT>0.04</AMOUNT><ALPHA>3</ALPHA><USE>Boil</USE><TIME>60</TIME></HOP></HOPS>" +
+		"</RECIPE></RECIPES>"
+	recipes, err := Decode(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipes) != 1 || recipes[0].Name != "Bière de garde" || len(recipes[0].Fermentables) != 1 || len(recipes[0].Hops) != 1 {
+		t.Fatalf("got recipes %+v, want one Bière de garde with one fermentable and one hop", recipes)
+	}
+	if got := YieldToPotential(recipes[0].Fermentables[0].Yield); got < 1.0369 || got > 1.0371 {
+		t.Errorf("YieldToPotential() = %v, want 1.037", got)
+	}
+}
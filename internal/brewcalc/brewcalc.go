@@ -0,0 +1,110 @@
+// Package brewcalc provides the usual homebrewing estimates : gravities, alcohol, bitterness and color
+package brewcalc
+
+import (
+	"math"
+)
+
+// Conversion factors
+const (
+	// PointsPerKgPerLiter converts gravity points per pound per gallon into points per kilogram per liter
+	PointsPerKgPerLiter = 8.3454
+	litersPerGallon     = 3.78541
+	poundsPerKg         = 2.20462
+)
+
+// Points returns the gravity points of a specific gravity (1.050 gives 50)
+func Points(gravity float64) float64 {
+	return (gravity - 1) * 1000
+}
+
+// Gravity returns the specific gravity of gravity points (50 gives 1.050)
+func Gravity(points float64) float64 {
+	return 1 + points/1000
+}
+
+// ExtractPoints returns the gravity points brought by a fermentable, given its potential (as 1.037 for one pound in one gallon), its weight in kg,
+// the brewhouse efficiency in % and the batch volume in liters
+func ExtractPoints(potential float64, weight float64, efficiency float64, volume float64) float64 {
+	if volume <= 0 {
+		return 0
+	}
+	return Points(potential) * PointsPerKgPerLiter * weight * efficiency / 100 / volume
+}
+
+// FinalGravity returns the final gravity from the original gravity and the apparent attenuation in %
+func FinalGravity(og float64, attenuation float64) float64 {
+	return Gravity(Points(og) * (1 - attenuation/100))
+}
+
+// ABV returns the alcohol by volume in % from the original and final gravities
+func ABV(og float64, fg float64) float64 {
+	return (og - fg) * 131.25
+}
+
+// ApparentAttenuation returns the apparent attenuation in % from the original and current gravities
+func ApparentAttenuation(og float64, fg float64) float64 {
+	if og <= 1 {
+		return 0
+	}
+	return (og - fg) / (og - 1) * 100
+}
+
+// PlatoToGravity converts a gravity from degrees Plato (or Brix) to a specific gravity
+func PlatoToGravity(plato float64) float64 {
+	return 1 + plato/(258.6-plato/258.2*227.1)
+}
+
+// Tinseth returns the bitterness in IBU of a hop addition with the Tinseth formula, given its alpha acid in %, its weight in g,
+// its boil time in minutes, the batch volume in liters and the boil gravity
+func Tinseth(alpha float64, weight float64, time float64, volume float64, gravity float64) float64 {
+	if volume <= 0 {
+		return 0
+	}
+	bigness := 1.65 * math.Pow(0.000125, gravity-1)
+	boilTime := (1 - math.Exp(-0.04*time)) / 4.15
+	return bigness * boilTime * alpha / 100 * weight * 1000 / volume
+}
+
+// Rager returns the bitterness in IBU of a hop addition with the Rager formula, with the same arguments as Tinseth
+func Rager(alpha float64, weight float64, time float64, volume float64, gravity float64) float64 {
+	if volume <= 0 || time <= 0 {
+		return 0
+	}
+	utilization := (18.11 + 13.86*math.Tanh((time-31.32)/18.27)) / 100
+	adjustment := 0.0
+	if gravity > 1.050 {
+		adjustment = (gravity - 1.050) / 0.2
+	}
+	return weight * utilization * alpha / 100 * 1000 / (volume * (1 + adjustment))
+}
+
+// MaltColorUnits returns the malt color units brought by a fermentable, given its color in EBC, its weight in kg and the batch volume in liters
+func MaltColorUnits(color float64, weight float64, volume float64) float64 {
+	if volume <= 0 || color <= 0 {
+		return 0
+	}
+	lovibond := (EBCToSRM(color) + 0.76) / 1.3546
+	return lovibond * weight * poundsPerKg / (volume / litersPerGallon)
+}
+
+// Morey returns the beer color in SRM from the total malt color units
+func Morey(mcu float64) float64 {
+	return 1.4922 * math.Pow(mcu, 0.6859)
+}
+
+// SRMToEBC converts a color from SRM to EBC
+func SRMToEBC(srm float64) float64 {
+	return srm * 1.97
+}
+
+// EBCToSRM converts a color from EBC to SRM
+func EBCToSRM(ebc float64) float64 {
+	return ebc / 1.97
+}
+
+// Round rounds a value to the given number of decimals
+func Round(value float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Round(value*p) / p
+}
@@ -0,0 +1,35 @@
+package brewcalc
+
+import (
+	"testing"
+)
+
+func TestFormulas(t *testing.T) {
+	tests := []struct {
+		name    string
+		got     float64
+		want    float64
+		decimal int
+	}{
+		// 5 kg of pale malt (1.037) at 75 % in 23 L
+		{"extract_points", ExtractPoints(1.037, 5, 75, 23), 50.3, 1},
+		{"final_gravity", FinalGravity(1.050, 75), 1.0125, 4},
+		{"abv", ABV(1.050, 1.010), 5.25, 2},
+		{"apparent_attenuation", ApparentAttenuation(1.050, 1.010), 80, 1},
+		{"plato_to_gravity", PlatoToGravity(12), 1.048, 3},
+		// 30 g of 10 % alpha hops boiled 60 min in 20 L of 1.050 wort
+		{"tinseth", Tinseth(10, 30, 60, 20, 1.050), 34.6, 1},
+		{"rager", Rager(10, 30, 60, 20, 1.050), 46.2, 1},
+		{"rager_high_gravity", Rager(10, 30, 60, 20, 1.090), 38.5, 1},
+		{"rager_no_boil", Rager(10, 30, 0, 20, 1.050), 0, 1},
+		{"srm_to_ebc", SRMToEBC(10), 19.7, 1},
+		{"morey", Morey(10), 7.2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Round(tt.got, tt.decimal); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
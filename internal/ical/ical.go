@@ -0,0 +1,109 @@
+// Package ical writes calendars in the iCalendar format (RFC 5545), to be subscribed to from calendar applications
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Calendar is an iCalendar calendar of events
+type Calendar struct {
+	ProdID string // the product writing the calendar
+	Name   string
+	Events []Event
+}
+
+// Event is a calendar event, lasting whole days if AllDay is set
+type Event struct {
+	UID         string
+	Stamp       time.Time // the last change of the event
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	Summary     string
+	Description string
+	URL         string
+}
+
+// Date formats of the iCalendar format
+const (
+	dateFormat     = "20060102"
+	dateTimeFormat = "20060102T150405Z"
+)
+
+// maxLineLength is the length in octets after which the lines are folded
+const maxLineLength = 75
+
+// escaper escapes the text values
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// Encode writes the calendar in the iCalendar format
+func Encode(w io.Writer, c Calendar) error {
+	bw := bufio.NewWriter(w)
+	line := func(name, value string) {
+		bw.WriteString(fold(name + ":" + value))
+		bw.WriteString("\r\n")
+	}
+	line("BEGIN", "VCALENDAR")
+	line("VERSION", "2.0")
+	line("PRODID", c.ProdID)
+	line("CALSCALE", "GREGORIAN")
+	line("METHOD", "PUBLISH")
+	if c.Name != "" {
+		line("X-WR-CALNAME", escaper.Replace(c.Name))
+	}
+	for _, e := range c.Events {
+		line("BEGIN", "VEVENT")
+		line("UID", e.UID)
+		line("DTSTAMP", e.Stamp.UTC().Format(dateTimeFormat))
+		if e.AllDay {
+			// The end date is excluded, an event of a single day ends the next day
+			end := e.End
+			if end.Format(dateFormat) <= e.Start.Format(dateFormat) {
+				end = e.Start.AddDate(0, 0, 1)
+			}
+			line("DTSTART;VALUE=DATE", e.Start.Format(dateFormat))
+			line("DTEND;VALUE=DATE", end.Format(dateFormat))
+		} else {
+			line("DTSTART", e.Start.UTC().Format(dateTimeFormat))
+			if e.End.After(e.Start) {
+				line("DTEND", e.End.UTC().Format(dateTimeFormat))
+			}
+		}
+		line("SUMMARY", escaper.Replace(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION", escaper.Replace(e.Description))
+		}
+		if e.URL != "" {
+			line("URL", e.URL)
+		}
+		line("END", "VEVENT")
+	}
+	line("END", "VCALENDAR")
+	return bw.Flush()
+}
+
+// fold splits the line into lines of at most 75 octets, the following ones starting with a space, without splitting the UTF-8 characters
+func fold(s string) string {
+	if len(s) <= maxLineLength {
+		return s
+	}
+	var b strings.Builder
+	limit := maxLineLength
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		fmt.Fprintf(&b, "%s\r\n ", s[:cut])
+		s = s[cut:]
+		// The continuation lines start with a space, counting in their length
+		limit = maxLineLength - 1
+	}
+	b.WriteString(s)
+	return b.String()
+}
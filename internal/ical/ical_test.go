@@ -0,0 +1,47 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	stamp := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	c := Calendar{ProdID: "-//Malt App//Brewery//EN", Name: "Brewery", Events: []Event{
+		{UID: "batch-1@example.org", Stamp: stamp, Start: time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local), End: time.Date(2026, 1, 10, 1, 0, 0, 0, time.Local), AllDay: true, Summary: "Brew day : #1 IPA, Pale; Amber", URL: "https://example.org/admin/batches/1"},
+		{UID: "transfer-2@example.org", Stamp: stamp, Start: time.Date(2026, 1, 20, 9, 30, 0, 0, time.UTC), End: time.Date(2026, 1, 20, 10, 30, 0, 0, time.UTC), Summary: "Transfer", Description: "From the fermenter\nto the tank"},
+	}}
+	var b bytes.Buffer
+	if err := Encode(&b, c); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Malt App//Brewery//EN\r\n",
+		"DTSTART;VALUE=DATE:20260110\r\nDTEND;VALUE=DATE:20260111\r\n",
+		`SUMMARY:Brew day : #1 IPA\, Pale\; Amber` + "\r\n",
+		"DTSTART:20260120T093000Z\r\nDTEND:20260120T103000Z\r\n",
+		`DESCRIPTION:From the fermenter\nto the tank` + "\r\n",
+		"DTSTAMP:20260102T100000Z\r\n",
+		"END:VEVENT\r\nEND:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got calendar\n%s\nwant it to contain %q", got, want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	long := "SUMMARY:" + strings.Repeat("é", 60)
+	folded := fold(long)
+	for _, line := range strings.Split(folded, "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("got line of %d octets, want at most %d", len(line), maxLineLength)
+		}
+	}
+	if unfolded := strings.Replace(folded, "\r\n ", "", -1); unfolded != long {
+		t.Errorf("got unfolded %q, want %q", unfolded, long)
+	}
+}
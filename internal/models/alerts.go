@@ -0,0 +1,326 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/nicolaspernoud/malt_app/internal/notify"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/roles"
+)
+
+// Alert is an anomaly raised by a rule on a fermenting batch, it is resolved by the engine when the rule doesn't see it anymore
+type Alert struct {
+	gorm.Model
+	Batch          Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID        uint  `gorm:"index"`
+	Rule           string
+	Message        string
+	Date           time.Time
+	AcknowledgedBy string
+	AcknowledgedAt *time.Time
+	ResolvedAt     *time.Time
+}
+
+// Watch is what the rules know of a fermenting batch
+type Watch struct {
+	Batch    Batch
+	Recipe   Recipe               // as it was when the batch was created
+	Readings []Measurement        // sorted by date
+	Devices  map[string]time.Time // names of the devices assigned to the batch, with the start of their assignment
+	Now      time.Time
+}
+
+// AlertRule checks a fermenting batch, and gives a message when something goes wrong
+type AlertRule struct {
+	Name  string
+	Check func(w Watch) (message string, raised bool)
+}
+
+// Rules names
+const (
+	RuleTemperature = "temperature out of range"
+	RuleStalled     = "gravity stalled"
+	RuleMissing     = "reading missing"
+)
+
+// Gravity tolerances, in specific gravity
+const (
+	stallTolerance     = 0.001 // variation under which the gravity is considered stable
+	finalGravityMargin = 0.002 // margin above the expected final gravity under which the fermentation is considered finished
+)
+
+// AlertRules are the rules run on the fermenting batches
+var AlertRules = []AlertRule{TemperatureOutOfRange(), GravityStalled(48 * time.Hour), ReadingMissing(6 * time.Hour)}
+
+// Notifiers deliver the new alerts
+var Notifiers = []notify.Notifier{notify.Log{}}
+
+// lastReading gives the last reading of a kind, if any
+func (w Watch) lastReading(kind string) (Measurement, bool) {
+	for i := len(w.Readings) - 1; i >= 0; i-- {
+		if w.Readings[i].Kind == kind {
+			return w.Readings[i], true
+		}
+	}
+	return Measurement{}, false
+}
+
+// TemperatureOutOfRange raises an alert when the last temperature reading is outside the range of the recipe yeasts
+func TemperatureOutOfRange() AlertRule {
+	return AlertRule{Name: RuleTemperature, Check: func(w Watch) (string, bool) {
+		min, max := math.Inf(-1), math.Inf(1)
+		for _, y := range w.Recipe.Yeasts {
+			if y.MinTemperature != 0 || y.MaxTemperature != 0 {
+				min, max = math.Max(min, y.MinTemperature), math.Min(max, y.MaxTemperature)
+			}
+		}
+		last, ok := w.lastReading(KindTemperature)
+		if !ok || math.IsInf(min, -1) {
+			return "", false
+		}
+		if t := last.Normalized(); t < min || t > max {
+			return fmt.Sprintf("temperature of %.1f °C outside the %g - %g °C range of the yeast", t, min, max), true
+		}
+		return "", false
+	}}
+}
+
+// GravityStalled raises an alert when the gravity didn't move for the given duration while still above the final gravity expected from the recipe
+func GravityStalled(d time.Duration) AlertRule {
+	return AlertRule{Name: RuleStalled, Check: func(w Watch) (string, bool) {
+		last, ok := w.lastReading(KindGravity)
+		if !ok {
+			return "", false
+		}
+		since := last.Date.Add(-d)
+		min, max, covered := math.Inf(1), math.Inf(-1), false
+		for _, m := range w.Readings {
+			if m.Kind != KindGravity {
+				continue
+			}
+			if !m.Date.After(since) {
+				covered = true
+			}
+			if !m.Date.Before(since) {
+				min, max = math.Min(min, m.Normalized()), math.Max(max, m.Normalized())
+			}
+		}
+		// The final gravity is expected from the original gravity read, attenuated as the recipe tells
+		var og float64
+		for _, m := range w.Readings {
+			if m.Kind == KindGravity {
+				og = m.Normalized()
+				break
+			}
+		}
+		e := w.Recipe.Estimate()
+		attenuation := brewcalc.ApparentAttenuation(e.OriginalGravity, e.FinalGravity)
+		if attenuation <= 0 {
+			attenuation = defaultAttenuation
+		}
+		expected := brewcalc.Round(brewcalc.FinalGravity(og, attenuation), 3)
+		if covered && max-min < stallTolerance && last.Normalized() > expected+finalGravityMargin {
+			return fmt.Sprintf("gravity stalled at %.3f for %v, above the expected %.3f", last.Normalized(), d, expected), true
+		}
+		return "", false
+	}}
+}
+
+// ReadingMissing raises an alert when a batch measured by a device got no reading for the given duration
+func ReadingMissing(d time.Duration) AlertRule {
+	return AlertRule{Name: RuleMissing, Check: func(w Watch) (string, bool) {
+		var names []string
+		for device := range w.Devices {
+			names = append(names, device)
+		}
+		sort.Strings(names)
+		for _, device := range names {
+			since := w.Devices[device]
+			// Only the readings of the device since it measures the batch tell that it works
+			last := since
+			for _, m := range w.Readings {
+				if m.Source == device && m.Date.After(last) {
+					last = m.Date
+				}
+			}
+			if w.Now.Sub(last) <= d {
+				continue
+			}
+			if last.Equal(since) {
+				return fmt.Sprintf("no reading received from %v since it was assigned on %v", device, since.Format("2006-01-02 15:04")), true
+			}
+			return fmt.Sprintf("no reading received from %v since %v", device, last.Format("2006-01-02 15:04")), true
+		}
+		return "", false
+	}}
+}
+
+// CheckAlerts runs the rules on the fermenting batches, stores the new alerts and delivers them, and resolves the alerts the rules don't see anymore
+func CheckAlerts(db *gorm.DB, now time.Time) ([]Alert, error) {
+	var batches []Batch
+	if err := db.Where("step = ?", StepFermenting).Find(&batches).Error; err != nil {
+		return nil, err
+	}
+	var ids []uint
+	for _, b := range batches {
+		ids = append(ids, b.ID)
+	}
+	var readings []Measurement
+	var assignments []DeviceAssignment
+	var unresolved []Alert
+	if len(ids) > 0 {
+		if err := db.Where("batch_id IN (?)", ids).Order("date, id").Find(&readings).Error; err != nil {
+			return nil, err
+		}
+		if err := db.Where("batch_id IN (?) AND since <= ? AND (until IS NULL OR until > ?)", ids, now, now).Find(&assignments).Error; err != nil {
+			return nil, err
+		}
+	}
+	// The readings tell their device by its name
+	devices := map[uint]string{}
+	for _, a := range assignments {
+		var d Device
+		if err := db.Unscoped().First(&d, a.DeviceID).Error; err != nil {
+			return nil, err
+		}
+		devices[a.DeviceID] = d.Name
+	}
+	if err := db.Where("resolved_at IS NULL").Find(&unresolved).Error; err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		batchID uint
+		rule    string
+	}
+	raised := map[key]bool{}
+	for _, a := range unresolved {
+		raised[key{a.BatchID, a.Rule}] = false
+	}
+	var alerts []Alert
+	for _, b := range batches {
+		w := Watch{Batch: b, Now: now}
+		w.Recipe, _ = b.SnapshotRecipe()
+		for _, m := range readings {
+			if m.BatchID == b.ID {
+				w.Readings = append(w.Readings, m)
+			}
+		}
+		for _, a := range assignments {
+			if a.BatchID == b.ID {
+				if w.Devices == nil {
+					w.Devices = map[string]time.Time{}
+				}
+				w.Devices[devices[a.DeviceID]] = a.Since
+			}
+		}
+		for _, rule := range AlertRules {
+			message, ok := rule.Check(w)
+			if !ok {
+				continue
+			}
+			k := key{b.ID, rule.Name}
+			if _, open := raised[k]; !open {
+				alert := Alert{BatchID: b.ID, Rule: rule.Name, Message: message, Date: now}
+				if err := db.Create(&alert).Error; err != nil {
+					return alerts, err
+				}
+				alert.Batch = b
+				alerts = append(alerts, alert)
+			}
+			raised[k] = true
+		}
+	}
+	for _, a := range unresolved {
+		if !raised[key{a.BatchID, a.Rule}] {
+			if err := db.Model(&a).UpdateColumn("resolved_at", now).Error; err != nil {
+				return alerts, err
+			}
+		}
+	}
+
+	for _, a := range alerts {
+		m := notify.Message{Subject: fmt.Sprintf("Batch %s: %s", a.Batch.Stringify(), a.Rule), Body: a.Message}
+		for _, n := range Notifiers {
+			if err := n.Notify(m); err != nil {
+				log.Printf("Error notifying an alert: %v\n", err)
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// WatchBatches runs the alert rules on the fermenting batches at the given interval
+func WatchBatches(db *gorm.DB, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if _, err := CheckAlerts(db, now); err != nil {
+			log.Printf("Error checking the alerts: %v\n", err)
+		}
+	}
+}
+
+// Acknowledge marks the alert as seen by the user
+func (a *Alert) Acknowledge(db *gorm.DB, user string, now time.Time) error {
+	a.AcknowledgedBy, a.AcknowledgedAt = user, &now
+	return db.Model(a).UpdateColumns(map[string]interface{}{"acknowledged_by": a.AcknowledgedBy, "acknowledged_at": a.AcknowledgedAt}).Error
+}
+
+// OpenAlerts gives the alerts not acknowledged yet, the latest first
+func OpenAlerts(db *gorm.DB) ([]Alert, error) {
+	var alerts []Alert
+	err := db.Preload("Batch").Where("acknowledged_at IS NULL").Order("date DESC, id DESC").Find(&alerts).Error
+	return alerts, err
+}
+
+// configureAlerts adds the alerts admin with their acknowledgement, and lists the open alerts on the dashboard
+func configureAlerts(Admin *admin.Admin) {
+	alert := Admin.AddResource(&Alert{}, &admin.Config{Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.Delete, "admin")})
+	alert.IndexAttrs("Date", "Batch", "Rule", "Message", "AcknowledgedBy", "ResolvedAt")
+	alert.Scope(&admin.Scope{Name: "Open", Handler: func(db *gorm.DB, context *qor.Context) *gorm.DB {
+		return db.Where("acknowledged_at IS NULL")
+	}})
+	alert.Scope(&admin.Scope{Name: "Acknowledged", Handler: func(db *gorm.DB, context *qor.Context) *gorm.DB {
+		return db.Where("acknowledged_at IS NOT NULL")
+	}})
+
+	alert.Action(&admin.Action{
+		Name:       "Acknowledge",
+		Permission: anyone,
+		Modes:      []string{"batch", "show", "menu_item"},
+		Visible: func(record interface{}, context *admin.Context) bool {
+			a, ok := record.(*Alert)
+			return !ok || a.AcknowledgedAt == nil
+		},
+		Handler: func(argument *admin.ActionArgument) error {
+			for _, record := range argument.FindSelectedRecords() {
+				a, ok := record.(*Alert)
+				if !ok {
+					return errors.New("not an alert")
+				}
+				if a.AcknowledgedAt != nil {
+					continue
+				}
+				if err := a.Acknowledge(argument.Context.GetDB(), userName(argument.Context.CurrentUser), time.Now()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	Admin.RegisterFuncMap("open_alerts", func() []Alert {
+		alerts, err := OpenAlerts(DB)
+		if err != nil {
+			log.Printf("Error getting the open alerts: %v\n", err)
+		}
+		return alerts
+	})
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicolaspernoud/malt_app/internal/notify"
+)
+
+type recorder struct{ messages []notify.Message }
+
+func (r *recorder) Notify(m notify.Message) error {
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+func TestAlertRules(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	recipe := Recipe{Yeasts: []Yeast{{Name: "US-05", Attenuation: 78, MinTemperature: 15, MaxTemperature: 22}}}
+	gravity := func(hours int, value float64) Measurement {
+		return Measurement{Kind: KindGravity, Value: value, Unit: "SG", Date: start.Add(time.Duration(hours) * time.Hour), Source: "iSpindel"}
+	}
+	temperature := func(hours int, value float64, unit string) Measurement {
+		return Measurement{Kind: KindTemperature, Value: value, Unit: unit, Date: start.Add(time.Duration(hours) * time.Hour)}
+	}
+	now := start.Add(72 * time.Hour)
+	assigned := map[string]time.Time{"iSpindel": start}
+	tests := []struct {
+		name     string
+		rule     AlertRule
+		readings []Measurement
+		devices  map[string]time.Time
+		want     bool
+	}{
+		{"temperature_in_range", TemperatureOutOfRange(), []Measurement{temperature(0, 25, "°C"), temperature(1, 19, "°C")}, nil, false},
+		{"temperature_too_high", TemperatureOutOfRange(), []Measurement{temperature(0, 19, "°C"), temperature(1, 77, "°F")}, nil, true},
+		{"temperature_none", TemperatureOutOfRange(), nil, nil, false},
+		{"gravity_dropping", GravityStalled(48 * time.Hour), []Measurement{gravity(0, 1.050), gravity(24, 1.030), gravity(50, 1.020)}, nil, false},
+		{"gravity_stalled", GravityStalled(48 * time.Hour), []Measurement{gravity(0, 1.050), gravity(10, 1.030), gravity(40, 1.0305), gravity(60, 1.030)}, nil, true},
+		{"gravity_stable_not_long_enough", GravityStalled(48 * time.Hour), []Measurement{gravity(0, 1.030), gravity(24, 1.030)}, nil, false},
+		{"gravity_finished", GravityStalled(48 * time.Hour), []Measurement{gravity(0, 1.050), gravity(10, 1.011), gravity(60, 1.011)}, nil, false},
+		{"reading_recent", ReadingMissing(6 * time.Hour), []Measurement{gravity(70, 1.030)}, assigned, false},
+		{"reading_missing", ReadingMissing(6 * time.Hour), []Measurement{gravity(60, 1.030)}, assigned, true},
+		{"reading_missing_no_device", ReadingMissing(6 * time.Hour), []Measurement{gravity(60, 1.030)}, nil, false},
+		{"reading_missing_from_the_device", ReadingMissing(6 * time.Hour), []Measurement{gravity(60, 1.030), {Kind: KindGravity, Value: 1.030, Unit: "SG", Date: now, Source: "Manual"}}, assigned, true},
+		{"reading_none_since_assigned", ReadingMissing(6 * time.Hour), nil, assigned, true},
+		{"device_assigned_a_minute_ago", ReadingMissing(6 * time.Hour), []Measurement{gravity(60, 1.030)}, map[string]time.Time{"iSpindel": now.Add(-time.Minute)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := Watch{Recipe: recipe, Readings: tt.readings, Devices: tt.devices, Now: now}
+			if message, got := tt.rule.Check(w); got != tt.want {
+				t.Errorf("got %v (%v), want %v", got, message, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAlerts(t *testing.T) {
+	defer initTestDB(t)()
+	r := &recorder{}
+	defer func(notifiers []notify.Notifier) { Notifiers = notifiers }(Notifiers)
+	Notifiers = []notify.Notifier{r}
+
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	fermenting := Batch{Recipe: Recipe{Name: "IPA", Yeasts: []Yeast{{Name: "US-05", MinTemperature: 15, MaxTemperature: 22}}}, Step: StepFermenting, StartVolume: 20}
+	DB.Create(&fermenting)
+	planned := Batch{Recipe: Recipe{Name: "Stout", Yeasts: []Yeast{{Name: "S-04", MinTemperature: 15, MaxTemperature: 20}}}, StartVolume: 20}
+	DB.Create(&planned)
+	for _, b := range []Batch{fermenting, planned} {
+		DB.Create(&Measurement{BatchID: b.ID, Kind: KindTemperature, Value: 26, Date: start})
+	}
+
+	alerts, err := CheckAlerts(DB, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].BatchID != fermenting.ID || alerts[0].Rule != RuleTemperature || len(r.messages) != 1 {
+		t.Fatalf("got alerts %+v and messages %+v, want one temperature alert on the fermenting batch", alerts, r.messages)
+	}
+
+	// The alert is raised once, even once acknowledged, as long as the rule sees it
+	if err := alerts[0].Acknowledge(DB, "Brewer", start.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if alerts, _ := CheckAlerts(DB, start.Add(3*time.Hour)); len(alerts) != 0 || len(r.messages) != 1 {
+		t.Errorf("got alerts %+v, want no new alert", alerts)
+	}
+	if open, _ := OpenAlerts(DB); len(open) != 0 {
+		t.Errorf("got open alerts %+v, want none", open)
+	}
+
+	// Back in range, the alert is resolved, and raised again if the temperature goes up again
+	DB.Create(&Measurement{BatchID: fermenting.ID, Kind: KindTemperature, Value: 19, Date: start.Add(4 * time.Hour)})
+	if alerts, _ := CheckAlerts(DB, start.Add(5*time.Hour)); len(alerts) != 0 {
+		t.Errorf("got alerts %+v, want none", alerts)
+	}
+	var alert Alert
+	DB.First(&alert, alerts[0].ID)
+	if alert.ResolvedAt == nil || alert.AcknowledgedBy != "Brewer" {
+		t.Errorf("got alert %+v, want it resolved and acknowledged by the brewer", alert)
+	}
+	DB.Create(&Measurement{BatchID: fermenting.ID, Kind: KindTemperature, Value: 24, Date: start.Add(6 * time.Hour)})
+	if alerts, _ := CheckAlerts(DB, start.Add(7*time.Hour)); len(alerts) != 1 || len(r.messages) != 2 {
+		t.Errorf("got alerts %+v, want the alert raised again", alerts)
+	}
+	if open, _ := OpenAlerts(DB); len(open) != 1 || open[0].Batch.ID != fermenting.ID {
+		t.Errorf("got open alerts %+v, want the new one", open)
+	}
+}
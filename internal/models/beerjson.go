@@ -0,0 +1,461 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/beerjson"
+	"github.com/nicolaspernoud/malt_app/internal/beerxml"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+)
+
+// BeerJSON fermentable types of our fermentable types
+var beerJSONFermentableTypes = map[string]string{
+	"Grain":       "grain",
+	"Sugar":       "sugar",
+	"Extract":     "extract",
+	"Dry Extract": "dry extract",
+	"Adjunct":     "grain",
+}
+
+func quantity(unit string, value float64) *beerjson.Quantity {
+	return &beerjson.Quantity{Unit: unit, Value: value}
+}
+
+// ToBeerJSON converts a recipe, which ingredients must be loaded, into a BeerJSON recipe
+func (r Recipe) ToBeerJSON() beerjson.Recipe {
+	x := beerjson.Recipe{
+		Name:        r.Name,
+		Type:        "all grain",
+		BatchSize:   quantity("l", r.BatchSize),
+		Efficiency:  &beerjson.Efficiency{Brewhouse: quantity("%", r.Efficiency)},
+		Ingredients: &beerjson.Ingredients{FermentableAdditions: []beerjson.FermentableAddition{}},
+		Boil:        &beerjson.Boil{BoilTime: quantity("min", float64(r.BoilTime))},
+	}
+	if r.IBUFormula != "" {
+		x.IBUEstimate = &beerjson.IBUEstimate{Method: r.IBUFormula}
+	}
+	for _, f := range r.Fermentables {
+		fermentable := beerjson.FermentableAddition{
+			Name:   f.Name,
+			Type:   beerJSONFermentableTypes[f.Type],
+			Yield:  &beerjson.Yield{Potential: quantity("sg", f.Potential)},
+			Color:  quantity("EBC", f.Color),
+			Amount: quantity("kg", f.Weight),
+		}
+		if fermentable.Type == "" {
+			fermentable.Type = "other"
+		}
+		if f.Type == "Adjunct" {
+			fermentable.GrainGroup = "adjunct"
+		}
+		x.Ingredients.FermentableAdditions = append(x.Ingredients.FermentableAdditions, fermentable)
+	}
+	for _, h := range r.Hops {
+		hop := beerjson.HopAddition{Name: h.Name, AlphaAcid: quantity("%", h.Alpha), Amount: quantity("g", h.Weight), Timing: &beerjson.Timing{}}
+		switch h.Use {
+		case "Mash":
+			hop.Timing.Use, hop.Timing.Time = "add_to_mash", quantity("min", float64(h.Time))
+		case "First Wort":
+			hop.Timing.Use, hop.Timing.Time = "add_to_boil", quantity("min", float64(r.BoilTime))
+		case "Aroma":
+			hop.Timing.Use, hop.Timing.Time, hop.Timing.Duration = "add_to_boil", quantity("min", 0), quantity("min", float64(h.Time))
+		case "Dry Hop":
+			hop.Timing.Use, hop.Timing.Duration = "add_to_fermentation", quantity("min", float64(h.Time))
+		default:
+			hop.Timing.Use, hop.Timing.Time = "add_to_boil", quantity("min", float64(h.Time))
+		}
+		x.Ingredients.HopAdditions = append(x.Ingredients.HopAdditions, hop)
+	}
+	for _, y := range r.Yeasts {
+		culture := beerjson.CultureAddition{Name: y.Name, Type: strings.ToLower(y.Type), Form: strings.ToLower(y.Form), Attenuation: quantity("%", y.Attenuation)}
+		// The schema has no wheat yeasts, and requires a type and a form even when we don't know them
+		switch culture.Type {
+		case "wheat":
+			culture.Type = "ale"
+		case "":
+			culture.Type = "other"
+		}
+		if culture.Form == "" {
+			culture.Form = "culture"
+		}
+		if y.MinTemperature != 0 || y.MaxTemperature != 0 {
+			culture.TemperatureRange = &beerjson.TemperatureRange{Minimum: quantity("C", y.MinTemperature), Maximum: quantity("C", y.MaxTemperature)}
+		}
+		x.Ingredients.CultureAdditions = append(x.Ingredients.CultureAdditions, culture)
+	}
+	if len(r.MashSteps) > 0 {
+		x.Mash = &beerjson.Mash{Name: r.Name}
+		for _, m := range r.MashSteps {
+			x.Mash.MashSteps = append(x.Mash.MashSteps, beerjson.MashStep{
+				Name:            m.Name,
+				Type:            "infusion",
+				StepTemperature: quantity("C", m.Temperature),
+				StepTime:        quantity("min", float64(m.Time)),
+			})
+		}
+	}
+	return x
+}
+
+// minutes converts a BeerJSON time into whole minutes
+func minutes(q *beerjson.Quantity) int {
+	return int(math.Round(q.In(beerjson.Time)))
+}
+
+// RecipeFromBeerJSON converts a valid BeerJSON recipe into a recipe
+func RecipeFromBeerJSON(x beerjson.Recipe) Recipe {
+	r := Recipe{
+		Name:       x.Name,
+		BatchSize:  brewcalc.Round(x.BatchSize.In(beerjson.Volume), 2),
+		Efficiency: x.Efficiency.Brewhouse.In(beerjson.Percent),
+	}
+	if x.Boil != nil {
+		r.BoilTime = minutes(x.Boil.BoilTime)
+	}
+	if x.IBUEstimate != nil && (x.IBUEstimate.Method == Tinseth || x.IBUEstimate.Method == Rager) {
+		r.IBUFormula = x.IBUEstimate.Method
+	}
+	for _, f := range x.Ingredients.FermentableAdditions {
+		fermentable := Fermentable{
+			Name:   f.Name,
+			Weight: brewcalc.Round(f.Amount.In(beerjson.Mass), 3),
+			Color:  brewcalc.Round(f.Color.In(beerjson.Color), 2),
+		}
+		switch {
+		case f.Type == "grain" && f.GrainGroup == "adjunct", f.Type == "other":
+			fermentable.Type = "Adjunct"
+		case f.Type == "grain":
+			fermentable.Type = "Grain"
+		case f.Type == "extract":
+			fermentable.Type = "Extract"
+		case f.Type == "dry extract":
+			fermentable.Type = "Dry Extract"
+		default:
+			fermentable.Type = "Sugar"
+		}
+		if f.Yield.Potential != nil {
+			fermentable.Potential = brewcalc.Round(f.Yield.Potential.In(beerjson.Gravity), 4)
+		} else {
+			fermentable.Potential = brewcalc.Round(beerxml.YieldToPotential(f.Yield.FineGrind.In(beerjson.Percent)), 4)
+		}
+		r.Fermentables = append(r.Fermentables, fermentable)
+	}
+	for _, h := range x.Ingredients.HopAdditions {
+		hop := Hop{Name: h.Name, Weight: brewcalc.Round(h.Amount.In(beerjson.Mass)*1000, 2), Alpha: h.AlphaAcid.In(beerjson.Percent)}
+		switch {
+		case h.Timing.Use == "add_to_mash":
+			hop.Use, hop.Time = "Mash", minutes(h.Timing.Time)
+		case h.Timing.Use == "add_to_fermentation", h.Timing.Use == "add_to_package":
+			hop.Use, hop.Time = "Dry Hop", minutes(h.Timing.Duration)
+		case minutes(h.Timing.Time) == 0 && h.Timing.Duration != nil:
+			hop.Use, hop.Time = "Aroma", minutes(h.Timing.Duration)
+		default:
+			hop.Use, hop.Time = "Boil", minutes(h.Timing.Time)
+		}
+		r.Hops = append(r.Hops, hop)
+	}
+	for _, c := range x.Ingredients.CultureAdditions {
+		yeast := Yeast{Name: c.Name, Type: oneOf(c.Type, YeastTypes), Form: oneOf(c.Form, YeastForms), Attenuation: c.Attenuation.In(beerjson.Percent)}
+		if c.TemperatureRange != nil {
+			yeast.MinTemperature = brewcalc.Round(c.TemperatureRange.Minimum.In(beerjson.Temperature), 1)
+			yeast.MaxTemperature = brewcalc.Round(c.TemperatureRange.Maximum.In(beerjson.Temperature), 1)
+		}
+		r.Yeasts = append(r.Yeasts, yeast)
+	}
+	if x.Mash != nil {
+		for _, m := range x.Mash.MashSteps {
+			r.MashSteps = append(r.MashSteps, MashStep{Name: m.Name, Temperature: brewcalc.Round(m.StepTemperature.In(beerjson.Temperature), 1), Time: minutes(m.StepTime)})
+		}
+	}
+	return r
+}
+
+// ToBeerJSON converts a batch, which events and measurements must be loaded, into a BeerJSON batch and the recipe it was brewed from
+func (b Batch) ToBeerJSON() (beerjson.Batch, beerjson.Recipe, error) {
+	recipe, err := b.SnapshotRecipe()
+	if err != nil {
+		return beerjson.Batch{}, beerjson.Recipe{}, err
+	}
+	x := beerjson.Batch{
+		Recipe:      recipe.Name,
+		Date:        b.Date.Format(beerjson.DateLayout),
+		Step:        b.Step,
+		StartVolume: quantity("l", float64(b.StartVolume)),
+	}
+	for _, e := range b.Events {
+		x.Events = append(x.Events, beerjson.Event{Name: e.Name, Date: e.Date.Format(beerjson.DateLayout), Volume: quantity("l", float64(e.Volume))})
+	}
+	for _, m := range b.Measurements {
+		x.Measurements = append(x.Measurements, beerjson.Measurement{Date: m.Date.Format(time.RFC3339), Kind: m.Kind, Value: m.Value, Unit: m.Unit, Source: m.Source})
+	}
+	return x, recipe.ToBeerJSON(), nil
+}
+
+// parseDate reads a valid BeerJSON date
+func parseDate(value string) time.Time {
+	if date, err := time.Parse(beerjson.DateLayout, value); err == nil {
+		return date
+	}
+	date, _ := time.Parse(time.RFC3339, value)
+	return date
+}
+
+// liters converts a BeerJSON volume into whole liters
+func liters(q *beerjson.Quantity) int {
+	return int(math.Round(q.In(beerjson.Volume)))
+}
+
+// ImportRecipesBeerJSON creates the recipes of a BeerJSON document, all of them or none
+func ImportRecipesBeerJSON(db *gorm.DB, r io.Reader) ([]Recipe, error) {
+	doc, err := beerjson.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Recipes) == 0 {
+		return nil, errors.New("no recipe found in the BeerJSON file")
+	}
+	tx := db.Begin()
+	var recipes []Recipe
+	for _, x := range doc.Recipes {
+		recipe := RecipeFromBeerJSON(x)
+		if err := tx.Create(&recipe).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		recipes = append(recipes, recipe)
+	}
+	return recipes, tx.Commit().Error
+}
+
+// ImportBatchesBeerJSON creates the batches of a BeerJSON document with their events and measurements, along with the recipes they were brewed from, all of them or none.
+// The step change of each batch out of the plan is recorded under the given user.
+func ImportBatchesBeerJSON(db *gorm.DB, r io.Reader, user string, now time.Time) ([]Batch, error) {
+	doc, err := beerjson.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Batches) == 0 {
+		return nil, errors.New("no batch found in the BeerJSON file")
+	}
+	var errs beerjson.Errors
+	for i, x := range doc.Batches {
+		if _, ok := FindStep(x.Step); !ok {
+			errs = append(errs, beerjson.FieldError{Path: fmt.Sprintf("beerjson.batches[%d].step", i), Message: "is not a known step"})
+		}
+		for j, m := range x.Measurements {
+			path := fmt.Sprintf("beerjson.batches[%d].measurements[%d]", i, j)
+			if k, ok := FindMeasurementKind(m.Kind); !ok {
+				errs = append(errs, beerjson.FieldError{Path: path + ".kind", Message: "is not a known measurement kind"})
+			} else if !k.HasUnit(m.Unit) {
+				errs = append(errs, beerjson.FieldError{Path: path + ".unit", Message: fmt.Sprintf("must be one of %q", k.Units)})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	tx := db.Begin()
+	recipeIDs := map[string]uint{}
+	var batches []Batch
+	for _, x := range doc.Batches {
+		if _, ok := recipeIDs[x.Recipe]; !ok {
+			for _, xr := range doc.Recipes {
+				if xr.Name == x.Recipe {
+					recipe := RecipeFromBeerJSON(xr)
+					if err := tx.Create(&recipe).Error; err != nil {
+						tx.Rollback()
+						return nil, err
+					}
+					recipeIDs[x.Recipe] = recipe.ID
+					break
+				}
+			}
+		}
+		batch := Batch{RecipeID: recipeIDs[x.Recipe], Date: parseDate(x.Date), Step: x.Step, StartVolume: liters(x.StartVolume)}
+		for _, e := range x.Events {
+			batch.Events = append(batch.Events, Event{Name: e.Name, Date: parseDate(e.Date), Volume: liters(e.Volume)})
+		}
+		for _, m := range x.Measurements {
+			batch.Measurements = append(batch.Measurements, Measurement{Date: parseDate(m.Date), Kind: m.Kind, Value: m.Value, Unit: m.Unit, Source: m.Source})
+		}
+		if err := tx.Create(&batch).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		// The batch history starts with the import, as if the importing user had moved it out of the plan
+		if batch.Step != StepPlanned {
+			if err := tx.Create(&StepChange{BatchID: batch.ID, From: StepPlanned, To: batch.Step, Date: now, User: user}).Error; err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		batches = append(batches, batch)
+	}
+	return batches, tx.Commit().Error
+}
+
+// ExportRecipesBeerJSON writes the recipes, which ingredients must be loaded, as a BeerJSON document
+func ExportRecipesBeerJSON(w io.Writer, recipes ...Recipe) error {
+	var doc beerjson.BeerJSON
+	for _, r := range recipes {
+		doc.Recipes = append(doc.Recipes, r.ToBeerJSON())
+	}
+	return beerjson.Encode(w, doc)
+}
+
+// ExportBatchesBeerJSON writes the batches, with their events, their measurements and the recipes they were brewed from, as a BeerJSON document
+func ExportBatchesBeerJSON(db *gorm.DB, w io.Writer, batches ...Batch) error {
+	var doc beerjson.BeerJSON
+	snapshots, names := map[string]string{}, map[string]bool{}
+	for _, b := range batches {
+		if err := db.Where("batch_id = ?", b.ID).Order("date, id").Find(&b.Events).Error; err != nil {
+			return err
+		}
+		if err := db.Where("batch_id = ?", b.ID).Order("date, id").Find(&b.Measurements).Error; err != nil {
+			return err
+		}
+		batch, recipe, err := b.ToBeerJSON()
+		if err != nil {
+			return err
+		}
+		// The batches reference their recipe by name, the recipes that were edited between two batches get a name of their own
+		name, ok := snapshots[b.RecipeSnapshot]
+		if !ok {
+			name = recipe.Name
+			for i := 2; names[name]; i++ {
+				name = fmt.Sprintf("%v (%d)", recipe.Name, i)
+			}
+			recipe.Name = name
+			snapshots[b.RecipeSnapshot], names[name] = name, true
+			doc.Recipes = append(doc.Recipes, recipe)
+		}
+		batch.Recipe = name
+		doc.Batches = append(doc.Batches, batch)
+	}
+	return beerjson.Encode(w, doc)
+}
+
+// ServeBeerJSON serves a recipe or a batch as a BeerJSON document, from /api/recipes/{id}.beerjson or /api/batches/{id}.beerjson
+func ServeBeerJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	collection, file := path.Split(strings.TrimPrefix(r.URL.Path, "/api/"))
+	id, err := strconv.ParseUint(strings.TrimSuffix(file, ".beerjson"), 10, 64)
+	if err != nil || !strings.HasSuffix(file, ".beerjson") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch collection {
+	case "recipes/":
+		var recipe Recipe
+		if PreloadRecipe(DB).First(&recipe, id).RecordNotFound() {
+			http.NotFound(w, r)
+			return
+		}
+		err = ExportRecipesBeerJSON(w, recipe)
+	case "batches/":
+		var batch Batch
+		if DB.First(&batch, id).RecordNotFound() {
+			http.NotFound(w, r)
+			return
+		}
+		err = ExportBatchesBeerJSON(DB, w, batch)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// addFieldErrors adds the BeerJSON validation errors one by one to the action context, so that each is shown with its field path
+func addFieldErrors(argument *admin.ActionArgument, err error) error {
+	if errs, ok := err.(beerjson.Errors); ok {
+		for _, e := range errs {
+			argument.Context.AddError(e)
+		}
+		return nil
+	}
+	return err
+}
+
+// configureBeerJSON adds the BeerJSON import and export actions to the recipe and batch admins
+func configureBeerJSON(recipe *admin.Resource, batch *admin.Resource) {
+	recipe.Action(&admin.Action{
+		Name:     "Import BeerJSON",
+		Modes:    []string{"collection"},
+		Resource: newFileUpload(recipe.GetAdmin()),
+		Handler: func(argument *admin.ActionArgument) error {
+			file, ok := uploadedFile(argument)
+			if !ok {
+				return errors.New("no BeerJSON file given")
+			}
+			_, err := ImportRecipesBeerJSON(argument.Context.GetDB(), strings.NewReader(file))
+			return addFieldErrors(argument, err)
+		},
+	})
+	recipe.Action(&admin.Action{
+		Name:       "Export BeerJSON",
+		Permission: anyone,
+		Modes:      []string{"batch", "show", "menu_item"},
+		Handler: func(argument *admin.ActionArgument) error {
+			recipes, err := selectedRecipes(argument)
+			if err != nil {
+				return err
+			}
+			return ExportRecipesBeerJSON(sendFile(argument, "application/json", exportName(recipes, "json")), recipes...)
+		},
+	})
+
+	batch.Action(&admin.Action{
+		Name:     "Import BeerJSON",
+		Modes:    []string{"collection"},
+		Resource: newFileUpload(batch.GetAdmin()),
+		Handler: func(argument *admin.ActionArgument) error {
+			file, ok := uploadedFile(argument)
+			if !ok {
+				return errors.New("no BeerJSON file given")
+			}
+			_, err := ImportBatchesBeerJSON(argument.Context.GetDB(), strings.NewReader(file), userName(argument.Context.CurrentUser), time.Now())
+			return addFieldErrors(argument, err)
+		},
+	})
+	batch.Action(&admin.Action{
+		Name:       "Export BeerJSON",
+		Permission: anyone,
+		Modes:      []string{"batch", "show", "menu_item"},
+		Handler: func(argument *admin.ActionArgument) error {
+			var batches []Batch
+			for _, record := range argument.FindSelectedRecords() {
+				b, ok := record.(*Batch)
+				if !ok {
+					return errors.New("not a batch")
+				}
+				batches = append(batches, *b)
+			}
+			if len(batches) == 0 {
+				return errors.New("no batch selected")
+			}
+			fileName := "batches.json"
+			if len(batches) == 1 {
+				fileName = fmt.Sprintf("batch-%d.json", batches[0].ID)
+			}
+			return ExportBatchesBeerJSON(argument.Context.GetDB().New(), sendFile(argument, "application/json", fileName), batches...)
+		},
+	})
+}
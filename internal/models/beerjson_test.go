@@ -0,0 +1,91 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBeerJSON_RoundTrip(t *testing.T) {
+	defer initTestDB(t)()
+
+	recipe := Recipe{
+		Name:         "Pale Ale",
+		BatchSize:    20,
+		Efficiency:   72,
+		IBUFormula:   Tinseth,
+		BoilTime:     60,
+		Fermentables: []Fermentable{{Name: "Pale malt", Type: "Grain", Weight: 4.5, Color: 6.5, Potential: 1.037}, {Name: "Oats", Type: "Adjunct", Weight: 0.5, Color: 2, Potential: 1.033}},
+		Hops:         []Hop{{Name: "Cascade", Weight: 40, Alpha: 6.4, Use: "Boil", Time: 60}, {Name: "Citra", Weight: 50, Alpha: 12, Use: "Dry Hop", Time: 4320}},
+		Yeasts:       []Yeast{{Name: "US-05", Type: "Ale", Form: "Dry", Attenuation: 78, MinTemperature: 15, MaxTemperature: 24}, {Name: "WLP830", Type: "Lager", Form: "Liquid", Attenuation: 76}},
+		MashSteps:    []MashStep{{Name: "Saccharification", Temperature: 67, Time: 60}},
+	}
+	DB.Create(&recipe)
+	date := time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC)
+	batch := Batch{RecipeID: recipe.ID, Date: date, Step: StepFermenting, StartVolume: 20, Events: []Event{{Name: "Dry hopping loss", Date: date.AddDate(0, 0, 7), Volume: -1}}}
+	if err := DB.Create(&batch).Error; err != nil {
+		t.Fatal(err)
+	}
+	DB.Create(&Measurement{BatchID: batch.ID, Date: date.Add(time.Hour), Kind: KindGravity, Value: 12, Unit: "°P", Source: "iSpindel"})
+
+	// Recipes
+	var exported bytes.Buffer
+	if err := ExportRecipesBeerJSON(&exported, recipe); err != nil {
+		t.Fatal(err)
+	}
+	recipes, err := ImportRecipesBeerJSON(DB, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Recipe
+	PreloadRecipe(DB).First(&got, recipes[0].ID)
+	if !reflect.DeepEqual(withoutIDs(got), withoutIDs(recipe)) {
+		t.Errorf("got recipe %+v, want %+v", withoutIDs(got), withoutIDs(recipe))
+	}
+
+	// Batches, with the recipe they were brewed from
+	exported.Reset()
+	if err := ExportBatchesBeerJSON(DB, &exported, batch); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	batches, err := ImportBatchesBeerJSON(DB, &exported, "admin", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotBatch Batch
+	DB.Preload("Events").Preload("Measurements").First(&gotBatch, batches[0].ID)
+	if gotBatch.RecipeID == recipe.ID || !gotBatch.Date.Equal(date) || gotBatch.Step != StepFermenting || gotBatch.StartVolume != 20 || len(gotBatch.Events) != 1 || gotBatch.Events[0].Volume != -1 ||
+		len(gotBatch.Measurements) != 1 || !gotBatch.Measurements[0].Date.Equal(date.Add(time.Hour)) || gotBatch.Measurements[0].Unit != "°P" || gotBatch.Measurements[0].Source != "iSpindel" {
+		t.Errorf("got batch %+v, want a copy of %+v with a new recipe", gotBatch, batch)
+	}
+	snapshot, _ := gotBatch.SnapshotRecipe()
+	if snapshot.Name != "Pale Ale" || len(snapshot.Hops) != 2 {
+		t.Errorf("got batch recipe %+v, want the Pale Ale", snapshot)
+	}
+	var changes []StepChange
+	DB.Where("batch_id = ?", gotBatch.ID).Find(&changes)
+	if len(changes) != 1 || changes[0].From != StepPlanned || changes[0].To != StepFermenting || changes[0].User != "admin" || !changes[0].Date.Equal(now) {
+		t.Errorf("got step changes %+v, want the import out of the plan", changes)
+	}
+
+	// Batches of a recipe edited in between, each linked to the recipe as it was brewed
+	DB.Model(&recipe.Hops[1]).Update("weight", 80)
+	later := Batch{RecipeID: recipe.ID, Date: date.AddDate(0, 0, 14), Step: StepPlanned, StartVolume: 20}
+	DB.Create(&later)
+	exported.Reset()
+	if err := ExportBatchesBeerJSON(DB, &exported, batch, later); err != nil {
+		t.Fatal(err)
+	}
+	batches, err = ImportBatchesBeerJSON(DB, &exported, "admin", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{50, 80} {
+		snapshot, _ := batches[i].SnapshotRecipe()
+		if len(snapshot.Hops) != 2 || snapshot.Hops[1].Weight != want {
+			t.Errorf("got batch %v recipe %+v, want %v g of Citra", i, snapshot, want)
+		}
+	}
+}
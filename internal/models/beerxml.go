@@ -0,0 +1,201 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/beerxml"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+)
+
+// ToBeerXML converts a recipe, which ingredients must be loaded, into a BeerXML recipe
+func (r Recipe) ToBeerXML() beerxml.Recipe {
+	x := beerxml.Recipe{
+		Name:       r.Name,
+		Type:       "All Grain",
+		BatchSize:  r.BatchSize,
+		BoilSize:   r.BatchSize,
+		BoilTime:   float64(r.BoilTime),
+		Efficiency: r.Efficiency,
+		IBUMethod:  r.IBUFormula,
+		PrimaryAge: float64(r.FermentationDays),
+		Age:        float64(r.ConditioningDays),
+		Mash:       beerxml.Mash{Name: r.Name},
+	}
+	for _, f := range r.Fermentables {
+		x.Fermentables = append(x.Fermentables, beerxml.Fermentable{
+			Name:      f.Name,
+			Type:      f.Type,
+			Amount:    f.Weight,
+			Yield:     brewcalc.Round(beerxml.PotentialToYield(f.Potential), 1),
+			Color:     brewcalc.EBCToSRM(f.Color),
+			Potential: f.Potential,
+		})
+	}
+	for _, h := range r.Hops {
+		x.Hops = append(x.Hops, beerxml.Hop{Name: h.Name, Alpha: h.Alpha, Amount: h.Weight / 1000, Use: h.Use, Time: float64(h.Time)})
+	}
+	for _, y := range r.Yeasts {
+		x.Yeasts = append(x.Yeasts, beerxml.Yeast{
+			Name:           y.Name,
+			Type:           y.Type,
+			Form:           y.Form,
+			Attenuation:    y.Attenuation,
+			MinTemperature: y.MinTemperature,
+			MaxTemperature: y.MaxTemperature,
+		})
+	}
+	for _, m := range r.MashSteps {
+		x.Mash.MashSteps = append(x.Mash.MashSteps, beerxml.MashStep{Name: m.Name, Type: "Infusion", StepTemp: m.Temperature, StepTime: float64(m.Time)})
+	}
+	return x
+}
+
+// RecipeFromBeerXML converts a BeerXML recipe into a recipe, rounding the converted units so that our own exports give back the same recipe
+func RecipeFromBeerXML(x beerxml.Recipe) Recipe {
+	r := Recipe{
+		Name:       x.Name,
+		BatchSize:  x.BatchSize,
+		Efficiency: x.Efficiency,
+		BoilTime:   int(math.Round(x.BoilTime)),
+		// The ages are in days
+		FermentationDays: int(math.Round(x.PrimaryAge)),
+		ConditioningDays: int(math.Round(x.Age)),
+	}
+	for _, formula := range []string{Tinseth, Rager} {
+		if strings.EqualFold(x.IBUMethod, formula) {
+			r.IBUFormula = formula
+		}
+	}
+	for _, f := range x.Fermentables {
+		// The potential is an extension, standard files only give the yield
+		potential := f.Potential
+		if potential <= 0 {
+			potential = brewcalc.Round(beerxml.YieldToPotential(f.Yield), 3)
+		}
+		r.Fermentables = append(r.Fermentables, Fermentable{
+			Name:      f.Name,
+			Type:      f.Type,
+			Weight:    f.Amount,
+			Color:     brewcalc.Round(brewcalc.SRMToEBC(f.Color), 2),
+			Potential: potential,
+		})
+	}
+	for _, h := range x.Hops {
+		r.Hops = append(r.Hops, Hop{Name: h.Name, Weight: brewcalc.Round(h.Amount*1000, 3), Alpha: h.Alpha, Use: h.Use, Time: int(math.Round(h.Time))})
+	}
+	for _, y := range x.Yeasts {
+		r.Yeasts = append(r.Yeasts, Yeast{
+			Name:           y.Name,
+			Type:           oneOf(y.Type, YeastTypes),
+			Form:           oneOf(y.Form, YeastForms),
+			Attenuation:    y.Attenuation,
+			MinTemperature: y.MinTemperature,
+			MaxTemperature: y.MaxTemperature,
+		})
+	}
+	for _, m := range x.Mash.MashSteps {
+		r.MashSteps = append(r.MashSteps, MashStep{Name: m.Name, Temperature: m.StepTemp, Time: int(math.Round(m.StepTime))})
+	}
+	return r
+}
+
+// oneOf gives the value of the list matching the given value whatever its case, or nothing
+func oneOf(value string, values []string) string {
+	for _, v := range values {
+		if strings.EqualFold(value, v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// ImportBeerXML creates the recipes of a BeerXML document, all of them or none
+func ImportBeerXML(db *gorm.DB, r io.Reader) ([]Recipe, error) {
+	xmlRecipes, err := beerxml.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BeerXML file: %v", err)
+	}
+	if len(xmlRecipes) == 0 {
+		return nil, errors.New("no recipe found in the BeerXML file")
+	}
+	tx := db.Begin()
+	var recipes []Recipe
+	for _, x := range xmlRecipes {
+		recipe := RecipeFromBeerXML(x)
+		if err := tx.Create(&recipe).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		recipes = append(recipes, recipe)
+	}
+	return recipes, tx.Commit().Error
+}
+
+// ExportBeerXML writes the recipes, which ingredients must be loaded, as a BeerXML document
+func ExportBeerXML(w io.Writer, recipes ...Recipe) error {
+	var xmlRecipes []beerxml.Recipe
+	for _, r := range recipes {
+		xmlRecipes = append(xmlRecipes, r.ToBeerXML())
+	}
+	return beerxml.Encode(w, xmlRecipes)
+}
+
+// configureBeerXML adds the BeerXML import and export actions to the recipe admin
+func configureBeerXML(recipe *admin.Resource) {
+	recipe.Action(&admin.Action{
+		Name:     "Import BeerXML",
+		Modes:    []string{"collection"},
+		Resource: newFileUpload(recipe.GetAdmin()),
+		Handler: func(argument *admin.ActionArgument) error {
+			file, ok := uploadedFile(argument)
+			if !ok {
+				return errors.New("no BeerXML file given")
+			}
+			_, err := ImportBeerXML(argument.Context.GetDB(), strings.NewReader(file))
+			return err
+		},
+	})
+
+	recipe.Action(&admin.Action{
+		Name:       "Export BeerXML",
+		Permission: anyone,
+		Modes:      []string{"batch", "show", "menu_item"},
+		Handler: func(argument *admin.ActionArgument) error {
+			recipes, err := selectedRecipes(argument)
+			if err != nil {
+				return err
+			}
+			return ExportBeerXML(sendFile(argument, "application/xml; charset=utf-8", exportName(recipes, "xml")), recipes...)
+		},
+	})
+}
+
+// selectedRecipes gives the recipes an action is run on
+func selectedRecipes(argument *admin.ActionArgument) ([]Recipe, error) {
+	var recipes []Recipe
+	for _, record := range argument.FindSelectedRecords() {
+		r, ok := record.(*Recipe)
+		if !ok {
+			return nil, errors.New("not a recipe")
+		}
+		recipes = append(recipes, *r)
+	}
+	if len(recipes) == 0 {
+		return nil, errors.New("no recipe selected")
+	}
+	return recipes, nil
+}
+
+// exportName gives the name of the file exporting the recipes
+func exportName(recipes []Recipe, extension string) string {
+	if len(recipes) == 1 {
+		return recipes[0].Name + "." + extension
+	}
+	return "recipes." + extension
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBeerXML_RoundTrip(t *testing.T) {
+	defer initTestDB(t)()
+
+	recipe := Recipe{
+		Name:             "Pale Ale",
+		BatchSize:        20,
+		Efficiency:       72,
+		IBUFormula:       Rager,
+		BoilTime:         60,
+		FermentationDays: 14,
+		ConditioningDays: 21,
+		Fermentables:     []Fermentable{{Name: "Pale malt", Type: "Grain", Weight: 4.5, Color: 6.55, Potential: 1.037}, {Name: "Sugar", Type: "Sugar", Weight: 0.3, Potential: 1.046}},
+		Hops:             []Hop{{Name: "Cascade", Weight: 42.5, Alpha: 6.4, Use: "Boil", Time: 60}, {Name: "Citra", Weight: 50, Alpha: 12, Use: "Dry Hop"}},
+		Yeasts:           []Yeast{{Name: "W-34/70", Type: "Lager", Form: "Dry", Attenuation: 83, MinTemperature: 9, MaxTemperature: 22}, {Name: "US-05", Attenuation: 78, MinTemperature: 15, MaxTemperature: 24}},
+		MashSteps:        []MashStep{{Name: "Saccharification", Temperature: 67, Time: 60}, {Name: "Mash out", Temperature: 78, Time: 10}},
+	}
+	var exported bytes.Buffer
+	if err := ExportBeerXML(&exported, recipe); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(exported.String(), "<TYPE>Lager</TYPE>") || strings.Count(exported.String(), "<FORM>") != 1 {
+		t.Errorf("got yeasts exported as %v, want the lager type and form and nothing for the other yeast", exported.String())
+	}
+	imported, err := ImportBeerXML(DB, &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("got %v imported recipes, want 1", len(imported))
+	}
+	var got Recipe
+	PreloadRecipe(DB).First(&got, imported[0].ID)
+	if !reflect.DeepEqual(withoutIDs(got), withoutIDs(recipe)) {
+		t.Errorf("got recipe %+v, want %+v", withoutIDs(got), withoutIDs(recipe))
+	}
+}
+
+func TestImportBeerXML_Invalid(t *testing.T) {
+	defer initTestDB(t)()
+
+	for _, doc := range []string{"not xml", "<RECIPES></RECIPES>"} {
+		if _, err := ImportBeerXML(DB, strings.NewReader(doc)); err == nil {
+			t.Errorf("got no error importing %q", doc)
+		}
+	}
+}
+
+// withoutIDs clears the database fields of a recipe and its ingredients, to compare their content
+func withoutIDs(r Recipe) Recipe {
+	r.Model = Recipe{}.Model
+	for i := range r.Fermentables {
+		r.Fermentables[i].Model, r.Fermentables[i].RecipeID = Fermentable{}.Model, 0
+	}
+	for i := range r.Hops {
+		r.Hops[i].Model, r.Hops[i].RecipeID = Hop{}.Model, 0
+	}
+	for i := range r.Yeasts {
+		r.Yeasts[i].Model, r.Yeasts[i].RecipeID = Yeast{}.Model, 0
+	}
+	for i := range r.MashSteps {
+		r.MashSteps[i].Model, r.MashSteps[i].RecipeID = MashStep{}.Model, 0
+	}
+	return r
+}
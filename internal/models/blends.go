@@ -0,0 +1,281 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Blend errors
+const (
+	errBlendSources  = "A blend needs at least two sources"
+	errBlendVolume   = "The blended volumes must be positive"
+	errNotBlendable  = "This batch can't be blended at its step"
+	errBlendFinished = "A blend can't be changed once made"
+)
+
+// Blend takes volumes of several batches from their containers and mixes them in a container as a new batch, the child of the source batches
+type Blend struct {
+	gorm.Model
+	Date        time.Time
+	Batch       Batch     `gorm:"association_autoupdate:false;association_autocreate:false"` // the child batch
+	BatchID     uint      `gorm:"index"`
+	Container   Container `gorm:"association_autoupdate:false;association_autocreate:false"` // where the blend is made
+	ContainerID uint
+	Sources     []BlendSource
+	Volume      int
+	ABV         float64 // %, the sources ABV weighted by their volumes
+	User        string
+}
+
+// BlendSource is a volume of a parent batch taken from a container for a blend
+type BlendSource struct {
+	gorm.Model
+	BlendID     uint      `gorm:"index"`
+	Batch       Batch     `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID     uint      `gorm:"index"`
+	Container   Container `gorm:"association_autoupdate:false;association_autocreate:false"`
+	ContainerID uint
+	Volume      int
+}
+
+// batchABV gives the ABV of a batch from its readings, from its blend or else from its recipe
+func batchABV(tx *gorm.DB, b Batch) (float64, error) {
+	if err := LoadBatches(tx, &b); err != nil {
+		return 0, err
+	}
+	if b.ABV != 0 {
+		return b.ABV, nil
+	}
+	recipe, err := b.SnapshotRecipe()
+	if err != nil {
+		return 0, err
+	}
+	return recipe.Estimate().ABV, nil
+}
+
+// BeforeCreate checks the sources, works out the blend volume and ABV, and creates the child batch
+func (d *Blend) BeforeCreate(tx *gorm.DB) error {
+	tx = tx.New() // drops the admin search conditions, keeping the transaction
+	if len(d.Sources) < 2 {
+		return validations.NewError(d, "Sources", errBlendSources)
+	}
+	if d.Date.IsZero() {
+		d.Date = time.Now()
+	}
+	d.Volume = 0
+	var main Batch
+	var mainVolume int
+	var names []string
+	var alcohol float64
+	for i := range d.Sources {
+		s := &d.Sources[i]
+		s.BatchID = keyOf(s.BatchID, s.Batch.ID)
+		s.ContainerID = keyOf(s.ContainerID, s.Container.ID)
+		if s.Volume <= 0 {
+			return validations.NewError(d, "Sources", errBlendVolume)
+		}
+		var parent Batch
+		if err := tx.First(&parent, s.BatchID).Error; err != nil {
+			return err
+		}
+		if _, ok := FindTransition(parent.Step, StepMixed); !ok {
+			return validations.NewError(d, "Sources", errNotBlendable)
+		}
+		abv, err := batchABV(tx, parent)
+		if err != nil {
+			return err
+		}
+		alcohol += abv * float64(s.Volume)
+		d.Volume += s.Volume
+		if s.Volume > mainVolume {
+			main, mainVolume = parent, s.Volume
+		}
+		if name := parent.Stringify(); !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	// The ABV is kept unrounded so that the pure alcohol of the child is the one of its parents, it is only rounded for display
+	d.ABV = alcohol / float64(d.Volume)
+
+	// The child batch is named after its parents, and takes the recipe of the main one
+	recipe, err := main.SnapshotRecipe()
+	if err != nil {
+		return err
+	}
+	recipe.Name = "Blend of " + strings.Join(names, ", ")
+	snapshot, err := json.Marshal(recipe)
+	if err != nil {
+		return err
+	}
+	child := Batch{RecipeID: main.RecipeID, RecipeSnapshot: string(snapshot), Date: d.Date, Step: StepConditioning}
+	if err := tx.Create(&child).Error; err != nil {
+		return err
+	}
+	// The child history starts with the blend, as if the blender had moved it out of the plan into conditioning
+	if err := tx.Create(&StepChange{BatchID: child.ID, From: StepPlanned, To: StepConditioning, Date: d.Date, User: d.User}).Error; err != nil {
+		return err
+	}
+	d.BatchID = child.ID
+	return nil
+}
+
+// containsString tells if the string is in the list
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// BeforeUpdate prevents a blend from being changed once made, as its child batch may have been transferred or sold since
+func (d *Blend) BeforeUpdate() error {
+	return validations.NewError(d, "Sources", errBlendFinished)
+}
+
+// AfterCreate moves the blended volumes into the child batch in the stock ledger, checks the stocks, and marks the parents fully blended as mixed
+func (d *Blend) AfterCreate(tx *gorm.DB) error {
+	tx = tx.New()
+	entries, err := ledgerEntries(tx, d)
+	if err != nil {
+		return err
+	}
+	if err := writeEntries(tx, sourceBlend, d.ID, entries); err != nil {
+		return err
+	}
+	for _, s := range d.Sources {
+		if err := validateSource(tx, d, s.BatchID, s.ContainerID); err != nil {
+			return err
+		}
+	}
+	if err := validateCapacity(tx, d, d.ContainerID); err != nil {
+		return err
+	}
+	var parents []uint
+	for _, s := range d.Sources {
+		if !containsID(parents, s.BatchID) {
+			parents = append(parents, s.BatchID)
+		}
+	}
+	for _, id := range parents {
+		var parent Batch
+		if err := tx.First(&parent, id).Error; err != nil {
+			return err
+		}
+		if err := LoadStock(tx, &parent); err != nil {
+			return err
+		}
+		left := 0
+		for _, s := range parent.Stocks {
+			left += s.Volume
+		}
+		if left > 0 {
+			continue
+		}
+		t, _ := FindTransition(parent.Step, StepMixed)
+		if err := moveStep(tx, &parent, t, d.User, d.Date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadBlends names the parents and children of the given batches, and gives the blended batches without readings the ABV of their blend
+func LoadBlends(db *gorm.DB, batches ...*Batch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, b := range batches {
+		ids = append(ids, b.ID)
+	}
+	var rows []struct {
+		ParentID uint
+		ChildID  uint
+		ABV      float64
+		Volume   int
+	}
+	err := db.Table("blend_sources").Select("blend_sources.batch_id AS parent_id, blends.batch_id AS child_id, blends.abv, SUM(blend_sources.volume) AS volume").
+		Joins("JOIN blends ON blends.id = blend_sources.blend_id AND blends.deleted_at IS NULL").
+		Where("blend_sources.deleted_at IS NULL AND (blend_sources.batch_id IN (?) OR blends.batch_id IN (?))", ids, ids).
+		Group("blend_sources.batch_id, blends.batch_id, blends.abv").Order("blends.batch_id, blend_sources.batch_id").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	var linkedIDs []uint
+	for _, r := range rows {
+		linkedIDs = append(linkedIDs, r.ParentID, r.ChildID)
+	}
+	var linked []Batch
+	if len(linkedIDs) > 0 {
+		if err := db.Where("id IN (?)", linkedIDs).Find(&linked).Error; err != nil {
+			return err
+		}
+	}
+	name := func(id uint) string {
+		for _, b := range linked {
+			if b.ID == id {
+				return b.Stringify()
+			}
+		}
+		return fmt.Sprintf("#%d", id)
+	}
+	for _, b := range batches {
+		var from, into []string
+		for _, r := range rows {
+			if r.ChildID == b.ID {
+				from = append(from, fmt.Sprintf("%s: %d", name(r.ParentID), r.Volume))
+				if b.ABV == 0 {
+					b.ABV = r.ABV
+				}
+			}
+			if r.ParentID == b.ID {
+				into = append(into, fmt.Sprintf("%s: %d", name(r.ChildID), r.Volume))
+			}
+		}
+		b.BlendedFrom, b.BlendedInto = strings.Join(from, ", "), strings.Join(into, ", ")
+		if b.Step == StepMixed && len(into) > 0 {
+			b.Stock = "blended into " + b.BlendedInto
+		}
+	}
+	return nil
+}
+
+// configureBlends adds the blends admin, made by anyone but never changed, and shows the blend links on the batches
+func configureBlends(Admin *admin.Admin, batch *admin.Resource) {
+	blend := Admin.AddResource(&Blend{}, &admin.Config{Menu: []string{"Batches"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.Create, roles.Anyone)})
+	blend.IndexAttrs("Date", "Batch", "Container", "Volume", "ABV", "User")
+	blend.NewAttrs("Date", "Container", "Sources")
+	blend.ShowAttrs("Date", "Batch", "Container", "Sources", "Volume", "ABV", "User")
+	blend.Meta(&admin.Meta{Name: "ABV", Type: "readonly", Valuer: func(record interface{}, context *qor.Context) interface{} {
+		if d, ok := record.(*Blend); ok {
+			return brewcalc.Round(d.ABV, 1)
+		}
+		return nil
+	}})
+	sources := blend.Meta(&admin.Meta{Name: "Sources"}).Resource
+	sources.NewAttrs("Batch", "Container", "Volume")
+
+	save := blend.SaveHandler
+	blend.SaveHandler = func(result interface{}, context *qor.Context) error {
+		if d, ok := result.(*Blend); ok {
+			d.User = userName(context.CurrentUser)
+		}
+		return save(result, context)
+	}
+
+	for _, name := range []string{"BlendedFrom", "BlendedInto"} {
+		batch.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	}
+}
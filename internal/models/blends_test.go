@@ -0,0 +1,110 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBlend(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	fermenter, _ := fermenterID(DB)
+	tank, small := Container{Name: "Tank", Volume: 100}, Container{Name: "Small", Volume: 10}
+	DB.Create(&tank)
+	DB.Create(&small)
+	blonde := Batch{Recipe: Recipe{Name: "Blonde"}, Step: StepFermenting, StartVolume: 20, Date: date}
+	amber := Batch{Recipe: Recipe{Name: "Amber"}, Step: StepConditioning, StartVolume: 30, Date: date}
+	stout := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepPackaged, StartVolume: 30, Date: date}
+	for _, b := range []*Batch{&blonde, &amber, &stout} {
+		DB.Create(b)
+	}
+	for _, m := range []Measurement{{BatchID: blonde.ID, Kind: KindGravity, Value: 1.050, Date: date}, {BatchID: blonde.ID, Kind: KindGravity, Value: 1.010, Date: date.AddDate(0, 0, 7)}, {BatchID: amber.ID, Kind: KindGravity, Value: 1.060, Date: date}, {BatchID: amber.ID, Kind: KindGravity, Value: 1.012, Date: date.AddDate(0, 0, 7)}} {
+		DB.Create(&m)
+	}
+	blondeABV, _ := batchABV(DB, blonde)
+	amberABV, _ := batchABV(DB, amber)
+
+	var count int
+	tests := []struct {
+		name    string
+		blend   Blend
+		wantErr bool
+	}{
+		{"one_source", Blend{ContainerID: tank.ID, Sources: []BlendSource{{BatchID: blonde.ID, ContainerID: fermenter, Volume: 20}}}, true},
+		{"not_blendable_step", Blend{ContainerID: tank.ID, Sources: []BlendSource{{BatchID: blonde.ID, ContainerID: fermenter, Volume: 20}, {BatchID: stout.ID, ContainerID: fermenter, Volume: 10}}}, true},
+		{"not_enough_beer", Blend{ContainerID: tank.ID, Sources: []BlendSource{{BatchID: blonde.ID, ContainerID: fermenter, Volume: 25}, {BatchID: amber.ID, ContainerID: fermenter, Volume: 10}}}, true},
+		{"over_capacity", Blend{ContainerID: small.ID, Sources: []BlendSource{{BatchID: blonde.ID, ContainerID: fermenter, Volume: 20}, {BatchID: amber.ID, ContainerID: fermenter, Volume: 10}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DB.Create(&tt.blend).Error; (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if DB.Model(Batch{}).Count(&count); count != 3 {
+		t.Errorf("got %v batches, want the failed blends to create no batch", count)
+	}
+
+	blend := Blend{Date: date.AddDate(0, 0, 14), ContainerID: tank.ID, User: "USER", Sources: []BlendSource{{BatchID: blonde.ID, ContainerID: fermenter, Volume: 20}, {BatchID: amber.ID, ContainerID: fermenter, Volume: 10}}}
+	if err := DB.Create(&blend).Error; err != nil {
+		t.Fatal(err)
+	}
+	if blend.Volume != 30 || blend.ABV != (20*blondeABV+10*amberABV)/30 {
+		t.Errorf("got blend of %v L at %v %%, want 30 L at the weighted ABV", blend.Volume, blend.ABV)
+	}
+
+	// The child holds the blended beer, the parents show where theirs went, and no beer was lost
+	var child Batch
+	DB.First(&child, blend.BatchID)
+	batches := []*Batch{&child, &blonde, &amber}
+	for _, b := range batches {
+		DB.First(b, b.ID)
+	}
+	if err := LoadBatches(DB, batches...); err != nil {
+		t.Fatal(err)
+	}
+	if child.Stringify() != "#4 Blend of #1 Blonde, #2 Amber" || child.Step != StepConditioning || child.CurrentVolume != 30 || child.Stock != "Tank: 30" || child.ABV != blend.ABV {
+		t.Errorf("got child %v at %v with %v L (%v) at %v %%, want the blend in the tank", child.Stringify(), child.Step, child.CurrentVolume, child.Stock, child.ABV)
+	}
+	if blonde.Step != StepMixed || blonde.CurrentVolume != 0 || blonde.Stock != "blended into #4 Blend of #1 Blonde, #2 Amber: 20" {
+		t.Errorf("got blonde at %v with %v L (%v), want it mixed and moved", blonde.Step, blonde.CurrentVolume, blonde.Stock)
+	}
+	var changes []StepChange
+	DB.Where("batch_id = ?", child.ID).Find(&changes)
+	if len(changes) != 1 || changes[0].To != StepConditioning || changes[0].User != "USER" || !changes[0].Date.Equal(blend.Date) {
+		t.Errorf("got child step changes %+v, want the blend moving it into conditioning", changes)
+	}
+	if amber.Step != StepConditioning || amber.CurrentVolume != 20 || child.BlendedFrom != "#1 Blonde: 20, #2 Amber: 10" {
+		t.Errorf("got amber at %v with %v L, child blended from %v, want amber partly blended", amber.Step, amber.CurrentVolume, child.BlendedFrom)
+	}
+	var total struct{ Volume int }
+	DB.Table("stock_entries").Select("SUM(volume) AS volume").Scan(&total)
+	if total.Volume != 80 {
+		t.Errorf("got %v L in stock, want the 80 L brewed", total.Volume)
+	}
+
+	// The ledger rebuilds to the same stocks, and the blend is traced
+	if err := RebuildLedger(DB); err != nil {
+		t.Fatal(err)
+	}
+	LoadBatches(DB, batches...)
+	if child.Stock != "Tank: 30" || amber.CurrentVolume != 20 {
+		t.Errorf("got child %v and amber %v L after rebuilding the ledger, want them unchanged", child.Stock, amber.CurrentVolume)
+	}
+	tr, err := TraceBatch(DB, child.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Batches) != 3 || !reflect.DeepEqual(tr.Batches[2].BlendedFrom, []uint{blonde.ID, amber.ID}) {
+		t.Errorf("got trace %+v, want the child blended from both parents", tr.Batches)
+	}
+
+	// A blend can't be changed
+	blend.Volume = 40
+	if err := DB.Save(&blend).Error; err == nil {
+		t.Error("got no error changing a blend")
+	}
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+)
+
+// IBU formulas
+const (
+	Tinseth = "Tinseth"
+	Rager   = "Rager"
+)
+
+// Defaults used when the recipe doesn't tell
+const (
+	defaultEfficiency  = 75.0
+	defaultAttenuation = 75.0
+)
+
+// Estimates are the computed characteristics of a recipe
+type Estimates struct {
+	BatchSize       float64 // L
+	OriginalGravity float64
+	FinalGravity    float64
+	ABV             float64 // %
+	IBU             float64
+	SRM             float64
+	EBC             float64
+}
+
+// Estimate works out the recipe characteristics from its ingredients, which must be loaded
+func (r Recipe) Estimate() Estimates {
+	e := Estimates{BatchSize: r.BatchSize}
+	efficiency := r.Efficiency
+	if efficiency <= 0 {
+		efficiency = defaultEfficiency
+	}
+
+	// Gravities and alcohol
+	var points, mcu float64
+	for _, f := range r.Fermentables {
+		// Sugars and extracts are fully dissolved, whatever the brewhouse efficiency
+		fermentableEfficiency := efficiency
+		if f.Type != "" && f.Type != "Grain" && f.Type != "Adjunct" {
+			fermentableEfficiency = 100
+		}
+		points += brewcalc.ExtractPoints(f.Potential, f.Weight, fermentableEfficiency, r.BatchSize)
+		mcu += brewcalc.MaltColorUnits(f.Color, f.Weight, r.BatchSize)
+	}
+	og := brewcalc.Gravity(points)
+	attenuation := 0.0
+	for _, y := range r.Yeasts {
+		if y.Attenuation > attenuation {
+			attenuation = y.Attenuation
+		}
+	}
+	if attenuation <= 0 {
+		attenuation = defaultAttenuation
+	}
+	fg := brewcalc.FinalGravity(og, attenuation)
+	e.OriginalGravity = brewcalc.Round(og, 3)
+	e.FinalGravity = brewcalc.Round(fg, 3)
+	e.ABV = brewcalc.Round(brewcalc.ABV(og, fg), 1)
+
+	// Bitterness, only the boiled hops count
+	formula := brewcalc.Tinseth
+	if r.IBUFormula == Rager {
+		formula = brewcalc.Rager
+	}
+	var ibu float64
+	for _, h := range r.Hops {
+		switch h.Use {
+		case "Boil", "":
+			ibu += formula(h.Alpha, h.Weight, float64(h.Time), r.BatchSize, og)
+		case "First Wort":
+			ibu += formula(h.Alpha, h.Weight, float64(r.BoilTime), r.BatchSize, og)
+		}
+	}
+	e.IBU = brewcalc.Round(ibu, 1)
+
+	// Color
+	if mcu > 0 {
+		srm := brewcalc.Morey(mcu)
+		e.SRM = brewcalc.Round(srm, 1)
+		e.EBC = brewcalc.Round(brewcalc.SRMToEBC(srm), 1)
+	}
+	return e
+}
+
+// LoadIngredients loads the ingredients and mash steps of the given recipes, with one query for each kind
+func LoadIngredients(db *gorm.DB, recipes ...*Recipe) error {
+	if len(recipes) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, r := range recipes {
+		ids = append(ids, r.ID)
+	}
+	var fermentables []Fermentable
+	var hops []Hop
+	var yeasts []Yeast
+	var mashSteps []MashStep
+	for _, lines := range []interface{}{&fermentables, &hops, &yeasts, &mashSteps} {
+		if err := db.Where("recipe_id IN (?)", ids).Order("id").Find(lines).Error; err != nil {
+			return err
+		}
+	}
+	for _, r := range recipes {
+		r.Fermentables, r.Hops, r.Yeasts, r.MashSteps = nil, nil, nil, nil
+		for _, f := range fermentables {
+			if f.RecipeID == r.ID {
+				r.Fermentables = append(r.Fermentables, f)
+			}
+		}
+		for _, h := range hops {
+			if h.RecipeID == r.ID {
+				r.Hops = append(r.Hops, h)
+			}
+		}
+		for _, y := range yeasts {
+			if y.RecipeID == r.ID {
+				r.Yeasts = append(r.Yeasts, y)
+			}
+		}
+		for _, m := range mashSteps {
+			if m.RecipeID == r.ID {
+				r.MashSteps = append(r.MashSteps, m)
+			}
+		}
+	}
+	return nil
+}
+
+// configureEstimates adds the recipe estimates as read only metas, and loads the ingredients they need with the recipes
+func configureEstimates(recipe *admin.Resource) {
+	recipe.Meta(&admin.Meta{Name: "IBUFormula", Label: "IBU Formula", Type: "select_one", Config: &admin.SelectOneConfig{Collection: []string{Tinseth, Rager}}})
+
+	estimates := []struct {
+		name  string
+		value func(Estimates) float64
+	}{
+		{"OriginalGravity", func(e Estimates) float64 { return e.OriginalGravity }},
+		{"FinalGravity", func(e Estimates) float64 { return e.FinalGravity }},
+		{"ABV", func(e Estimates) float64 { return e.ABV }},
+		{"IBU", func(e Estimates) float64 { return e.IBU }},
+		{"SRM", func(e Estimates) float64 { return e.SRM }},
+		{"EBC", func(e Estimates) float64 { return e.EBC }},
+	}
+	for _, e := range estimates {
+		value := e.value
+		recipe.Meta(&admin.Meta{
+			Name:   e.name,
+			Type:   "readonly",
+			Setter: func(interface{}, *resource.MetaValue, *qor.Context) {},
+			Valuer: func(record interface{}, context *qor.Context) interface{} {
+				if r, ok := record.(*Recipe); ok {
+					return value(r.Estimate())
+				}
+				return nil
+			},
+		})
+	}
+
+	findMany := recipe.FindManyHandler
+	recipe.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findMany(result, context); err != nil {
+			return err
+		}
+		if recipes, ok := result.(*[]*Recipe); ok {
+			return LoadIngredients(context.GetDB().New(), *recipes...)
+		}
+		return nil
+	}
+	findOne := recipe.FindOneHandler
+	recipe.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOne(result, metaValues, context); err != nil {
+			return err
+		}
+		if r, ok := result.(*Recipe); ok {
+			return LoadIngredients(context.GetDB().New(), r)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/ical"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+)
+
+// CalendarPastDays is the number of past days the calendar feeds go back to
+var CalendarPastDays = 90
+
+var errInvalidFeedToken = errors.New("invalid calendar feed token")
+
+// CalendarFeed is the calendar feed of a user, authenticated by its own token as calendar applications can't log in
+type CalendarFeed struct {
+	gorm.Model
+	User        string `gorm:"unique_index"`
+	TokenHash   string
+	LastFetched *time.Time
+}
+
+// NewCalendarToken gives the user a new random calendar feed token and returns it, the former one stops working
+func NewCalendarToken(db *gorm.DB, user string) (string, error) {
+	if user == "" {
+		return "", errors.New("no user given")
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	// The feed revoked by an admin is given back
+	var f CalendarFeed
+	if err := db.Unscoped().Where(CalendarFeed{User: user}).FirstOrInit(&f).Error; err != nil {
+		return "", err
+	}
+	f.TokenHash, f.DeletedAt = hashToken(token), nil
+	return token, db.Unscoped().Save(&f).Error
+}
+
+// FindCalendarFeed finds the calendar feed of a token
+func FindCalendarFeed(db *gorm.DB, token string) (CalendarFeed, error) {
+	var f CalendarFeed
+	if token == "" || db.Where("token_hash = ?", hashToken(token)).First(&f).RecordNotFound() {
+		return f, errInvalidFeedToken
+	}
+	return f, nil
+}
+
+// isMidnight tells if the time is at midnight, as the days without time
+func isMidnight(t time.Time) bool {
+	return t.Equal(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()))
+}
+
+// calendarEvent makes an event, lasting the day if the date has no time and an hour otherwise, linked to the admin page of the path
+func calendarEvent(baseURL, uid string, stamp, date time.Time, summary, description, path string) ical.Event {
+	return ical.Event{
+		UID:         uid + "@" + strings.TrimPrefix(strings.TrimPrefix(baseURL, "https://"), "http://"),
+		Stamp:       stamp,
+		Start:       date,
+		End:         date.Add(time.Hour),
+		AllDay:      isMidnight(date),
+		Summary:     summary,
+		Description: description,
+		URL:         baseURL + "/admin/" + path,
+	}
+}
+
+// CalendarEvents gives the events of the brewery from the day : the planned brew days, the transfers recorded or expected from the reservations,
+// the packaging runs recorded or expected at the end of the conditioning reservations, and the cleaning tasks of the reserved containers
+func CalendarEvents(db *gorm.DB, baseURL string, from time.Time) ([]ical.Event, error) {
+	var events []ical.Event
+	var batches []Batch
+	if err := db.Where("step IN (?) AND date >= ?", []string{StepPlanned, StepBrewing}, from).Find(&batches).Error; err != nil {
+		return nil, err
+	}
+	for _, b := range batches {
+		events = append(events, calendarEvent(baseURL, fmt.Sprintf("batch-%d-brew", b.ID), b.UpdatedAt, b.Date, "Brew day : "+b.Stringify(), fmt.Sprintf("%d L", b.StartVolume), fmt.Sprintf("batches/%d", b.ID)))
+	}
+
+	var transfers []Transfer
+	if err := db.Preload("From").Preload("To").Where("date >= ?", from).Find(&transfers).Error; err != nil {
+		return nil, err
+	}
+	var runs []PackagingRun
+	if err := db.Preload("Format").Where("date >= ?", from).Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	var reservations []Reservation
+	if err := db.Preload("Container").Where(`"end" >= ?`, from).Order("batch_id, start").Find(&reservations).Error; err != nil {
+		return nil, err
+	}
+	var ids []uint
+	for _, t := range transfers {
+		ids = append(ids, t.BatchID)
+	}
+	for _, r := range runs {
+		ids = append(ids, r.BatchID)
+	}
+	for _, r := range reservations {
+		ids = append(ids, r.BatchID)
+	}
+	names := map[uint]string{}
+	if len(ids) > 0 {
+		var found []Batch
+		if err := db.Where("id IN (?)", ids).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for _, b := range found {
+			names[b.ID] = b.Stringify()
+		}
+	}
+
+	for _, t := range transfers {
+		events = append(events, calendarEvent(baseURL, fmt.Sprintf("transfer-%d", t.ID), t.UpdatedAt, t.Date, fmt.Sprintf("Transfer : %s, %s → %s", names[t.BatchID], t.From.Name, t.To.Name), fmt.Sprintf("%d L", t.Volume), fmt.Sprintf("batches/%d", t.BatchID)))
+	}
+	for _, r := range runs {
+		events = append(events, calendarEvent(baseURL, fmt.Sprintf("packaging-%d", r.ID), r.UpdatedAt, r.Date, fmt.Sprintf("Packaging : %s, %d × %s", names[r.BatchID], r.Units, r.Format.Name), fmt.Sprintf("%d L", r.Volume), fmt.Sprintf("batches/%d", r.BatchID)))
+	}
+	for i, r := range reservations {
+		name, batchPath, containerPath := names[r.BatchID], fmt.Sprintf("batches/%d", r.BatchID), fmt.Sprintf("containers/%d", r.ContainerID)
+		first, last := i == 0 || reservations[i-1].BatchID != r.BatchID, i == len(reservations)-1 || reservations[i+1].BatchID != r.BatchID
+		// The container is sanitized before the batch comes in, and cleaned once it leaves
+		if first || reservations[i-1].ContainerID != r.ContainerID {
+			events = append(events, calendarEvent(baseURL, fmt.Sprintf("reservation-%d-sanitize", r.ID), r.UpdatedAt, r.Start, fmt.Sprintf("Sanitize %s for %s", r.Container.Name, name), r.Phase, containerPath))
+		}
+		if last || reservations[i+1].ContainerID != r.ContainerID {
+			events = append(events, calendarEvent(baseURL, fmt.Sprintf("reservation-%d-clean", r.ID), r.UpdatedAt, r.End, fmt.Sprintf("Clean %s after %s", r.Container.Name, name), r.Phase, containerPath))
+		}
+		// The reservation following another one of the batch in another container starts with a transfer, the last one of the conditioning ends with the packaging
+		if !first && reservations[i-1].ContainerID != r.ContainerID {
+			events = append(events, calendarEvent(baseURL, fmt.Sprintf("reservation-%d-transfer", r.ID), r.UpdatedAt, r.Start, fmt.Sprintf("Expected transfer : %s, %s → %s", name, reservations[i-1].Container.Name, r.Container.Name), r.Phase, batchPath))
+		}
+		if r.Phase == PhaseConditioning && last {
+			events = append(events, calendarEvent(baseURL, fmt.Sprintf("reservation-%d-packaging", r.ID), r.UpdatedAt, r.End, "Expected packaging : "+name, r.Container.Name, batchPath))
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events, nil
+}
+
+// baseURL gives the URL of the application from the request
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// ServeCalendar serves the calendar feed of the token, from /calendar/{token}.ics
+func ServeCalendar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/"), ".ics")
+	feed, err := FindCalendarFeed(DB, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	now := time.Now()
+	events, err := CalendarEvents(DB, baseURL(r), now.AddDate(0, 0, -CalendarPastDays))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	DB.Model(&feed).UpdateColumn("last_fetched", now)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	ical.Encode(w, ical.Calendar{ProdID: "-//Malt App//Brewery calendar//EN", Name: "Malt App", Events: events})
+}
+
+// calendarPage is the calendar feed page of the current user, giving the feed URL once a new token is made
+type calendarPage struct {
+	Feed CalendarFeed
+	URL  string
+}
+
+// configureCalendar adds the calendar feed page of the current user, and lets the admins revoke the feeds
+func configureCalendar(Admin *admin.Admin) {
+	feed := Admin.AddResource(&CalendarFeed{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, "admin").Allow(roles.Delete, "admin")})
+	feed.IndexAttrs("User", "LastFetched")
+	feed.ShowAttrs("User", "LastFetched")
+
+	page := func(context *admin.Context, url string) {
+		var p calendarPage
+		context.GetDB().New().Where(CalendarFeed{User: userName(context.CurrentUser)}).First(&p.Feed)
+		p.URL = url
+		context.Execute("calendar", p)
+	}
+	Admin.GetRouter().Get("/calendar", func(context *admin.Context) {
+		page(context, "")
+	})
+	Admin.GetRouter().Post("/calendar", func(context *admin.Context) {
+		token, err := NewCalendarToken(context.GetDB().New(), userName(context.CurrentUser))
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page(context, baseURL(context.Request)+"/calendar/"+token+".ics")
+	})
+	Admin.AddMenu(&admin.Menu{Name: "Calendar feed", Link: "/admin/calendar", Ancestors: []string{"Batches"}})
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	defer initTestDB(t)()
+
+	base := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	fv, tank := Container{Name: "FV1", Volume: 100}, Container{Name: "Tank", Volume: 100}
+	DB.Create(&fv)
+	DB.Create(&tank)
+	recipe := Recipe{Name: "IPA", FermentationDays: 10, ConditioningDays: 7}
+	DB.Create(&recipe)
+	b := Batch{RecipeID: recipe.ID, Step: StepPlanned, StartVolume: 100, Date: base}
+	DB.Create(&b)
+	DB.Create(&Reservation{BatchID: b.ID, Phase: PhaseFermentation, ContainerID: fv.ID})
+	DB.Create(&Reservation{BatchID: b.ID, Phase: PhaseConditioning, ContainerID: tank.ID})
+
+	// The feed needs a valid token, the former one stopping working
+	former, err := NewCalendarToken(DB, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewCalendarToken(DB, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		token string
+		code  int
+	}{{former, http.StatusUnauthorized}, {"", http.StatusUnauthorized}, {token, http.StatusOK}} {
+		w := httptest.NewRecorder()
+		ServeCalendar(w, httptest.NewRequest("GET", "http://brewery.example.org/calendar/"+tc.token+".ics", nil))
+		if w.Code != tc.code {
+			t.Errorf("got code %d for token %q, want %d", w.Code, tc.token, tc.code)
+		}
+	}
+
+	events, err := CalendarEvents(DB, "https://brewery.example.org", base.AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Time{
+		"Brew day : #1 IPA":                      base,
+		"Sanitize FV1 for #1 IPA":                base,
+		"Clean FV1 after #1 IPA":                 base.AddDate(0, 0, 10),
+		"Expected transfer : #1 IPA, FV1 → Tank": base.AddDate(0, 0, 10),
+		"Expected packaging : #1 IPA":            base.AddDate(0, 0, 17),
+	}
+	for _, e := range events {
+		if day, ok := want[e.Summary]; ok {
+			if !e.Start.Equal(day) || !e.AllDay || !strings.HasPrefix(e.URL, "https://brewery.example.org/admin/") {
+				t.Errorf("got event %+v, want an all day event on %v linking to the admin", e, day)
+			}
+			delete(want, e.Summary)
+		}
+	}
+	for _, e := range events {
+		if e.Summary == "Clean Tank after #1 IPA" && !e.Start.Equal(base.AddDate(0, 0, 17)) {
+			t.Errorf("got event %+v, want the tank cleaned after the conditioning", e)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("got events %+v, missing %v", events, want)
+	}
+}
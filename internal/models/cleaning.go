@@ -0,0 +1,223 @@
+package models
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Container states
+const (
+	StateEmptyDirty = "Empty - dirty"
+	StateCleaned    = "Cleaned"
+	StateSanitized  = "Sanitized"
+	StateFilled     = "Filled"
+)
+
+// ContainerStates are the states of the containers
+var ContainerStates = []string{StateEmptyDirty, StateCleaned, StateSanitized, StateFilled}
+
+// Cleaning operation kinds, giving the state of the container cleaned
+const (
+	KindCleaning   = "Cleaning"
+	KindSanitation = "Sanitation"
+)
+
+// CleaningKinds are the kinds of cleaning operations
+var CleaningKinds = []string{KindCleaning, KindSanitation}
+
+// Cleaning errors
+const (
+	errNotSanitized   = "The destination container isn't sanitized"
+	errCleaningFilled = "A container holding beer can't be cleaned"
+)
+
+// CleaningOperation is a cleaning-in-place operation of a container
+type CleaningOperation struct {
+	gorm.Model
+	Container     Container `gorm:"association_autoupdate:false;association_autocreate:false"`
+	ContainerID   uint
+	Date          time.Time
+	Kind          string
+	Chemical      string
+	Concentration float64 // %
+	Temperature   float64 // °C
+	Operator      string
+}
+
+// BeforeSave sets a new container as empty and dirty, until a cleaning-in-place operation is recorded
+func (c *Container) BeforeSave() error {
+	if c.State == "" {
+		c.State = StateEmptyDirty
+	}
+	return nil
+}
+
+// containerVolume gives the volume held in the container from the stock ledger, and the part of the batch
+func containerVolume(tx *gorm.DB, containerID, batchID uint) (int, int, error) {
+	var rows []struct {
+		BatchID uint
+		Volume  int
+	}
+	if err := tx.New().Table("stock_entries").Select("batch_id, SUM(volume) AS volume").Where("container_id = ?", containerID).Group("batch_id").Scan(&rows).Error; err != nil {
+		return 0, 0, err
+	}
+	total, batch := 0, 0
+	for _, r := range rows {
+		total += r.Volume
+		if r.BatchID == batchID {
+			batch = r.Volume
+		}
+	}
+	return total, batch, nil
+}
+
+// entryContainers gives the containers of the ledger entries matching the conditions
+func entryContainers(tx *gorm.DB, query string, args ...interface{}) ([]uint, error) {
+	var ids []uint
+	err := tx.New().Model(&StockEntry{}).Where(query, args...).Pluck("DISTINCT container_id", &ids).Error
+	return ids, err
+}
+
+// refreshStates sets the containers holding beer as filled, and the filled containers emptied as dirty
+func refreshStates(tx *gorm.DB, ids ...uint) error {
+	for _, id := range ids {
+		var c Container
+		if err := tx.New().First(&c, id).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				continue
+			}
+			return err
+		}
+		volume, _, err := containerVolume(tx, id, 0)
+		if err != nil {
+			return err
+		}
+		state := c.State
+		if volume > 0 {
+			state = StateFilled
+		} else if c.State == StateFilled {
+			state = StateEmptyDirty
+		}
+		if state != c.State {
+			if err := tx.New().Model(&c).UpdateColumn("state", state).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSanitized checks that a transfer goes into a sanitized container, or a container already holding beer, unless overridden by an admin
+func checkSanitized(tx *gorm.DB, t *Transfer) error {
+	t.ToID = keyOf(t.ToID, t.To.ID)
+	if t.Override {
+		return nil
+	}
+	if t.ID != 0 {
+		var former Transfer
+		if err := tx.Unscoped().First(&former, t.ID).Error; err == nil && former.ToID == t.ToID {
+			return nil
+		}
+	}
+	var to Container
+	if err := tx.First(&to, t.ToID).Error; err != nil {
+		return err
+	}
+	if to.State == StateSanitized {
+		return nil
+	}
+	if held, _, err := containerVolume(tx, t.ToID, 0); err != nil || held > 0 {
+		return err
+	}
+	return validations.NewError(t, "To", errNotSanitized+" : "+to.Name+" ("+to.State+")")
+}
+
+// BeforeSave checks that the container is empty, and sets the operator
+func (o *CleaningOperation) BeforeSave(tx *gorm.DB) error {
+	o.ContainerID = keyOf(o.ContainerID, o.Container.ID)
+	if o.Date.IsZero() {
+		o.Date = time.Now()
+	}
+	volume, _, err := containerVolume(tx, o.ContainerID, 0)
+	if err != nil {
+		return err
+	}
+	if volume > 0 {
+		return validations.NewError(o, "Container", errCleaningFilled)
+	}
+	return nil
+}
+
+// AfterCreate sets the state of the container cleaned
+func (o *CleaningOperation) AfterCreate(tx *gorm.DB) error {
+	state := StateCleaned
+	if o.Kind == KindSanitation {
+		state = StateSanitized
+	}
+	return tx.New().Model(&Container{}).Where("id = ?", o.ContainerID).UpdateColumn("state", state).Error
+}
+
+// BoardLine is a container on the board, with its fill level
+type BoardLine struct {
+	Container Container
+	Percent   int
+}
+
+// ContainersBoard gives all the containers, with the beer they hold and their fill level
+func ContainersBoard(db *gorm.DB) ([]BoardLine, error) {
+	var containers []*Container
+	if err := db.Order("name").Find(&containers).Error; err != nil {
+		return nil, err
+	}
+	if err := LoadContainers(db, containers...); err != nil {
+		return nil, err
+	}
+	var board []BoardLine
+	for _, c := range containers {
+		l := BoardLine{Container: *c}
+		if c.Volume > 0 {
+			l.Percent = c.Filled * 100 / c.Volume
+		}
+		board = append(board, l)
+	}
+	return board, nil
+}
+
+// configureCleaning adds the container states, the cleaning operations log, the override of the transfers into unsanitized containers, and the containers board
+func configureCleaning(Admin *admin.Admin, batch *admin.Resource, container *admin.Resource) {
+	container.Meta(&admin.Meta{Name: "State", Type: "select_one", Config: &admin.SelectOneConfig{Collection: ContainerStates}})
+	container.EditAttrs("Name", "Volume", "State")
+	container.NewAttrs("Name", "Volume")
+
+	cleaning := Admin.AddResource(&CleaningOperation{}, &admin.Config{Menu: []string{"Batches"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.Create, roles.Anyone).Allow(roles.CRUD, "admin")})
+	cleaning.IndexAttrs("Date", "Container", "Kind", "Chemical", "Concentration", "Temperature", "Operator")
+	cleaning.Meta(&admin.Meta{Name: "Kind", Type: "select_one", Config: &admin.SelectOneConfig{Collection: CleaningKinds}})
+	cleaning.Meta(&admin.Meta{Name: "Concentration", Label: "Concentration (%)"})
+	cleaning.Meta(&admin.Meta{Name: "Temperature", Label: "Temperature (°C)"})
+	save := cleaning.SaveHandler
+	cleaning.SaveHandler = func(result interface{}, context *qor.Context) error {
+		if o, ok := result.(*CleaningOperation); ok && o.Operator == "" {
+			o.Operator = userName(context.CurrentUser)
+		}
+		return save(result, context)
+	}
+
+	transfers := batch.Meta(&admin.Meta{Name: "Transfers"}).Resource
+	transfers.Meta(&admin.Meta{Name: "Override", Label: "Override the sanitation check", Permission: roles.Allow(roles.CRUD, "admin")})
+
+	Admin.GetRouter().Get("/containers_board", func(context *admin.Context) {
+		board, err := ContainersBoard(context.GetDB().New())
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		context.Execute("containers_board", board)
+	})
+	Admin.AddMenu(&admin.Menu{Name: "Containers board", Link: "/admin/containers_board", Ancestors: []string{"Batches"}})
+}
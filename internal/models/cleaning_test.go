@@ -0,0 +1,104 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleaning(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	tank := Container{Name: "Tank", Volume: 100}
+	DB.Create(&tank)
+	if tank.State != StateEmptyDirty {
+		t.Errorf("got new container state %s, want %s", tank.State, StateEmptyDirty)
+	}
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date}
+	DB.Create(&b)
+	state := func(id uint) string {
+		var c Container
+		DB.First(&c, id)
+		return c.State
+	}
+	if got := state(fermenter); got != StateFilled {
+		t.Errorf("got fermenter state %s, want %s", got, StateFilled)
+	}
+
+	// A transfer into a dirty container is blocked, unless overridden
+	if err := DB.Create(&Transfer{BatchID: b.ID, Date: date, FromID: fermenter, ToID: tank.ID, Volume: 40}).Error; err == nil {
+		t.Error("got no error transferring into a dirty container")
+	}
+	overridden := Transfer{BatchID: b.ID, Date: date, FromID: fermenter, ToID: tank.ID, Volume: 40, Override: true}
+	if err := DB.Create(&overridden).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got := state(tank.ID); got != StateFilled {
+		t.Errorf("got tank state %s, want %s", got, StateFilled)
+	}
+
+	// A container holding beer can't be cleaned, and is dirty once emptied
+	if err := DB.Create(&CleaningOperation{ContainerID: tank.ID, Date: date, Kind: KindSanitation}).Error; err == nil {
+		t.Error("got no error cleaning a filled container")
+	}
+	DB.Delete(&overridden)
+	if got := state(tank.ID); got != StateEmptyDirty {
+		t.Errorf("got tank state %s, want %s", got, StateEmptyDirty)
+	}
+
+	// A cleaning leaves the container cleaned, a sanitation allows the transfers
+	DB.Create(&CleaningOperation{ContainerID: tank.ID, Date: date, Kind: KindCleaning, Chemical: "NaOH", Concentration: 2, Temperature: 70, Operator: "Bob"})
+	if got := state(tank.ID); got != StateCleaned {
+		t.Errorf("got tank state %s, want %s", got, StateCleaned)
+	}
+	if err := DB.Create(&Transfer{BatchID: b.ID, Date: date, FromID: fermenter, ToID: tank.ID, Volume: 40}).Error; err == nil {
+		t.Error("got no error transferring into a cleaned container")
+	}
+	DB.Create(&CleaningOperation{ContainerID: tank.ID, Date: date, Kind: KindSanitation, Chemical: "Peracetic acid", Concentration: 0.2, Temperature: 20, Operator: "Bob"})
+	if err := DB.Create(&Transfer{BatchID: b.ID, Date: date, FromID: fermenter, ToID: tank.ID, Volume: 40}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	board, err := ContainersBoard(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range board {
+		if l.Container.ID == tank.ID && (l.Container.State != StateFilled || l.Container.Filled != 40 || l.Percent != 40) {
+			t.Errorf("got board line %+v, want the tank filled at 40 %%", l)
+		}
+	}
+}
+
+func TestInitDB_ContainerStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "malt_app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "business.db")
+	InitDB(path)
+	defer func() { DB.Close() }()
+
+	fermenter, _ := fermenterID(DB)
+	empty, full := Container{Name: "Empty", Volume: 100}, Container{Name: "Full", Volume: 100, State: StateSanitized}
+	DB.Create(&empty)
+	DB.Create(&full)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 50, Date: time.Now()}
+	DB.Create(&b)
+	DB.Create(&Transfer{BatchID: b.ID, Date: time.Now(), FromID: fermenter, ToID: full.ID, Volume: 50})
+	// The containers created before the states have none
+	DB.Model(&Container{}).UpdateColumn("state", "")
+
+	DB.Close()
+	InitDB(path)
+	DB.First(&empty, empty.ID)
+	DB.First(&full, full.ID)
+	if empty.State != StateEmptyDirty || full.State != StateFilled {
+		t.Errorf("got states %v and %v, want the empty container dirty and the other filled", empty.State, full.State)
+	}
+}
@@ -0,0 +1,337 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+)
+
+// OverheadRate gives the overheads of the batches brewed from a date, until the next rate
+type OverheadRate struct {
+	gorm.Model
+	ValidFrom     time.Time
+	EnergyPerBrew float64 // €
+	LabourPerHour float64 // €
+}
+
+// UnitCost is the cost of a unit of a packaging format filled with a batch
+type UnitCost struct {
+	Format PackagingFormat
+	Units  int
+	Cost   float64 // € per unit, the beer and the packaging materials
+}
+
+// SaleMargin is the margin of a sale, known if the sale comes from an order line
+type SaleMargin struct {
+	Sale    Sale
+	Cost    float64
+	Priced  bool
+	Revenue float64 // excluding VAT
+	Margin  float64
+	Rate    float64 // % of the revenue
+}
+
+// BatchCost is the cost of goods of a batch : its ingredient lots at their purchase price, its overheads and its packaging materials.
+// The volume lost in the events and the packaging runs raises the cost of the liters left.
+// A blend carries the cost per liter of its parents into its child, for the volume blended.
+type BatchCost struct {
+	Batch       Batch
+	Ingredients float64
+	Energy      float64
+	Labour      float64
+	BlendedIn   float64 // the cost of the beer blended in from the parents
+	BlendedOut  float64 // the cost of the beer blended out into the children
+	Packaging   float64 // the packaging materials
+	Total       float64
+	Volume      float64 // L, the volume brewed or blended in with the gains of the events, less the volume blended out
+	Losses      float64 // L, lost in the events and the packaging runs
+	LossesCost  float64
+	PerLiter    float64
+	Units       []UnitCost
+	Sales       []SaleMargin
+	Unpriced    []string // the ingredient lots consumed without purchase price
+}
+
+// findOverheadRate gives the latest rate valid at the date
+func findOverheadRate(rates []OverheadRate, date time.Time) OverheadRate {
+	var found OverheadRate
+	for _, r := range rates {
+		if !r.ValidFrom.After(date) && (found.ID == 0 || r.ValidFrom.After(found.ValidFrom)) {
+			found = r
+		}
+	}
+	return found
+}
+
+// BatchCosts works out the cost of goods of the batches
+func BatchCosts(db *gorm.DB, batches ...Batch) ([]BatchCost, error) {
+	var rates []OverheadRate
+	if err := db.Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	var costs []BatchCost
+	for _, b := range batches {
+		c, err := batchCost(db, b, rates)
+		if err != nil {
+			return nil, err
+		}
+		costs = append(costs, c)
+	}
+	return costs, nil
+}
+
+// batchCost works out the cost of goods of a batch with the overheads of the rate valid at its date, and the costs of its parents if blended
+func batchCost(db *gorm.DB, b Batch, rates []OverheadRate) (BatchCost, error) {
+	rate := findOverheadRate(rates, b.Date)
+	c := BatchCost{Batch: b, Energy: rate.EnergyPerBrew, Labour: b.LabourHours * rate.LabourPerHour, Volume: float64(b.StartVolume)}
+
+	// The child of a blend isn't brewed, its beer costs what it cost its parents
+	var parents []BlendSource
+	if err := db.Joins("JOIN blends ON blends.id = blend_sources.blend_id").Where("blends.batch_id = ? AND blends.deleted_at IS NULL", b.ID).Find(&parents).Error; err != nil {
+		return c, err
+	}
+	if len(parents) > 0 {
+		c.Energy = 0
+	}
+	for _, s := range parents {
+		var parent Batch
+		if err := db.Unscoped().First(&parent, s.BatchID).Error; err != nil {
+			return c, err
+		}
+		pc, err := batchCost(db, parent, rates)
+		if err != nil {
+			return c, err
+		}
+		c.BlendedIn += float64(s.Volume) * pc.PerLiter
+		c.Volume += float64(s.Volume)
+	}
+	var children []BlendSource
+	if err := db.Where("batch_id = ?", b.ID).Find(&children).Error; err != nil {
+		return c, err
+	}
+	blendedOut := 0.0
+	for _, s := range children {
+		blendedOut += float64(s.Volume)
+	}
+
+	var consumptions []Consumption
+	if err := db.Preload("Lot").Preload("Lot.Ingredient").Where("batch_id = ?", b.ID).Find(&consumptions).Error; err != nil {
+		return c, err
+	}
+	for _, cons := range consumptions {
+		c.Ingredients += cons.Quantity * cons.Lot.UnitPrice
+		if cons.Lot.UnitPrice == 0 {
+			c.Unpriced = append(c.Unpriced, cons.Lot.Ingredient.Name+" "+cons.Lot.Number)
+		}
+	}
+
+	var events []Event
+	if err := db.Where("batch_id = ?", b.ID).Find(&events).Error; err != nil {
+		return c, err
+	}
+	for _, e := range events {
+		if e.Volume < 0 {
+			c.Losses -= float64(e.Volume)
+		} else {
+			c.Volume += float64(e.Volume)
+		}
+	}
+	var runs []PackagingRun
+	if err := db.Preload("Format").Where("batch_id = ?", b.ID).Order("date").Find(&runs).Error; err != nil {
+		return c, err
+	}
+	for _, r := range runs {
+		c.Losses += r.Losses
+		c.Packaging += float64(r.Units) * r.Format.UnitCost
+	}
+
+	// The beer costs the ingredients, the overheads and the beer blended in, spread over the liters left.
+	// The beer blended out takes its cost per liter away, leaving the cost per liter of the beer kept unchanged.
+	bulk := c.Ingredients + c.Energy + c.Labour + c.BlendedIn
+	if left := c.Volume - c.Losses; left > 0 {
+		c.PerLiter = bulk / left
+	}
+	if c.Volume > 0 {
+		c.LossesCost = bulk / c.Volume * c.Losses
+	}
+	c.BlendedOut = blendedOut * c.PerLiter
+	c.Volume -= blendedOut
+	c.Total = bulk - c.BlendedOut + c.Packaging
+	unitCost := func(f PackagingFormat) float64 {
+		return c.PerLiter*f.Volume + f.UnitCost
+	}
+	for _, r := range runs {
+		found := false
+		for i := range c.Units {
+			if c.Units[i].Format.ID == r.FormatID {
+				c.Units[i].Units += r.Units
+				found = true
+			}
+		}
+		if !found {
+			c.Units = append(c.Units, UnitCost{Format: r.Format, Units: r.Units, Cost: unitCost(r.Format)})
+		}
+	}
+
+	var sales []Sale
+	if err := db.Preload("Format").Preload("Customer").Where("batch_id = ?", b.ID).Order("date").Find(&sales).Error; err != nil {
+		return c, err
+	}
+	for _, s := range sales {
+		m := SaleMargin{Sale: s, Cost: s.Liters * c.PerLiter}
+		if s.FormatID != 0 {
+			m.Cost = float64(s.Units) * unitCost(s.Format)
+		}
+		var line OrderLine
+		err := db.Where("sale_id = ?", s.ID).First(&line).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return c, err
+		}
+		if err == nil {
+			m.Priced, m.Revenue = true, line.Amount
+			m.Margin = m.Revenue - m.Cost
+			if m.Revenue != 0 {
+				m.Rate = m.Margin / m.Revenue * 100
+			}
+		}
+		c.Sales = append(c.Sales, m)
+	}
+	return c, nil
+}
+
+// CostReport is the cost of goods of the batches brewed over a period
+type CostReport struct {
+	From    time.Time
+	To      time.Time
+	Batches []BatchCost
+}
+
+// MonthlyCosts gives the cost of goods of the batches brewed from the first month to the last one, included
+func MonthlyCosts(db *gorm.DB, from, to time.Time) (CostReport, error) {
+	r := CostReport{From: from, To: to}
+	var batches []Batch
+	if err := db.Where("date >= ? AND date < ? AND step <> ?", from, to.AddDate(0, 1, 0), StepPlanned).Order("date").Find(&batches).Error; err != nil {
+		return r, err
+	}
+	costs, err := BatchCosts(db, batches...)
+	r.Batches = costs
+	return r, err
+}
+
+// formatCost formats an amount in euros for the CSV exports
+func formatCost(v float64) string {
+	return strconv.FormatFloat(brewcalc.Round(v, 2), 'f', 2, 64)
+}
+
+// WriteCSV writes the costs of the batches, a line per batch, with the cost of a unit of each format packaged
+func (r CostReport) WriteCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"batch", "date", "ingredients", "energy", "labour", "blended_in", "blended_out", "packaging", "total", "volume_l", "losses_l", "losses_cost", "cost_per_liter", "cost_per_unit", "unpriced_lots"})
+	for _, b := range r.Batches {
+		var units []string
+		for _, u := range b.Units {
+			units = append(units, fmt.Sprintf("%s: %s", u.Format.Name, formatCost(u.Cost)))
+		}
+		c.Write([]string{b.Batch.Stringify(), b.Batch.Date.Format("2006-01-02"), formatCost(b.Ingredients), formatCost(b.Energy), formatCost(b.Labour), formatCost(b.BlendedIn), formatCost(b.BlendedOut), formatCost(b.Packaging), formatCost(b.Total),
+			strconv.FormatFloat(b.Volume, 'f', -1, 64), strconv.FormatFloat(brewcalc.Round(b.Losses, 2), 'f', -1, 64), formatCost(b.LossesCost), formatCost(b.PerLiter), strings.Join(units, ", "), strings.Join(b.Unpriced, ", ")})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// WriteSalesCSV writes the margins of the sales of the batches, the revenue and margin being empty if the price is unknown
+func (r CostReport) WriteSalesCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"sale", "date", "batch", "customer", "format", "units", "liters", "cost", "revenue", "margin", "margin_rate"})
+	var sales []SaleMargin
+	for _, b := range r.Batches {
+		sales = append(sales, b.Sales...)
+	}
+	sort.SliceStable(sales, func(i, j int) bool { return sales[i].Sale.Date.Before(sales[j].Sale.Date) })
+	names := map[uint]string{}
+	for _, b := range r.Batches {
+		names[b.Batch.ID] = b.Batch.Stringify()
+	}
+	for _, m := range sales {
+		revenue, margin, rate := "", "", ""
+		if m.Priced {
+			revenue, margin, rate = formatCost(m.Revenue), formatCost(m.Margin), strconv.FormatFloat(brewcalc.Round(m.Rate, 1), 'f', 1, 64)
+		}
+		c.Write([]string{strconv.Itoa(int(m.Sale.ID)), m.Sale.Date.Format("2006-01-02"), names[m.Sale.BatchID], m.Sale.Customer.Name, m.Sale.Format.Name, strconv.Itoa(m.Sale.Units),
+			strconv.FormatFloat(m.Sale.Liters, 'f', -1, 64), formatCost(m.Cost), revenue, margin, rate})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// configureCosts adds the overhead rates, the prices of the lots and the packaging materials, the labour hours of the batches, and the costs report
+func configureCosts(Admin *admin.Admin, batch *admin.Resource) {
+	rate := Admin.AddResource(&OverheadRate{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	rate.IndexAttrs("ValidFrom", "EnergyPerBrew", "LabourPerHour")
+	rate.Meta(&admin.Meta{Name: "EnergyPerBrew", Label: "Energy per brew (€)"})
+	rate.Meta(&admin.Meta{Name: "LabourPerHour", Label: "Labour per hour (€)"})
+
+	lots := Admin.GetResource("Delivery").Meta(&admin.Meta{Name: "Lots"}).Resource
+	lots.EditAttrs("Ingredient", "Number", "BestBefore", "Quantity", "UnitPrice")
+	lots.NewAttrs("Ingredient", "Number", "BestBefore", "Quantity", "UnitPrice")
+	lot := Admin.GetResource("Lot")
+	lot.EditAttrs("Number", "BestBefore", "Quantity", "UnitPrice")
+	lot.ShowAttrs("Ingredient", "Number", "BestBefore", "Quantity", "UnitPrice", "Remaining")
+	for _, r := range []*admin.Resource{lots, lot} {
+		r.Meta(&admin.Meta{Name: "UnitPrice", Label: "Unit price (€ per ingredient unit, excluding VAT)"})
+	}
+	Admin.GetResource("PackagingFormat").Meta(&admin.Meta{Name: "UnitCost", Label: "Packaging materials (€ per unit)"})
+	batch.Meta(&admin.Meta{Name: "LabourHours", Label: "Labour (hours)"})
+
+	report := func(context *admin.Context) (CostReport, bool) {
+		query := context.Request.URL.Query()
+		now := time.Now()
+		from, err := time.ParseInLocation("2006-01", query.Get("from"), time.Local)
+		if err != nil {
+			from = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+		}
+		to, err := time.ParseInLocation("2006-01", query.Get("to"), time.Local)
+		if err != nil {
+			to = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+		}
+		r, err := MonthlyCosts(context.GetDB().New(), from, to)
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return r, false
+		}
+		return r, true
+	}
+	router := Admin.GetRouter()
+	router.Get("/costs", func(context *admin.Context) {
+		if r, ok := report(context); ok {
+			context.Execute("costs", r)
+		}
+	})
+	for _, e := range []struct {
+		path, name string
+		write      func(CostReport, io.Writer) error
+	}{
+		{"/costs/csv", "costs", CostReport.WriteCSV},
+		{"/costs/sales_csv", "margins", CostReport.WriteSalesCSV},
+	} {
+		e := e
+		router.Get(e.path, func(context *admin.Context) {
+			if r, ok := report(context); ok {
+				context.Writer.Header().Set("Content-Type", "text/csv")
+				context.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s_%s.csv", e.name, r.From.Format("2006-01"), r.To.Format("2006-01")))
+				e.write(r, context.Writer)
+			}
+		})
+	}
+	Admin.AddMenu(&admin.Menu{Name: "Costs", Link: "/admin/costs", Ancestors: []string{"Sales"}})
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCosts(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	DB.Create(&OverheadRate{ValidFrom: date.AddDate(-1, 0, 0), EnergyPerBrew: 50, LabourPerHour: 20})
+	DB.Create(&OverheadRate{ValidFrom: date.AddDate(0, 3, 0), EnergyPerBrew: 999, LabourPerHour: 999})
+	malt, hops := Ingredient{Name: "Pils", Unit: "kg"}, Ingredient{Name: "Saaz", Unit: "kg"}
+	DB.Create(&malt)
+	DB.Create(&hops)
+	priced, unpriced := Lot{IngredientID: malt.ID, Number: "M-1", Quantity: 100, UnitPrice: 1.5}, Lot{IngredientID: hops.ID, Number: "H-1", Quantity: 5}
+	DB.Create(&priced)
+	DB.Create(&unpriced)
+	bottle := PackagingFormat{Name: "Bottle 33cl", Kind: KindBottle, Volume: 0.33, UnitCost: 0.5}
+	DB.Create(&bottle)
+
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, LabourHours: 5, Date: date}
+	DB.Create(&b)
+	DB.Create(&Consumption{BatchID: b.ID, LotID: priced.ID, Quantity: 20})
+	DB.Create(&Consumption{BatchID: b.ID, LotID: unpriced.ID, Quantity: 1})
+	DB.Create(&Event{BatchID: b.ID, Date: date, Name: "Dry hopping loss", Volume: -10})
+	DB.Create(&PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Volume: 33, Units: 100})
+	customer := Customer{Name: "Le Bar"}
+	DB.Create(&customer)
+	if err := DB.Create(&Order{CustomerID: customer.ID, Date: date, Lines: []OrderLine{{BatchID: b.ID, FormatID: bottle.ID, Units: 10, UnitPrice: 2.5}}}).Error; err != nil {
+		t.Fatal(err)
+	}
+	DB.Create(&Sale{BatchID: b.ID, Date: date.AddDate(0, 0, 1), FromID: fermenter, Volume: 5})
+	DB.Create(&Batch{Recipe: Recipe{Name: "Stout"}, Step: StepPlanned, StartVolume: 100, Date: date})
+	DB.Create(&Batch{Recipe: Recipe{Name: "Porter"}, Step: StepConditioning, StartVolume: 100, Date: date.AddDate(0, -3, 0)})
+
+	// The beer costs the ingredients and the overheads spread over the liters left, the units add their packaging materials
+	r, err := MonthlyCosts(DB, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Batches) != 1 {
+		t.Fatalf("got %d batches, want the batch brewed in March only", len(r.Batches))
+	}
+	c := r.Batches[0]
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	if !near(c.Ingredients, 30) || !near(c.Energy, 50) || !near(c.Labour, 100) || !near(c.Packaging, 50) || !near(c.Total, 230) {
+		t.Errorf("got cost %+v, want 30 € of ingredients, 50 € of energy, 100 € of labour and 50 € of packaging", c)
+	}
+	if !near(c.Losses, 10) || !near(c.LossesCost, 18) || !near(c.PerLiter, 2) || len(c.Unpriced) != 1 {
+		t.Errorf("got cost %+v, want 10 L lost for 18 €, 2 € per liter and the hops lot unpriced", c)
+	}
+	if len(c.Units) != 1 || c.Units[0].Units != 100 || !near(c.Units[0].Cost, 1.16) {
+		t.Errorf("got unit costs %+v, want 1.16 € per bottle", c.Units)
+	}
+
+	// The margin is known for the sales from an order line
+	if len(c.Sales) != 2 || !c.Sales[0].Priced || !near(c.Sales[0].Revenue, 25) || !near(c.Sales[0].Margin, 13.4) || !near(c.Sales[0].Rate, 53.6) {
+		t.Errorf("got sales %+v, want the bottles sold with a margin of 13.40 €", c.Sales)
+	}
+	if len(c.Sales) == 2 && (c.Sales[1].Priced || !near(c.Sales[1].Cost, 10)) {
+		t.Errorf("got sale %+v, want the bulk sale costing 10 € without price", c.Sales[1])
+	}
+
+	var csv, sales bytes.Buffer
+	if err := r.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	if want := "#1 IPA,2026-03-02,30.00,50.00,100.00,0.00,0.00,50.00,230.00,100,10,18.00,2.00,Bottle 33cl: 1.16,Saaz H-1"; !strings.Contains(csv.String(), want) {
+		t.Errorf("got CSV\n%s\nwant the line %s", csv.String(), want)
+	}
+	if err := r.WriteSalesCSV(&sales); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(sales.String()), "\n"); len(lines) != 3 || !strings.HasSuffix(lines[1], ",11.60,25.00,13.40,53.6") || !strings.HasSuffix(lines[2], ",10.00,,,") {
+		t.Errorf("got sales CSV\n%s\nwant the margins of the two sales", sales.String())
+	}
+}
+
+func TestCosts_Blends(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	tank := Container{Name: "Tank", Volume: 100}
+	DB.Create(&tank)
+	DB.Create(&OverheadRate{ValidFrom: date.AddDate(-1, 0, 0), EnergyPerBrew: 40})
+	malt := Ingredient{Name: "Pils", Unit: "kg"}
+	DB.Create(&malt)
+	lot := Lot{IngredientID: malt.ID, Number: "M-1", Quantity: 100, UnitPrice: 1}
+	DB.Create(&lot)
+	ipa := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date}
+	stout := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepConditioning, StartVolume: 50, Date: date}
+	for _, b := range []*Batch{&ipa, &stout} {
+		DB.Create(b)
+	}
+	DB.Create(&Consumption{BatchID: ipa.ID, LotID: lot.ID, Quantity: 60})
+	DB.Create(&Consumption{BatchID: stout.ID, LotID: lot.ID, Quantity: 35})
+	blend := Blend{Date: date.AddDate(0, 0, 7), ContainerID: tank.ID, Sources: []BlendSource{{BatchID: ipa.ID, ContainerID: fermenter, Volume: 40}, {BatchID: stout.ID, ContainerID: fermenter, Volume: 20}}}
+	if err := DB.Create(&blend).Error; err != nil {
+		t.Fatal(err)
+	}
+	customer := Customer{Name: "Le Bar"}
+	DB.Create(&customer)
+	if err := DB.Create(&Order{CustomerID: customer.ID, Date: blend.Date, Lines: []OrderLine{{BatchID: blend.BatchID, FromID: tank.ID, Volume: 6, UnitPrice: 3}}}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The IPA costs 1 € per liter and the stout 1.5 €, the child of the blend costs what its parents gave it and isn't brewed
+	r, err := MonthlyCosts(DB, date, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Batches) != 3 {
+		t.Fatalf("got %d batches, want the parents and the child", len(r.Batches))
+	}
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	parent, other, child := r.Batches[0], r.Batches[1], r.Batches[2]
+	if !near(parent.PerLiter, 1) || !near(parent.BlendedOut, 40) || !near(parent.Volume, 60) || !near(parent.Total, 60) {
+		t.Errorf("got IPA cost %+v, want 40 € blended out and 60 € left for 60 L", parent)
+	}
+	if !near(other.PerLiter, 1.5) || !near(other.BlendedOut, 30) || !near(other.Total, 45) {
+		t.Errorf("got stout cost %+v, want 30 € blended out and 45 € left", other)
+	}
+	if child.Batch.ID != blend.BatchID || child.Energy != 0 || !near(child.BlendedIn, 70) || !near(child.Volume, 60) || !near(child.PerLiter, 70.0/60) || !near(child.Total, 70) {
+		t.Errorf("got child cost %+v, want 70 € blended in for 60 L", child)
+	}
+	if len(child.Sales) != 1 || !near(child.Sales[0].Cost, 7) || !near(child.Sales[0].Margin, 11) {
+		t.Errorf("got child sales %+v, want 6 L costing 7 € sold 18 €", child.Sales)
+	}
+}
@@ -0,0 +1,331 @@
+package models
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+)
+
+// ExciseNumber is the excise number of the brewery, declaring the DRM
+var ExciseNumber string
+
+// drmTolerance is the volume in hl of pure alcohol under which a DRM stock is taken as nil, the volumes being rounded
+const drmTolerance = 0.0001
+
+// DRMLine is the monthly stock balance of a product, in hl of pure alcohol
+type DRMLine struct {
+	Product    string
+	Opening    float64
+	Production float64
+	BlendedIn  float64 // blended into the product from other ones
+	BlendedOut float64 // blended out of the product into other ones
+	Releases   float64 // released for consumption, sold
+	Losses     float64
+	Closing    float64
+}
+
+// Negative tells if the closing stock is negative, some beer having left the stock ledger before it came in.
+// The stocks and the movements all come from the ledger and balance by construction, only the inventory counts check them against the beer actually held.
+func (l DRMLine) Negative() bool {
+	return l.Closing < -drmTolerance
+}
+
+// add adds the volumes of the line
+func (l *DRMLine) add(o DRMLine) {
+	l.Opening += o.Opening
+	l.Production += o.Production
+	l.BlendedIn += o.BlendedIn
+	l.BlendedOut += o.BlendedOut
+	l.Releases += o.Releases
+	l.Losses += o.Losses
+	l.Closing += o.Closing
+}
+
+// round rounds the volumes of the line to the liter of pure alcohol hundredth
+func (l *DRMLine) round() {
+	for _, v := range []*float64{&l.Opening, &l.Production, &l.BlendedIn, &l.BlendedOut, &l.Releases, &l.Losses, &l.Closing} {
+		*v = brewcalc.Round(*v, 5)
+	}
+}
+
+// DRM is the monthly recapitulative declaration of the stocks and movements of the products, as filed to the customs
+type DRM struct {
+	Month        time.Time
+	ExciseNumber string
+	Lines        []DRMLine
+	Total        DRMLine
+}
+
+// Negative tells if a product has a negative closing stock
+func (d DRM) Negative() bool {
+	for _, l := range d.Lines {
+		if l.Negative() {
+			return true
+		}
+	}
+	return false
+}
+
+// sumByBatch runs a query giving a total by batch
+func sumByBatch(query *gorm.DB) (map[uint]float64, error) {
+	var rows []struct {
+		BatchID uint
+		Total   float64
+	}
+	if err := query.Group("batch_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	sums := map[uint]float64{}
+	for _, r := range rows {
+		sums[r.BatchID] = r.Total
+	}
+	return sums, nil
+}
+
+// batchStocks gives the liters of each batch held before the date : in bulk in the containers, and packaged but not sold
+func batchStocks(db *gorm.DB, date time.Time) (map[uint]float64, error) {
+	bulk, err := sumByBatch(db.Table("stock_entries").Select("batch_id, SUM(volume) AS total").Where("date < ?", date))
+	if err != nil {
+		return nil, err
+	}
+	packaged, err := sumByBatch(db.Table("packaging_runs").Select("batch_id, SUM(packaging_runs.units * packaging_formats.volume) AS total").
+		Joins("JOIN packaging_formats ON packaging_formats.id = packaging_runs.format_id").Where("packaging_runs.deleted_at IS NULL AND packaging_runs.date < ?", date))
+	if err != nil {
+		return nil, err
+	}
+	sold, err := sumByBatch(db.Table("sales").Select("batch_id, SUM(liters) AS total").Where("deleted_at IS NULL AND COALESCE(format_id, 0) <> 0 AND date < ?", date))
+	if err != nil {
+		return nil, err
+	}
+	for id, v := range packaged {
+		bulk[id] += v
+	}
+	for id, v := range sold {
+		bulk[id] -= v
+	}
+	return bulk, nil
+}
+
+// MonthlyDRM works out the DRM of the month from the stock ledger, the packaging runs and the sales, by recipe.
+// The blends move beer between the products, they are declared apart from the production.
+func MonthlyDRM(db *gorm.DB, month time.Time) (DRM, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	to := from.AddDate(0, 1, 0)
+	d := DRM{Month: from, ExciseNumber: ExciseNumber, Total: DRMLine{Product: "Total"}}
+
+	// Volumes by batch, in liters
+	opening, err := batchStocks(db, from)
+	if err != nil {
+		return d, err
+	}
+	closing, err := batchStocks(db, to)
+	if err != nil {
+		return d, err
+	}
+	inMonth := func(table string) *gorm.DB {
+		return db.Table(table).Where(table+".date >= ? AND "+table+".date < ?", from, to)
+	}
+	production, err := sumByBatch(inMonth("stock_entries").Select("batch_id, SUM(volume) AS total").
+		Where("source_type = ? OR (source_type = ? AND volume > 0)", sourceBatch, sourceEvent))
+	if err != nil {
+		return d, err
+	}
+	var blended []struct {
+		SourceID uint
+		BatchID  uint
+		Volume   float64
+	}
+	if err := inMonth("stock_entries").Select("source_id, batch_id, SUM(volume) AS volume").Where("source_type = ?", sourceBlend).Group("source_id, batch_id").Scan(&blended).Error; err != nil {
+		return d, err
+	}
+	eventLosses, err := sumByBatch(inMonth("stock_entries").Select("batch_id, -SUM(volume) AS total").Where("source_type = ? AND volume < 0", sourceEvent))
+	if err != nil {
+		return d, err
+	}
+	packagingLosses, err := sumByBatch(inMonth("packaging_runs").Select("batch_id, SUM(losses) AS total").Where("deleted_at IS NULL"))
+	if err != nil {
+		return d, err
+	}
+	releases, err := sumByBatch(inMonth("sales").Select("batch_id, SUM(liters) AS total").Where("deleted_at IS NULL"))
+	if err != nil {
+		return d, err
+	}
+
+	// Pure alcohol by product
+	var ids []uint
+	for _, sums := range []map[uint]float64{opening, closing, production, eventLosses, packagingLosses, releases} {
+		for id := range sums {
+			if !containsID(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, e := range blended {
+		if !containsID(ids, e.BatchID) {
+			ids = append(ids, e.BatchID)
+		}
+	}
+	var batches []Batch
+	if len(ids) > 0 {
+		if err := db.Unscoped().Preload("Recipe").Where("id IN (?)", ids).Find(&batches).Error; err != nil {
+			return d, err
+		}
+	}
+	lines := map[string]*DRMLine{}
+	products, abvs := map[uint]string{}, map[uint]float64{}
+	hlpa := func(id uint, liters float64) float64 { return liters / 100 * abvs[id] / 100 }
+	for _, b := range batches {
+		abv, err := batchABV(db, b)
+		if err != nil {
+			return d, err
+		}
+		abvs[b.ID] = abv
+		product := b.Recipe.Name
+		if product == "" {
+			product = b.Stringify()
+		}
+		products[b.ID] = product
+		if _, ok := lines[product]; !ok {
+			lines[product] = &DRMLine{Product: product}
+		}
+		lines[product].add(DRMLine{
+			Opening:    hlpa(b.ID, opening[b.ID]),
+			Production: hlpa(b.ID, production[b.ID]),
+			Releases:   hlpa(b.ID, releases[b.ID]),
+			Losses:     hlpa(b.ID, eventLosses[b.ID]+packagingLosses[b.ID]),
+			Closing:    hlpa(b.ID, closing[b.ID]),
+		})
+	}
+	// Each blend moves the pure alcohol taken from the parents of a product into the child of another one, the parents and child of a same product balancing out
+	byBlend := map[uint]map[string]float64{}
+	for _, e := range blended {
+		if byBlend[e.SourceID] == nil {
+			byBlend[e.SourceID] = map[string]float64{}
+		}
+		byBlend[e.SourceID][products[e.BatchID]] += hlpa(e.BatchID, e.Volume)
+	}
+	for _, moved := range byBlend {
+		for product, v := range moved {
+			if v > 0 {
+				lines[product].BlendedIn += v
+			} else {
+				lines[product].BlendedOut -= v
+			}
+		}
+	}
+	for _, l := range lines {
+		d.Total.add(*l)
+	}
+	for _, l := range lines {
+		l.round()
+		d.Lines = append(d.Lines, *l)
+	}
+	sort.Slice(d.Lines, func(i, j int) bool { return d.Lines[i].Product < d.Lines[j].Product })
+	d.Total.round()
+	return d, nil
+}
+
+// formatHLPA formats a volume of pure alcohol for the exports
+func formatHLPA(v float64) string {
+	return strconv.FormatFloat(v, 'f', 5, 64)
+}
+
+// WriteCSV writes the DRM as CSV, a line by product
+func (d DRM) WriteCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"month", "product", "opening_hlpa", "production_hlpa", "blended_in_hlpa", "blended_out_hlpa", "releases_hlpa", "losses_hlpa", "closing_hlpa", "negative"})
+	for _, l := range append(d.Lines, d.Total) {
+		c.Write([]string{d.Month.Format("2006-01"), l.Product, formatHLPA(l.Opening), formatHLPA(l.Production), formatHLPA(l.BlendedIn), formatHLPA(l.BlendedOut), formatHLPA(l.Releases), formatHLPA(l.Losses), formatHLPA(l.Closing), strconv.FormatBool(l.Negative())})
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// drmXML is the DRM laid out after the exchanges with the customs portal. It is not validated against the portal schema,
+// has no fiscal category nor ABV by product, and keys the products on their recipe name: it is a draft to file by hand, not an official export.
+type drmXML struct {
+	XMLName  xml.Name        `xml:"mouvements-balances"`
+	Declarer string          `xml:"identification-declarant>numero-accise"`
+	Month    int             `xml:"periode>mois"`
+	Year     int             `xml:"periode>annee"`
+	Nil      bool            `xml:"declaration-neant"`
+	Products []drmProductXML `xml:"droits-suspendus>produit"`
+}
+
+// drmProductXML is the stock balance of a product, as exchanged with the customs portal
+type drmProductXML struct {
+	Label      string `xml:"libelle-personnalise"`
+	Opening    string `xml:"balance-stocks>stock-debut-periode"`
+	Production string `xml:"balance-stocks>entrees-periode>volume-produit"`
+	BlendedIn  string `xml:"balance-stocks>entrees-periode>autres-entrees"`
+	Releases   string `xml:"balance-stocks>sorties-periode>ventes-france"`
+	BlendedOut string `xml:"balance-stocks>sorties-periode>autres-sorties"`
+	Losses     string `xml:"balance-stocks>sorties-periode>manquants"`
+	Closing    string `xml:"balance-stocks>stock-fin-periode"`
+}
+
+// drmXMLWarning heads the XML export, which is not the official format
+const drmXMLWarning = "<!-- Unofficial draft of the DRM, not validated against the customs portal schema: check it before filing -->\n"
+
+// WriteXML writes the DRM as an unofficial XML draft after the customs portal format, the volumes being in hl of pure alcohol
+func (d DRM) WriteXML(w io.Writer) error {
+	x := drmXML{Declarer: d.ExciseNumber, Month: int(d.Month.Month()), Year: d.Month.Year(), Nil: len(d.Lines) == 0}
+	for _, l := range d.Lines {
+		x.Products = append(x.Products, drmProductXML{Label: l.Product, Opening: formatHLPA(l.Opening), Production: formatHLPA(l.Production), BlendedIn: formatHLPA(l.BlendedIn), Releases: formatHLPA(l.Releases), BlendedOut: formatHLPA(l.BlendedOut), Losses: formatHLPA(l.Losses), Closing: formatHLPA(l.Closing)})
+	}
+	if _, err := io.WriteString(w, xml.Header+drmXMLWarning); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(x)
+}
+
+// configureDRM adds the monthly DRM report, and its CSV and unofficial XML exports
+func configureDRM(Admin *admin.Admin) {
+	drm := func(context *admin.Context) (DRM, bool) {
+		month, err := time.ParseInLocation("2006-01", context.Request.URL.Query().Get("month"), time.Local)
+		if err != nil {
+			now := time.Now()
+			month = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local)
+		}
+		d, err := MonthlyDRM(context.GetDB().New(), month)
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return d, false
+		}
+		return d, true
+	}
+	router := Admin.GetRouter()
+	router.Get("/drm", func(context *admin.Context) {
+		if d, ok := drm(context); ok {
+			context.Execute("drm", d)
+		}
+	})
+	for _, e := range []struct {
+		format, contentType string
+		write               func(DRM, io.Writer) error
+	}{
+		{"csv", "text/csv", DRM.WriteCSV},
+		{"xml", "application/xml", DRM.WriteXML},
+	} {
+		e := e
+		router.Get("/drm/"+e.format, func(context *admin.Context) {
+			if d, ok := drm(context); ok {
+				context.Writer.Header().Set("Content-Type", e.contentType)
+				context.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=drm_%s.%s", d.Month.Format("2006-01"), e.format))
+				e.write(d, context.Writer)
+			}
+		})
+	}
+	Admin.AddMenu(&admin.Menu{Name: "DRM", Link: "/admin/drm", Ancestors: []string{"Sales"}})
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonthlyDRM(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	bottle := PackagingFormat{Name: "Bottle 33cl", Volume: 0.33}
+	DB.Create(&bottle)
+	ipa := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date.AddDate(0, -1, 0)}
+	DB.Create(&ipa)
+	for _, m := range []Measurement{{BatchID: ipa.ID, Kind: KindGravity, Value: 1.060, Date: date}, {BatchID: ipa.ID, Kind: KindGravity, Value: 1.014, Date: date}} {
+		DB.Create(&m)
+	}
+	DB.Create(&Event{BatchID: ipa.ID, Name: "Dry hopping", Date: date, Volume: -5})
+	DB.Create(&PackagingRun{BatchID: ipa.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Volume: 20, Units: 57})
+	DB.Create(&Sale{BatchID: ipa.ID, Date: date, FormatID: bottle.ID, Units: 30})
+	bulk := Sale{BatchID: ipa.ID, Date: date, FromID: fermenter, Volume: 10}
+	DB.Create(&bulk)
+	DB.Create(&Sale{BatchID: ipa.ID, Date: date.AddDate(0, 1, 0), FromID: fermenter, Volume: 10})
+
+	// 100 L at 6 % opening, 19.9 L sold, 5 L lost by the event and 1.19 L by the packaging, 65 L in bulk and 27 bottles left
+	d, err := MonthlyDRM(DB, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DRMLine{Product: "IPA", Opening: 0.06, Releases: 0.01194, Losses: 0.00371, Closing: 0.04435}
+	if len(d.Lines) != 1 || d.Lines[0] != want || d.Negative() {
+		t.Fatalf("got lines %+v, want %+v", d.Lines, want)
+	}
+	if d.Total.Closing != want.Closing {
+		t.Errorf("got total %+v, want the line summed", d.Total)
+	}
+	next, _ := MonthlyDRM(DB, date.AddDate(0, 1, 0))
+	if next.Lines[0].Opening != want.Closing || next.Lines[0].Releases != 0.006 {
+		t.Errorf("got next month %+v, want the closing stock opening", next.Lines[0])
+	}
+
+	// Exports
+	var csv, xml bytes.Buffer
+	if err := d.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(csv.String(), "2026-03,IPA,0.06000,0.00000,0.00000,0.00000,0.01194,0.00371,0.04435,false") {
+		t.Errorf("got CSV %q, want the IPA line", csv.String())
+	}
+	if err := d.WriteXML(&xml); err != nil {
+		t.Fatal(err)
+	}
+	if out := xml.String(); !strings.Contains(out, "Unofficial draft") || !strings.Contains(out, "<mois>3</mois>") || !strings.Contains(out, "<libelle-personnalise>IPA</libelle-personnalise>") || !strings.Contains(out, "<stock-fin-periode>0.04435</stock-fin-periode>") {
+		t.Errorf("got XML %q, want the IPA balance", out)
+	}
+
+	// A negative closing stock is flagged
+	DB.Model(&StockEntry{}).Where("source_type = ? AND source_id = ?", sourceSale, bulk.ID).UpdateColumn("volume", -100)
+	if d, _ := MonthlyDRM(DB, date); !d.Negative() || !d.Lines[0].Negative() {
+		t.Errorf("got lines %+v, want a negative closing stock", d.Lines)
+	}
+}
+
+func TestMonthlyDRM_Blends(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	tank := Container{Name: "Tank", Volume: 100}
+	DB.Create(&tank)
+	ipa := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 40, Date: date.AddDate(0, -1, 0)}
+	stout := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepConditioning, StartVolume: 20, Date: date.AddDate(0, -1, 0)}
+	for _, b := range []*Batch{&ipa, &stout} {
+		DB.Create(b)
+	}
+	for _, m := range []Measurement{{BatchID: ipa.ID, Kind: KindGravity, Value: 1.060, Date: date}, {BatchID: ipa.ID, Kind: KindGravity, Value: 1.014, Date: date}, {BatchID: stout.ID, Kind: KindGravity, Value: 1.048, Date: date}, {BatchID: stout.ID, Kind: KindGravity, Value: 1.010, Date: date}} {
+		DB.Create(&m)
+	}
+	// 30 L of IPA at 6 % and 10 L of stout at 5 % make 40 L of an IPA blend at 5.75 %
+	blend := Blend{Date: date, ContainerID: tank.ID, Sources: []BlendSource{{BatchID: ipa.ID, ContainerID: fermenter, Volume: 30}, {BatchID: stout.ID, ContainerID: fermenter, Volume: 10}}}
+	if err := DB.Create(&blend).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := MonthlyDRM(DB, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DRMLine{
+		{Product: "IPA", Opening: 0.024, BlendedIn: 0.005, Closing: 0.029},
+		{Product: "Stout", Opening: 0.01, BlendedOut: 0.005, Closing: 0.005},
+	}
+	if !reflect.DeepEqual(d.Lines, want) || d.Negative() {
+		t.Errorf("got lines %+v, want %+v, the stout blended into the IPA without production", d.Lines, want)
+	}
+}
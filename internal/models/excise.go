@@ -0,0 +1,219 @@
+package models
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+)
+
+// Excise rate kinds
+const (
+	// KindDuty is the excise duty, in € per hl and per % vol
+	KindDuty = "Duty"
+	// KindLevy is the social security levy, in € per hl of pure alcohol, due above LevyABV
+	KindLevy = "Social security levy"
+)
+
+// ExciseKinds are the kinds of excise rates
+var ExciseKinds = []string{KindDuty, KindLevy}
+
+// LevyABV is the ABV above which the social security levy is due, in % vol
+const LevyABV = 18
+
+// ExciseRate is a rate of a kind of excise, valid over a date range for the beers within an ABV range.
+// The reduced rates of the small breweries apply up to a production, in hl brewed the year before.
+type ExciseRate struct {
+	gorm.Model
+	Name          string
+	Kind          string
+	ValidFrom     time.Time
+	ValidTo       *time.Time // still valid if empty
+	MinABV        float64    // % vol, excluded
+	MaxABV        float64    // % vol, included, unlimited if 0
+	MaxProduction float64    // hl a year, any production if 0
+	Rate          float64
+}
+
+// applies tells if the rate applies at the date to a beer of the ABV brewed by a brewery of the production
+func (r ExciseRate) applies(date time.Time, abv float64, production float64) bool {
+	if date.Before(r.ValidFrom) || (r.ValidTo != nil && !date.Before(r.ValidTo.AddDate(0, 0, 1))) {
+		return false
+	}
+	if abv <= r.MinABV || (r.MaxABV != 0 && abv > r.MaxABV) {
+		return false
+	}
+	return r.MaxProduction == 0 || production <= r.MaxProduction
+}
+
+// findRate gives the rate of the kind applying, the small brewery rate with the lowest production being the most specific
+func findRate(rates []ExciseRate, kind string, date time.Time, abv float64, production float64) (ExciseRate, bool) {
+	var found ExciseRate
+	ok := false
+	for _, r := range rates {
+		if r.Kind != kind || !r.applies(date, abv, production) {
+			continue
+		}
+		if !ok || (r.MaxProduction != 0 && (found.MaxProduction == 0 || r.MaxProduction < found.MaxProduction)) {
+			found, ok = r, true
+		}
+	}
+	return found, ok
+}
+
+// SaleExcise is the excise owed for a sale
+type SaleExcise struct {
+	SaleID      uint
+	Batch       Batch
+	Date        time.Time
+	Liters      float64
+	ABV         float64 // % vol, rounded to the tenth
+	PureAlcohol float64 // L
+	Rate        string  // the name of the duty rate, empty if no rate applies
+	Duty        float64
+	Levy        float64
+}
+
+// annualProduction gives the volume brewed in the year, in hl
+func annualProduction(db *gorm.DB, year int) (float64, error) {
+	var production struct{ Volume float64 }
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, time.Local)
+	err := db.Table("batches").Select("COALESCE(SUM(start_volume), 0) AS volume").Where("deleted_at IS NULL AND date >= ? AND date < ?", from, from.AddDate(1, 0, 0)).Scan(&production).Error
+	return production.Volume / 100, err
+}
+
+// SaleExcises works out the excise owed for the sales between the dates, the end excluded
+func SaleExcises(db *gorm.DB, from, to time.Time) ([]SaleExcise, error) {
+	var rates []ExciseRate
+	if err := db.Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	var sales []Sale
+	if err := db.Where("date >= ? AND date < ?", from, to).Order("date, id").Find(&sales).Error; err != nil {
+		return nil, err
+	}
+	batches := map[uint]*Batch{}
+	productions := map[int]float64{}
+	excises := []SaleExcise{}
+	for _, s := range sales {
+		b, ok := batches[s.BatchID]
+		if !ok {
+			b = &Batch{}
+			if err := db.First(b, s.BatchID).Error; err != nil {
+				return nil, err
+			}
+			abv, err := batchABV(db, *b)
+			if err != nil {
+				return nil, err
+			}
+			b.ABV = brewcalc.Round(abv, 1)
+			batches[s.BatchID] = b
+		}
+		production, ok := productions[s.Date.Year()]
+		if !ok {
+			var err error
+			if production, err = annualProduction(db, s.Date.Year()-1); err != nil {
+				return nil, err
+			}
+			productions[s.Date.Year()] = production
+		}
+		e := SaleExcise{SaleID: s.ID, Batch: *b, Date: s.Date, Liters: s.Liters, ABV: b.ABV, PureAlcohol: brewcalc.Round(s.Liters*b.ABV/100, 3)}
+		if r, ok := findRate(rates, KindDuty, s.Date, b.ABV, production); ok {
+			e.Rate = r.Name
+			e.Duty = brewcalc.Round(s.Liters/100*b.ABV*r.Rate, 2)
+		}
+		if r, ok := findRate(rates, KindLevy, s.Date, b.ABV, production); ok && b.ABV > LevyABV {
+			e.Levy = brewcalc.Round(e.PureAlcohol/100*r.Rate, 2)
+		}
+		excises = append(excises, e)
+	}
+	return excises, nil
+}
+
+// ExciseLine sums the excise owed for the sales at a rate
+type ExciseLine struct {
+	Rate        string
+	Sales       int
+	Volume      float64 // hl
+	PureAlcohol float64 // hl
+	Duty        float64
+	Levy        float64
+}
+
+// add adds a sale to the line
+func (l *ExciseLine) add(e SaleExcise) {
+	l.Sales++
+	l.Volume = brewcalc.Round(l.Volume+e.Liters/100, 4)
+	l.PureAlcohol = brewcalc.Round(l.PureAlcohol+e.PureAlcohol/100, 5)
+	l.Duty = brewcalc.Round(l.Duty+e.Duty, 2)
+	l.Levy = brewcalc.Round(l.Levy+e.Levy, 2)
+}
+
+// ExciseSummary is the excise owed for the sales of a month, by rate
+type ExciseSummary struct {
+	Month      time.Time
+	Production float64 // hl brewed the year before
+	Lines      []ExciseLine
+	Total      ExciseLine
+	Missing    int // sales without rate
+	Sales      []SaleExcise
+}
+
+// MonthlyExcise sums the excise owed for the sales of the month
+func MonthlyExcise(db *gorm.DB, month time.Time) (ExciseSummary, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	s := ExciseSummary{Month: from, Total: ExciseLine{Rate: "Total"}}
+	var err error
+	if s.Production, err = annualProduction(db, from.Year()-1); err != nil {
+		return s, err
+	}
+	if s.Sales, err = SaleExcises(db, from, from.AddDate(0, 1, 0)); err != nil {
+		return s, err
+	}
+	lines := map[string]*ExciseLine{}
+	for _, e := range s.Sales {
+		if e.Rate == "" {
+			s.Missing++
+		}
+		l, ok := lines[e.Rate]
+		if !ok {
+			l = &ExciseLine{Rate: e.Rate}
+			lines[e.Rate] = l
+		}
+		l.add(e)
+		s.Total.add(e)
+	}
+	for _, l := range lines {
+		s.Lines = append(s.Lines, *l)
+	}
+	sort.Slice(s.Lines, func(i, j int) bool { return s.Lines[i].Rate < s.Lines[j].Rate })
+	return s, nil
+}
+
+// configureExcise adds the excise rates settings, and the monthly excise report
+func configureExcise(Admin *admin.Admin) {
+	rate := Admin.AddResource(&ExciseRate{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	rate.IndexAttrs("Name", "Kind", "ValidFrom", "ValidTo", "MinABV", "MaxABV", "MaxProduction", "Rate")
+	rate.Meta(&admin.Meta{Name: "Kind", Type: "select_one", Config: &admin.SelectOneConfig{Collection: ExciseKinds}})
+	rate.Meta(&admin.Meta{Name: "Rate", Label: "Rate (€ per hl and % vol for the duty, per hl of pure alcohol for the levy)"})
+	rate.Meta(&admin.Meta{Name: "MaxProduction", Label: "Max production (hl brewed the year before, for the small brewery rates)"})
+
+	Admin.GetRouter().Get("/excise", func(context *admin.Context) {
+		month, err := time.ParseInLocation("2006-01", context.Request.URL.Query().Get("month"), time.Local)
+		if err != nil {
+			now := time.Now()
+			month = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.Local)
+		}
+		s, err := MonthlyExcise(context.GetDB().New(), month)
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		context.Execute("excise", s)
+	})
+	Admin.AddMenu(&admin.Menu{Name: "Excise", Link: "/admin/excise", Ancestors: []string{"Sales"}})
+}
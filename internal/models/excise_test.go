@@ -0,0 +1,86 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// testExciseRates are rates as of the French beer excise
+func testExciseRates() []ExciseRate {
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, time.Local) }
+	end := day(2025, 12, 31)
+	return []ExciseRate{
+		{Name: "Normal 2025", Kind: KindDuty, ValidFrom: day(2025, 1, 1), ValidTo: &end, MinABV: 2.8, Rate: 7.5},
+		{Name: "Normal", Kind: KindDuty, ValidFrom: day(2026, 1, 1), MinABV: 2.8, Rate: 8},
+		{Name: "Light", Kind: KindDuty, ValidFrom: day(2026, 1, 1), MaxABV: 2.8, Rate: 4},
+		{Name: "Small brewery", Kind: KindDuty, ValidFrom: day(2026, 1, 1), MinABV: 2.8, MaxProduction: 200000, Rate: 6},
+		{Name: "Micro brewery", Kind: KindDuty, ValidFrom: day(2026, 1, 1), MinABV: 2.8, MaxProduction: 10000, Rate: 4},
+		{Name: "Levy", Kind: KindLevy, ValidFrom: day(2026, 1, 1), Rate: 600},
+	}
+}
+
+func TestFindRate(t *testing.T) {
+	rates := testExciseRates()
+	tests := []struct {
+		name       string
+		kind       string
+		date       time.Time
+		abv        float64
+		production float64
+		want       string
+	}{
+		{"normal", KindDuty, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), 6, 500000, "Normal"},
+		{"last_day_of_former_rate", KindDuty, time.Date(2025, 12, 31, 23, 0, 0, 0, time.Local), 6, 500000, "Normal 2025"},
+		{"light", KindDuty, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), 2.8, 500000, "Light"},
+		{"small_brewery", KindDuty, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), 6, 50000, "Small brewery"},
+		{"micro_brewery", KindDuty, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), 6, 200, "Micro brewery"},
+		{"levy", KindLevy, time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local), 20, 200, "Levy"},
+		{"no_rate", KindDuty, time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), 6, 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := findRate(rates, tt.kind, tt.date, tt.abv, tt.production); got.Name != tt.want {
+				t.Errorf("findRate() = %v, want %v", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestMonthlyExcise(t *testing.T) {
+	defer initTestDB(t)()
+
+	for _, r := range testExciseRates() {
+		DB.Create(&r)
+	}
+	date := time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	ipa := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date.AddDate(-1, 0, 0)}
+	barleyWine := Batch{Recipe: Recipe{Name: "Barley wine"}, Step: StepConditioning, StartVolume: 20, Date: date}
+	for _, b := range []*Batch{&ipa, &barleyWine} {
+		DB.Create(b)
+	}
+	for _, m := range []Measurement{{BatchID: ipa.ID, Kind: KindGravity, Value: 1.060, Date: date}, {BatchID: ipa.ID, Kind: KindGravity, Value: 1.014, Date: date}, {BatchID: barleyWine.ID, Kind: KindGravity, Value: 1.160, Date: date}, {BatchID: barleyWine.ID, Kind: KindGravity, Value: 1.010, Date: date}} {
+		DB.Create(&m)
+	}
+	DB.Create(&Sale{BatchID: ipa.ID, Date: date, FromID: fermenter, Volume: 50})
+	DB.Create(&Sale{BatchID: barleyWine.ID, Date: date, FromID: fermenter, Volume: 10})
+	DB.Create(&Sale{BatchID: ipa.ID, Date: date.AddDate(0, 1, 0), FromID: fermenter, Volume: 10})
+
+	s, err := MonthlyExcise(DB, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Production != 1 || len(s.Sales) != 2 || s.Missing != 0 {
+		t.Fatalf("got production %v, %v sales and %v without rate, want 1 hl and the 2 sales of the month", s.Production, len(s.Sales), s.Missing)
+	}
+	ipaSale, wineSale := s.Sales[0], s.Sales[1]
+	if ipaSale.ABV != 6 || ipaSale.Rate != "Micro brewery" || ipaSale.Duty != 12 || ipaSale.Levy != 0 {
+		t.Errorf("got IPA sale %+v, want 0.5 hl at 6 %% and 4 € : 12 € of duty", ipaSale)
+	}
+	if wineSale.ABV != 19.7 || wineSale.PureAlcohol != 1.97 || wineSale.Duty != 7.88 || wineSale.Levy != 11.82 {
+		t.Errorf("got barley wine sale %+v, want 7.88 € of duty and 11.82 € of levy", wineSale)
+	}
+	if len(s.Lines) != 1 || s.Total.Volume != 0.6 || s.Total.PureAlcohol != 0.0497 || s.Total.Duty != 19.88 || s.Total.Levy != 11.82 {
+		t.Errorf("got lines %+v and total %+v, want the sales summed", s.Lines, s.Total)
+	}
+}
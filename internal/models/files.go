@@ -0,0 +1,63 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+)
+
+// fileUpload is the argument of the actions importing a file
+type fileUpload struct {
+	File string
+}
+
+// newFileUpload creates the argument resource of an action importing a file, which reads the uploaded file content
+func newFileUpload(adm *admin.Admin) *admin.Resource {
+	upload := adm.NewResource(&fileUpload{})
+	upload.Meta(&admin.Meta{
+		Name: "File",
+		Type: "file",
+		Setter: func(record interface{}, metaValue *resource.MetaValue, context *qor.Context) {
+			files, ok := metaValue.Value.([]*multipart.FileHeader)
+			if !ok || len(files) == 0 {
+				return
+			}
+			file, err := files[0].Open()
+			if err != nil {
+				context.AddError(err)
+				return
+			}
+			defer file.Close()
+			content, err := ioutil.ReadAll(file)
+			if err != nil {
+				context.AddError(err)
+				return
+			}
+			record.(*fileUpload).File = string(content)
+		},
+	})
+	return upload
+}
+
+// uploadedFile gives the content of the file uploaded to an action
+func uploadedFile(argument *admin.ActionArgument) (string, bool) {
+	u, ok := argument.Argument.(*fileUpload)
+	if !ok || u.File == "" {
+		return "", false
+	}
+	return u.File, true
+}
+
+// sendFile makes an action respond with a file to download instead of the default response
+func sendFile(argument *admin.ActionArgument, contentType string, fileName string) io.Writer {
+	argument.SkipDefaultResponse = true
+	w := argument.Context.Writer
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	return w
+}
@@ -0,0 +1,663 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Ingredient categories
+const (
+	CategoryFermentable = "Fermentable"
+	CategoryHop         = "Hop"
+	CategoryYeast       = "Yeast"
+	CategoryPackaging   = "Packaging"
+	CategoryOther       = "Other"
+)
+
+// IngredientCategories are the categories of the inventory catalogue
+var IngredientCategories = []string{CategoryFermentable, CategoryHop, CategoryYeast, CategoryPackaging, CategoryOther}
+
+// IngredientUnits are the units the ingredients are counted in, with their factor to the base unit of their dimension
+var IngredientUnits = map[string]struct {
+	Dimension string
+	Factor    float64
+}{
+	"kg":   {"mass", 1000},
+	"g":    {"mass", 1},
+	"L":    {"volume", 1000},
+	"mL":   {"volume", 1},
+	"unit": {"count", 1},
+}
+
+// Sources of the ingredient stock movements
+const (
+	sourceDelivery    = "delivery"
+	sourceConsumption = "consumption"
+)
+
+// Inventory errors
+const (
+	errUnknownIngredientUnit = "This unit does not exist"
+	errLotOverused           = "More of this lot was used than received"
+	errNotEnoughIngredient   = "There is not enough of this lot in stock"
+	errLotInUse              = "This lot was used in a batch"
+)
+
+// Supplier sells ingredients
+type Supplier struct {
+	gorm.Model
+	Name    string
+	Contact string
+}
+
+// Ingredient is an item of the inventory catalogue, counted in its unit
+type Ingredient struct {
+	gorm.Model
+	Name     string
+	Category string
+	Unit     string
+	Lots     []Lot
+	Stock    float64 `gorm:"-"`
+}
+
+// Delivery is a reception of ingredients lots from a supplier
+type Delivery struct {
+	gorm.Model
+	Supplier   Supplier `gorm:"association_autoupdate:false;association_autocreate:false"`
+	SupplierID uint
+	Date       time.Time
+	Reference  string
+	Lots       []Lot
+}
+
+// Lot is a quantity of an ingredient received in a delivery, in the ingredient unit
+type Lot struct {
+	gorm.Model
+	DeliveryID   uint       `gorm:"index"`
+	Ingredient   Ingredient `gorm:"association_autoupdate:false;association_autocreate:false"`
+	IngredientID uint       `gorm:"index"`
+	Number       string
+	BestBefore   *time.Time
+	Quantity     float64
+	UnitPrice    float64 // the purchase price excluding VAT, per ingredient unit
+	Remaining    float64 `gorm:"-"`
+}
+
+// Consumption is a quantity of a lot used by a batch, in the ingredient unit
+type Consumption struct {
+	gorm.Model
+	BatchID  uint `gorm:"index"`
+	Lot      Lot  `gorm:"association_autoupdate:false;association_autocreate:false"`
+	LotID    uint `gorm:"index"`
+	Date     time.Time
+	Quantity float64
+}
+
+// StockMovement is a line of the ingredients ledger : a quantity of a lot entering (positive) or leaving (negative) the inventory
+type StockMovement struct {
+	ID           uint       `gorm:"primary_key"`
+	Ingredient   Ingredient `gorm:"association_autoupdate:false;association_autocreate:false"`
+	IngredientID uint       `gorm:"index"`
+	Lot          Lot        `gorm:"association_autoupdate:false;association_autocreate:false"`
+	LotID        uint       `gorm:"index"`
+	Date         time.Time
+	Quantity     float64
+	SourceType   string `gorm:"index:idx_stock_movements_source"`
+	SourceID     uint   `gorm:"index:idx_stock_movements_source"`
+}
+
+// IngredientStock is the stock of an ingredient needed by a recipe
+type IngredientStock struct {
+	Name    string
+	Unit    string
+	Needed  float64
+	InStock float64
+	Tracked bool // the ingredient is in the catalogue
+}
+
+// Enough tells if the stock covers the need, untracked ingredients being assumed available
+func (s IngredientStock) Enough() bool {
+	return !s.Tracked || s.InStock >= s.Needed
+}
+
+// ConvertQuantity converts a quantity between two units of the same dimension
+func ConvertQuantity(quantity float64, from string, to string) (float64, bool) {
+	f, ok := IngredientUnits[from]
+	t, ok2 := IngredientUnits[to]
+	if !ok || !ok2 || f.Dimension != t.Dimension {
+		return 0, false
+	}
+	return quantity * f.Factor / t.Factor, true
+}
+
+// Stringify names the lot after its ingredient, when loaded
+func (l Lot) Stringify() string {
+	if l.Ingredient.Name == "" {
+		return l.Number
+	}
+	return fmt.Sprintf("%s - %s", l.Ingredient.Name, l.Number)
+}
+
+// BeforeSave checks the ingredient unit
+func (i *Ingredient) BeforeSave() error {
+	if _, ok := IngredientUnits[i.Unit]; !ok {
+		return validations.NewError(i, "Unit", errUnknownIngredientUnit)
+	}
+	return nil
+}
+
+// writeMovements replaces the stock movements of a source by the given one, if any
+func writeMovements(tx *gorm.DB, sourceType string, sourceID uint, movement *StockMovement) error {
+	if err := tx.Where("source_type = ? AND source_id = ?", sourceType, sourceID).Delete(StockMovement{}).Error; err != nil {
+		return err
+	}
+	if movement == nil {
+		return nil
+	}
+	movement.SourceType, movement.SourceID = sourceType, sourceID
+	return tx.Create(movement).Error
+}
+
+// lotRemaining gives the quantity left of a lot
+func lotRemaining(tx *gorm.DB, lotID uint) (float64, error) {
+	var stock struct{ Quantity float64 }
+	err := tx.Table("stock_movements").Select("COALESCE(SUM(quantity), 0) AS quantity").Where("lot_id = ?", lotID).Scan(&stock).Error
+	return stock.Quantity, err
+}
+
+// AfterSave records the lot reception into the ingredients ledger, at the delivery date, and checks that no more was used than received
+func (l *Lot) AfterSave(tx *gorm.DB) error {
+	var d Delivery
+	if err := tx.Select("date").First(&d, l.DeliveryID).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	if err := writeMovements(tx, sourceDelivery, l.ID, &StockMovement{IngredientID: l.IngredientID, LotID: l.ID, Date: d.Date, Quantity: l.Quantity}); err != nil {
+		return err
+	}
+	if err := tx.Model(StockMovement{}).Where("lot_id = ?", l.ID).UpdateColumn("ingredient_id", l.IngredientID).Error; err != nil {
+		return err
+	}
+	remaining, err := lotRemaining(tx, l.ID)
+	if err != nil {
+		return err
+	}
+	if remaining < 0 {
+		return validations.NewError(l, "Quantity", errLotOverused)
+	}
+	return nil
+}
+
+// BeforeDelete prevents the deletion of a lot used in a batch
+func (l *Lot) BeforeDelete(tx *gorm.DB) error {
+	var count int
+	if err := tx.Model(Consumption{}).Where("lot_id = ?", l.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return validations.NewError(l, "Number", errLotInUse)
+	}
+	return nil
+}
+
+// AfterDelete removes the lot reception from the ingredients ledger
+func (l *Lot) AfterDelete(tx *gorm.DB) error {
+	return writeMovements(tx, sourceDelivery, l.ID, nil)
+}
+
+// AfterSave moves the lots of the delivery to its date
+func (d *Delivery) AfterSave(tx *gorm.DB) error {
+	return tx.Exec("UPDATE stock_movements SET date = ? WHERE source_type = ? AND source_id IN (SELECT id FROM lots WHERE delivery_id = ? AND deleted_at IS NULL)", d.Date, sourceDelivery, d.ID).Error
+}
+
+// BeforeSave dates the consumption now by default
+func (c *Consumption) BeforeSave() error {
+	if c.Date.IsZero() {
+		c.Date = time.Now()
+	}
+	return nil
+}
+
+// AfterSave records the consumption into the ingredients ledger and checks the lot stock
+func (c *Consumption) AfterSave(tx *gorm.DB) error {
+	var l Lot
+	if err := tx.First(&l, c.LotID).Error; err != nil {
+		return err
+	}
+	if err := writeMovements(tx, sourceConsumption, c.ID, &StockMovement{IngredientID: l.IngredientID, LotID: l.ID, Date: c.Date, Quantity: -c.Quantity}); err != nil {
+		return err
+	}
+	remaining, err := lotRemaining(tx, l.ID)
+	if err != nil {
+		return err
+	}
+	if remaining < 0 {
+		return validations.NewError(c, "Lot", errNotEnoughIngredient)
+	}
+	return nil
+}
+
+// AfterDelete gives the consumed quantity back to the inventory
+func (c *Consumption) AfterDelete(tx *gorm.DB) error {
+	return writeMovements(tx, sourceConsumption, c.ID, nil)
+}
+
+// releaseIngredients gives back to the inventory the lots consumed by a batch
+func releaseIngredients(tx *gorm.DB, batchID uint) error {
+	var consumptions []Consumption
+	if err := tx.Where("batch_id = ?", batchID).Find(&consumptions).Error; err != nil {
+		return err
+	}
+	for i := range consumptions {
+		if err := tx.Delete(&consumptions[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// need is a quantity of an ingredient needed by a recipe
+type need struct {
+	category string
+	name     string
+	quantity float64
+	unit     string
+}
+
+// recipeNeeds lists the ingredients needed by a recipe, the additions of a same hop being summed
+func recipeNeeds(r Recipe) []need {
+	var needs []need
+	add := func(n need) {
+		for i := range needs {
+			if needs[i].category == n.category && strings.EqualFold(needs[i].name, n.name) {
+				needs[i].quantity += n.quantity
+				return
+			}
+		}
+		needs = append(needs, n)
+	}
+	for _, f := range r.Fermentables {
+		add(need{CategoryFermentable, f.Name, f.Weight, "kg"})
+	}
+	for _, h := range r.Hops {
+		add(need{CategoryHop, h.Name, h.Weight, "g"})
+	}
+	for _, y := range r.Yeasts {
+		add(need{CategoryYeast, y.Name, 1, "unit"})
+	}
+	return needs
+}
+
+// findIngredient finds the catalogue ingredient matching a need, by category and name whatever the case
+func findIngredient(catalogue []Ingredient, n need) (Ingredient, bool) {
+	for _, i := range catalogue {
+		if i.Category == n.category && strings.EqualFold(i.Name, n.name) {
+			return i, true
+		}
+	}
+	return Ingredient{}, false
+}
+
+// LoadIngredientStock works out the stock of the given ingredients from the ingredients ledger, with a single query
+func LoadIngredientStock(db *gorm.DB, ingredients ...*Ingredient) error {
+	if len(ingredients) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, i := range ingredients {
+		ids = append(ids, i.ID)
+	}
+	var rows []struct {
+		IngredientID uint
+		Quantity     float64
+	}
+	if err := db.Table("stock_movements").Select("ingredient_id, SUM(quantity) AS quantity").Where("ingredient_id IN (?)", ids).Group("ingredient_id").Scan(&rows).Error; err != nil {
+		return err
+	}
+	for _, i := range ingredients {
+		i.Stock = 0
+		for _, r := range rows {
+			if r.IngredientID == i.ID {
+				i.Stock = r.Quantity
+			}
+		}
+	}
+	return nil
+}
+
+// LoadLots works out the quantity left of the given lots from the ingredients ledger, and loads their ingredients
+func LoadLots(db *gorm.DB, lots ...*Lot) error {
+	if len(lots) == 0 {
+		return nil
+	}
+	var ids, ingredientIDs []uint
+	for _, l := range lots {
+		ids = append(ids, l.ID)
+		ingredientIDs = append(ingredientIDs, l.IngredientID)
+	}
+	var rows []struct {
+		LotID    uint
+		Quantity float64
+	}
+	if err := db.Table("stock_movements").Select("lot_id, SUM(quantity) AS quantity").Where("lot_id IN (?)", ids).Group("lot_id").Scan(&rows).Error; err != nil {
+		return err
+	}
+	var ingredients []Ingredient
+	if err := db.Where("id IN (?)", ingredientIDs).Find(&ingredients).Error; err != nil {
+		return err
+	}
+	for _, l := range lots {
+		l.Remaining = 0
+		for _, r := range rows {
+			if r.LotID == l.ID {
+				l.Remaining = r.Quantity
+			}
+		}
+		for _, i := range ingredients {
+			if i.ID == l.IngredientID {
+				l.Ingredient = i
+			}
+		}
+	}
+	return nil
+}
+
+// catalogue loads the inventory catalogue with the ingredients stocks
+func catalogue(db *gorm.DB) ([]Ingredient, error) {
+	var ingredients []Ingredient
+	if err := db.Find(&ingredients).Error; err != nil {
+		return nil, err
+	}
+	var pointers []*Ingredient
+	for i := range ingredients {
+		pointers = append(pointers, &ingredients[i])
+	}
+	return ingredients, LoadIngredientStock(db, pointers...)
+}
+
+// RecipeInventory gives the stock of the ingredients needed by a recipe, which must be loaded
+func RecipeInventory(db *gorm.DB, r Recipe) ([]IngredientStock, error) {
+	ingredients, err := catalogue(db)
+	if err != nil {
+		return nil, err
+	}
+	var stocks []IngredientStock
+	for _, n := range recipeNeeds(r) {
+		s := IngredientStock{Name: n.name, Unit: n.unit, Needed: n.quantity}
+		if i, ok := findIngredient(ingredients, n); ok {
+			if needed, ok := ConvertQuantity(n.quantity, n.unit, i.Unit); ok {
+				s.Unit, s.Needed, s.InStock, s.Tracked = i.Unit, needed, i.Stock, true
+			}
+		}
+		stocks = append(stocks, s)
+	}
+	return stocks, nil
+}
+
+// fefoLots gives the lots of an ingredient still in stock and not expired at the given date, the first to expire first
+func fefoLots(tx *gorm.DB, ingredientID uint, date time.Time) ([]Lot, error) {
+	var lots []Lot
+	if err := tx.Where("ingredient_id = ? AND (best_before IS NULL OR best_before >= ?)", ingredientID, date).Order("id").Find(&lots).Error; err != nil {
+		return nil, err
+	}
+	var pointers []*Lot
+	for i := range lots {
+		pointers = append(pointers, &lots[i])
+	}
+	if err := LoadLots(tx, pointers...); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		if lots[i].BestBefore == nil || lots[j].BestBefore == nil {
+			return lots[j].BestBefore == nil && lots[i].BestBefore != nil
+		}
+		return lots[i].BestBefore.Before(*lots[j].BestBefore)
+	})
+	var inStock []Lot
+	for _, l := range lots {
+		if l.Remaining > 0 {
+			inStock = append(inStock, l)
+		}
+	}
+	return inStock, nil
+}
+
+// consumeIngredients deducts the recipe ingredients of a batch from the inventory, first expired first out.
+// The ingredients for which lots were already chosen on the batch, and those not in the catalogue, are left as is.
+func consumeIngredients(tx *gorm.DB, b *Batch, date time.Time) error {
+	recipe, err := b.SnapshotRecipe()
+	if err != nil {
+		return err
+	}
+	ingredients, err := catalogue(tx)
+	if err != nil {
+		return err
+	}
+	var chosen []Lot
+	if err := tx.Where("id IN (SELECT lot_id FROM consumptions WHERE batch_id = ? AND deleted_at IS NULL)", b.ID).Find(&chosen).Error; err != nil {
+		return err
+	}
+	for _, n := range recipeNeeds(recipe) {
+		i, ok := findIngredient(ingredients, n)
+		if !ok {
+			continue
+		}
+		covered := false
+		for _, l := range chosen {
+			covered = covered || l.IngredientID == i.ID
+		}
+		if covered {
+			continue
+		}
+		quantity, ok := ConvertQuantity(n.quantity, n.unit, i.Unit)
+		if !ok {
+			return validations.NewError(b, "Step", fmt.Sprintf("%s is counted in %s, which can't be converted from %s", i.Name, i.Unit, n.unit))
+		}
+		lots, err := fefoLots(tx, i.ID, date)
+		if err != nil {
+			return err
+		}
+		for _, l := range lots {
+			if quantity <= 0 {
+				break
+			}
+			used := quantity
+			if l.Remaining < used {
+				used = l.Remaining
+			}
+			if err := tx.Create(&Consumption{BatchID: b.ID, LotID: l.ID, Date: date, Quantity: used}).Error; err != nil {
+				return err
+			}
+			quantity -= used
+		}
+		if quantity > 1e-9 {
+			return validations.NewError(b, "Step", fmt.Sprintf("There is not enough %s in stock: %g %s missing", i.Name, quantity, i.Unit))
+		}
+	}
+	return nil
+}
+
+// LoadContainers works out the beer held by the given containers from the stock ledger
+func LoadContainers(db *gorm.DB, containers ...*Container) error {
+	return LoadContainersAt(db, time.Time{}, containers...)
+}
+
+// LoadContainersAt works out the beer held by the given containers as of the end of the day
+func LoadContainersAt(db *gorm.DB, day time.Time, containers ...*Container) error {
+	if len(containers) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	var rows []struct {
+		ContainerID uint
+		BatchID     uint
+		Volume      int
+	}
+	err := asOf(db.Table("stock_entries"), "stock_entries", day).Select("container_id, batch_id, SUM(volume) AS volume").
+		Where("container_id IN (?)", ids).Group("container_id, batch_id").Having("SUM(volume) <> 0").Order("container_id, batch_id").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	var batchIDs []uint
+	for _, r := range rows {
+		batchIDs = append(batchIDs, r.BatchID)
+	}
+	var batches []Batch
+	if len(batchIDs) > 0 {
+		if err := db.Where("id IN (?)", batchIDs).Find(&batches).Error; err != nil {
+			return err
+		}
+	}
+	for _, c := range containers {
+		c.Filled = 0
+		var lines []string
+		for _, r := range rows {
+			if r.ContainerID != c.ID {
+				continue
+			}
+			name := fmt.Sprintf("#%d", r.BatchID)
+			for _, b := range batches {
+				if b.ID == r.BatchID {
+					name = b.Stringify()
+				}
+			}
+			c.Filled += r.Volume
+			lines = append(lines, fmt.Sprintf("%s: %d", name, r.Volume))
+		}
+		c.Stock = strings.Join(lines, ", ")
+	}
+	return nil
+}
+
+// configureInventory adds the ingredients catalogue, deliveries and stock movements admins, the lots used by the batches, and shows the stocks next to the recipes and containers
+func configureInventory(Admin *admin.Admin, recipe *admin.Resource, batch *admin.Resource, container *admin.Resource) {
+	menu := &admin.Config{Menu: []string{"Inventory"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")}
+	ingredient := Admin.AddResource(&Ingredient{}, menu)
+	ingredient.Meta(&admin.Meta{Name: "Category", Type: "select_one", Config: &admin.SelectOneConfig{Collection: IngredientCategories}})
+	var units []string
+	for u := range IngredientUnits {
+		units = append(units, u)
+	}
+	sort.Strings(units)
+	ingredient.Meta(&admin.Meta{Name: "Unit", Type: "select_one", Config: &admin.SelectOneConfig{Collection: units}})
+	ingredient.Meta(&admin.Meta{Name: "Stock", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	ingredient.IndexAttrs("Name", "Category", "Unit", "Stock")
+	ingredient.EditAttrs("Name", "Category", "Unit")
+	ingredient.NewAttrs("Name", "Category", "Unit")
+	ingredient.ShowAttrs("Name", "Category", "Unit", "Stock", "Lots")
+	ingredient.Filter(&admin.Filter{Name: "Category", Config: &admin.SelectOneConfig{Collection: IngredientCategories}})
+
+	Admin.AddResource(&Supplier{}, menu)
+	delivery := Admin.AddResource(&Delivery{}, menu)
+	delivery.IndexAttrs("Date", "Supplier", "Reference")
+	lots := delivery.Meta(&admin.Meta{Name: "Lots"}).Resource
+	lots.EditAttrs("Ingredient", "Number", "BestBefore", "Quantity")
+	lots.NewAttrs("Ingredient", "Number", "BestBefore", "Quantity")
+
+	lot := Admin.AddResource(&Lot{}, &admin.Config{Menu: []string{"Inventory"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.Update, "admin").Allow(roles.Delete, "admin")})
+	lot.Meta(&admin.Meta{Name: "Remaining", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	lot.IndexAttrs("Ingredient", "Number", "BestBefore", "Quantity", "Remaining")
+	lot.EditAttrs("Number", "BestBefore", "Quantity")
+	lot.ShowAttrs("Ingredient", "Number", "BestBefore", "Quantity", "Remaining")
+
+	movement := Admin.AddResource(&StockMovement{}, &admin.Config{Menu: []string{"Inventory"}, Permission: roles.Allow(roles.Read, roles.Anyone)})
+	movement.IndexAttrs("Date", "Ingredient", "Lot", "Quantity", "SourceType", "SourceID")
+
+	// Work out the stocks of the ingredients and the lots, for a whole page at once
+	findManyIngredients := ingredient.FindManyHandler
+	ingredient.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findManyIngredients(result, context); err != nil {
+			return err
+		}
+		if ingredients, ok := result.(*[]*Ingredient); ok {
+			return LoadIngredientStock(context.GetDB().New(), *ingredients...)
+		}
+		return nil
+	}
+	findOneIngredient := ingredient.FindOneHandler
+	ingredient.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOneIngredient(result, metaValues, context); err != nil {
+			return err
+		}
+		if i, ok := result.(*Ingredient); ok {
+			return LoadIngredientStock(context.GetDB().New(), i)
+		}
+		return nil
+	}
+	findManyLots := lot.FindManyHandler
+	lot.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findManyLots(result, context); err != nil {
+			return err
+		}
+		if lots, ok := result.(*[]*Lot); ok {
+			return LoadLots(context.GetDB().New(), *lots...)
+		}
+		return nil
+	}
+	findOneLot := lot.FindOneHandler
+	lot.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOneLot(result, metaValues, context); err != nil {
+			return err
+		}
+		if l, ok := result.(*Lot); ok {
+			return LoadLots(context.GetDB().New(), l)
+		}
+		return nil
+	}
+
+	// The lots used by a batch are chosen first expired first out when the brew starts, unless chosen before
+	consumptions := batch.Meta(&admin.Meta{Name: "Consumptions"}).Resource
+	consumptions.Meta(&admin.Meta{Name: "Lot", Type: "select_one", Config: &admin.SelectOneConfig{RemoteDataResource: lot}})
+	consumptions.EditAttrs("Lot", "Quantity")
+	consumptions.NewAttrs("Lot", "Quantity")
+
+	recipe.Meta(&admin.Meta{
+		Name:   "Inventory",
+		Type:   "ingredient_stock",
+		Setter: func(interface{}, *resource.MetaValue, *qor.Context) {},
+		Valuer: func(record interface{}, context *qor.Context) interface{} {
+			if r, ok := record.(*Recipe); ok && r.ID != 0 {
+				stocks, _ := RecipeInventory(context.GetDB().New(), *r)
+				return stocks
+			}
+			return nil
+		},
+	})
+
+	for _, name := range []string{"Filled", "Stock"} {
+		container.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	}
+	container.EditAttrs("Name", "Volume")
+	container.NewAttrs("Name", "Volume")
+	findManyContainers := container.FindManyHandler
+	container.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findManyContainers(result, context); err != nil {
+			return err
+		}
+		if containers, ok := result.(*[]*Container); ok {
+			return LoadContainers(context.GetDB().New(), *containers...)
+		}
+		return nil
+	}
+	findOneContainer := container.FindOneHandler
+	container.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOneContainer(result, metaValues, context); err != nil {
+			return err
+		}
+		if c, ok := result.(*Container); ok {
+			return LoadContainers(context.GetDB().New(), c)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,292 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Inventory adjustment kinds, tagging the events posted by the inventory counts
+const (
+	KindInventoryLoss = "Inventory loss"
+	KindInventoryGain = "Inventory gain"
+)
+
+// Inventory count errors
+const (
+	errCountApproved  = "An approved inventory count can't be changed"
+	errCountEmpty     = "An inventory count needs lines to be approved"
+	errCountDuplicate = "This batch is already counted in this container"
+	errCountNegative  = "The measured volume can't be negative"
+	errCountEvent     = "This event adjusts an approved inventory count, it can't be changed"
+)
+
+// InventoryCount is a physical count of the beer held in the containers, posting the variance against the stock ledger as adjustment events once approved by an admin
+type InventoryCount struct {
+	gorm.Model
+	Date       time.Time
+	User       string // who counted
+	Lines      []InventoryCountLine
+	ApprovedBy string
+	ApprovedAt *time.Time
+}
+
+// Stringify gives the count date
+func (c InventoryCount) Stringify() string {
+	return fmt.Sprintf("#%d %s", c.ID, c.Date.Format("2006-01-02"))
+}
+
+// InventoryCountLine is the volume of a batch measured in a container, and its variance against the volume computed from the stock ledger as of the count day
+type InventoryCountLine struct {
+	gorm.Model
+	InventoryCountID uint
+	Batch            Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID          uint
+	Container        Container `gorm:"foreignkey:ContainerID;association_autoupdate:false;association_autocreate:false"`
+	ContainerID      uint
+	Measured         int  // L
+	Computed         int  // L
+	Variance         int  // the measured volume less the computed one, in L
+	EventID          uint // the adjustment event, once approved
+}
+
+// countApproved tells if the count is approved
+func countApproved(tx *gorm.DB, countID uint) (bool, error) {
+	if countID == 0 {
+		return false, nil
+	}
+	var count int
+	err := tx.New().Model(&InventoryCount{}).Where("id = ? AND approved_at IS NOT NULL", countID).Count(&count).Error
+	return count > 0, err
+}
+
+// containerStockAt gives the volume of the batch held in the container as of the end of the day, from the stock ledger
+func containerStockAt(tx *gorm.DB, batchID, containerID uint, day time.Time) (int, error) {
+	var stock struct{ Volume int }
+	err := tx.Table("stock_entries").Select("COALESCE(SUM(volume), 0) AS volume").Where("batch_id = ? AND container_id = ? AND date < ?", batchID, containerID, endOfDay(day)).Scan(&stock).Error
+	return stock.Volume, err
+}
+
+// BeforeSave prevents changing an approved count, and dates the count
+func (c *InventoryCount) BeforeSave(tx *gorm.DB) error {
+	if approved, err := countApproved(tx, c.ID); err != nil || approved {
+		if err == nil {
+			err = validations.NewError(c, "Lines", errCountApproved)
+		}
+		return err
+	}
+	if c.Date.IsZero() {
+		c.Date = time.Now()
+	}
+	return nil
+}
+
+// BeforeDelete prevents deleting an approved count, its adjustments being posted
+func (c *InventoryCount) BeforeDelete(tx *gorm.DB) error {
+	if approved, err := countApproved(tx, c.ID); err != nil || approved {
+		if err == nil {
+			err = validations.NewError(c, "Lines", errCountApproved)
+		}
+		return err
+	}
+	return nil
+}
+
+// AfterDelete deletes the lines of the count
+func (c *InventoryCount) AfterDelete(tx *gorm.DB) error {
+	return tx.New().Where("inventory_count_id = ?", c.ID).Delete(InventoryCountLine{}).Error
+}
+
+// BeforeSave prevents changing the lines of an approved count, and works out the variance against the stock ledger as of the count day
+func (l *InventoryCountLine) BeforeSave(tx *gorm.DB) error {
+	tx = tx.New()
+	if approved, err := countApproved(tx, l.InventoryCountID); err != nil || approved {
+		if err == nil {
+			err = validations.NewError(l, "Measured", errCountApproved)
+		}
+		return err
+	}
+	l.BatchID = keyOf(l.BatchID, l.Batch.ID)
+	l.ContainerID = keyOf(l.ContainerID, l.Container.ID)
+	if l.ContainerID == 0 {
+		fermenter, err := fermenterID(tx)
+		if err != nil {
+			return err
+		}
+		l.ContainerID = fermenter
+	}
+	if l.Measured < 0 {
+		return validations.NewError(l, "Measured", errCountNegative)
+	}
+	var duplicates int
+	if err := tx.Model(&InventoryCountLine{}).Where("inventory_count_id = ? AND batch_id = ? AND container_id = ? AND id <> ?", l.InventoryCountID, l.BatchID, l.ContainerID, l.ID).Count(&duplicates).Error; err != nil {
+		return err
+	}
+	if duplicates > 0 {
+		return validations.NewError(l, "Container", errCountDuplicate)
+	}
+	day := time.Now()
+	if l.InventoryCountID != 0 {
+		var count InventoryCount
+		if err := tx.First(&count, l.InventoryCountID).Error; err != nil {
+			return err
+		}
+		day = count.Date
+	}
+	return l.compute(tx, day)
+}
+
+// compute works out the volume computed from the stock ledger as of the day, and the variance
+func (l *InventoryCountLine) compute(tx *gorm.DB, day time.Time) error {
+	computed, err := containerStockAt(tx, l.BatchID, l.ContainerID, day)
+	if err != nil {
+		return err
+	}
+	l.Computed = computed
+	l.Variance = l.Measured - computed
+	return nil
+}
+
+// BeforeDelete prevents deleting the lines of an approved count
+func (l *InventoryCountLine) BeforeDelete(tx *gorm.DB) error {
+	if approved, err := countApproved(tx, l.InventoryCountID); err != nil || approved {
+		if err == nil {
+			err = validations.NewError(l, "Measured", errCountApproved)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkCountEvent prevents changing an adjustment event posted by an approved count, the count giving the volume actually held
+func checkCountEvent(tx *gorm.DB, e *Event) error {
+	if e.ID == 0 {
+		return nil
+	}
+	var n int
+	if err := tx.New().Model(&InventoryCountLine{}).Where("event_id = ?", e.ID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return validations.NewError(e, "Volume", errCountEvent)
+	}
+	return nil
+}
+
+// BeforeUpdate prevents changing the adjustment events of the approved counts
+func (e *Event) BeforeUpdate(tx *gorm.DB) error {
+	return checkCountEvent(tx, e)
+}
+
+// BeforeDelete prevents deleting the adjustment events of the approved counts
+func (e *Event) BeforeDelete(tx *gorm.DB) error {
+	return checkCountEvent(tx, e)
+}
+
+// ApproveCount approves the count : the variances are worked out again against the stock ledger, and posted as adjustment events of the count day, recording the counting user
+func ApproveCount(db *gorm.DB, countID uint, approver string, date time.Time) error {
+	tx := db.New().Begin()
+	if err := approveCount(tx, countID, approver, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// approveCount approves the count within a transaction
+func approveCount(tx *gorm.DB, countID uint, approver string, date time.Time) error {
+	var count InventoryCount
+	if err := tx.Preload("Lines").First(&count, countID).Error; err != nil {
+		return err
+	}
+	if count.ApprovedAt != nil {
+		return validations.NewError(&count, "Lines", errCountApproved)
+	}
+	if len(count.Lines) == 0 {
+		return validations.NewError(&count, "Lines", errCountEmpty)
+	}
+	for _, l := range count.Lines {
+		if err := l.compute(tx, count.Date); err != nil {
+			return err
+		}
+		columns := map[string]interface{}{"computed": l.Computed, "variance": l.Variance}
+		if l.Variance != 0 {
+			e := Event{BatchID: l.BatchID, ContainerID: l.ContainerID, Date: count.Date, Name: fmt.Sprintf("Inventory count %s", count.Stringify()), Volume: l.Variance, Kind: KindInventoryGain, User: count.User}
+			if l.Variance < 0 {
+				e.Kind = KindInventoryLoss
+			}
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+			columns["event_id"] = e.ID
+		}
+		// Update the columns only, the hooks preventing changes to the lines
+		if err := tx.Model(&l).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&count).UpdateColumns(map[string]interface{}{"approved_by": approver, "approved_at": date}).Error
+}
+
+// configureInventoryCounts adds the inventory counts admin, counted by anyone and approved by an admin, and shows the adjustments tags on the events
+func configureInventoryCounts(Admin *admin.Admin, batch *admin.Resource) {
+	count := Admin.AddResource(&InventoryCount{}, &admin.Config{Menu: []string{"Inventory"}, Permission: roles.Allow(roles.CRUD, roles.Anyone)})
+	count.IndexAttrs("Date", "User", "ApprovedBy", "ApprovedAt")
+	count.NewAttrs("Date", "Lines")
+	count.EditAttrs("Date", "Lines")
+	count.ShowAttrs("Date", "User", "Lines", "ApprovedBy", "ApprovedAt")
+	noop := func(interface{}, *resource.MetaValue, *qor.Context) {}
+	for _, name := range []string{"User", "ApprovedBy", "ApprovedAt"} {
+		count.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: noop})
+	}
+	lines := count.Meta(&admin.Meta{Name: "Lines"}).Resource
+	lines.NewAttrs("Batch", "Container", "Measured")
+	lines.EditAttrs("Batch", "Container", "Measured", "Computed", "Variance")
+	lines.ShowAttrs("Batch", "Container", "Measured", "Computed", "Variance")
+	lines.Meta(&admin.Meta{Name: "Measured", Label: "Measured (L)"})
+	for _, name := range []string{"Computed", "Variance"} {
+		lines.Meta(&admin.Meta{Name: name, Label: name + " (L)", Type: "readonly", Setter: noop})
+	}
+
+	save := count.SaveHandler
+	count.SaveHandler = func(result interface{}, context *qor.Context) error {
+		if c, ok := result.(*InventoryCount); ok && c.User == "" {
+			c.User = userName(context.CurrentUser)
+		}
+		return save(result, context)
+	}
+
+	count.Action(&admin.Action{
+		Name:       "Approve",
+		Permission: adminsOnly,
+		Modes:      []string{"show", "menu_item"},
+		Visible: func(record interface{}, context *admin.Context) bool {
+			c, ok := record.(*InventoryCount)
+			return !ok || c.ApprovedAt == nil
+		},
+		Handler: func(argument *admin.ActionArgument) error {
+			for _, record := range argument.FindSelectedRecords() {
+				c, ok := record.(*InventoryCount)
+				if !ok {
+					return errors.New("not an inventory count")
+				}
+				if err := ApproveCount(argument.Context.GetDB(), c.ID, userName(argument.Context.CurrentUser), time.Now()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	events := batch.Meta(&admin.Meta{Name: "Events"}).Resource
+	for _, name := range []string{"Kind", "User"} {
+		events.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: noop})
+	}
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInventoryCount(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 1, 31, 18, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	keg := Container{Name: "Keg", Volume: 50, State: StateSanitized}
+	DB.Create(&keg)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date.AddDate(0, -1, 0)}
+	DB.Create(&b)
+	DB.Create(&Transfer{BatchID: b.ID, Date: date.AddDate(0, 0, -1), FromID: fermenter, ToID: keg.ID, Volume: 40})
+
+	// The lines give the variance against the ledger as of the count day
+	count := InventoryCount{Date: date, User: "counter", Lines: []InventoryCountLine{
+		{BatchID: b.ID, Measured: 55},
+		{BatchID: b.ID, ContainerID: keg.ID, Measured: 42},
+	}}
+	if err := DB.Create(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if l := count.Lines[0]; l.ContainerID != fermenter || l.Computed != 60 || l.Variance != -5 {
+		t.Errorf("got line %+v, want 60 L computed in the fermenter and a variance of -5 L", l)
+	}
+	for _, l := range []InventoryCountLine{
+		{InventoryCountID: count.ID, BatchID: b.ID, ContainerID: keg.ID, Measured: 40},
+		{InventoryCountID: count.ID, BatchID: b.ID, ContainerID: keg.ID + 1, Measured: -1},
+	} {
+		if err := DB.Create(&l).Error; err == nil {
+			t.Errorf("got no error creating the line %+v", l)
+		}
+	}
+	if err := ApproveCount(DB, (&InventoryCount{Date: date}).ID, "admin", date); err == nil {
+		t.Error("got no error approving a missing count")
+	}
+
+	// A sale recorded since the counting is accounted for at the approval
+	DB.Create(&Sale{BatchID: b.ID, Date: date.Add(-time.Hour), FromID: keg.ID, Volume: 2})
+	if err := ApproveCount(DB, count.ID, "admin", date.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	DB.Where("batch_id = ?", b.ID).Order("id").Find(&events)
+	if len(events) != 2 || events[0].Kind != KindInventoryLoss || events[0].Volume != -5 || events[0].ContainerID != fermenter || events[0].User != "counter" ||
+		events[1].Kind != KindInventoryGain || events[1].Volume != 4 || events[1].ContainerID != keg.ID || !events[1].Date.Equal(date) {
+		t.Errorf("got events %+v, want a loss of 5 L in the fermenter and a gain of 4 L in the keg by the counter", events)
+	}
+	LoadBatches(DB, &b)
+	if b.Stock != "Fermenter: 55, Keg: 42" {
+		t.Errorf("got stock %v, want the measured volumes", b.Stock)
+	}
+	DB.Preload("Lines").First(&count, count.ID)
+	if count.ApprovedBy != "admin" || count.Lines[1].Computed != 38 || count.Lines[1].EventID != events[1].ID {
+		t.Errorf("got count %+v, want it approved with the lines linked to their events", count)
+	}
+
+	// An approved count can't be changed
+	if err := ApproveCount(DB, count.ID, "admin", date); err == nil {
+		t.Error("got no error approving a count twice")
+	}
+	count.Lines[0].Measured = 60
+	if err := DB.Save(&count.Lines[0]).Error; err == nil {
+		t.Error("got no error changing a line of an approved count")
+	}
+	if err := DB.Delete(&count).Error; err == nil {
+		t.Error("got no error deleting an approved count")
+	}
+
+	// Nor its adjustment events
+	events[1].Volume = 5
+	if err := DB.Save(&events[1]).Error; err == nil {
+		t.Error("got no error changing an adjustment event")
+	}
+	if err := DB.Delete(&events[1]).Error; err == nil {
+		t.Error("got no error deleting an adjustment event")
+	}
+	var e Event
+	if DB.First(&e, events[1].ID); e.Volume != count.Lines[1].Variance {
+		t.Errorf("got adjustment event %+v, want it unchanged", e)
+	}
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConvertQuantity(t *testing.T) {
+	tests := []struct {
+		name     string
+		quantity float64
+		from, to string
+		want     float64
+		wantOk   bool
+	}{
+		{"kg_to_g", 1.5, "kg", "g", 1500, true},
+		{"g_to_kg", 250, "g", "kg", 0.25, true},
+		{"same_unit", 2, "unit", "unit", 2, true},
+		{"mass_to_count", 2, "kg", "unit", 0, false},
+		{"unknown_unit", 2, "lb", "kg", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ConvertQuantity(tt.quantity, tt.from, tt.to)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("ConvertQuantity() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestInventory(t *testing.T) {
+	defer initTestDB(t)()
+
+	now := time.Now()
+	date := func(days int) *time.Time {
+		d := now.AddDate(0, 0, days)
+		return &d
+	}
+	malt := Ingredient{Name: "Pale Ale", Category: CategoryFermentable, Unit: "kg"}
+	hop := Ingredient{Name: "Cascade", Category: CategoryHop, Unit: "kg"}
+	yeast := Ingredient{Name: "US-05", Category: CategoryYeast, Unit: "unit"}
+	for _, i := range []*Ingredient{&malt, &hop, &yeast} {
+		if err := DB.Create(i).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DB.Create(&Ingredient{Name: "Malt", Category: CategoryFermentable, Unit: "lb"}).Error; err == nil {
+		t.Error("got no error creating an ingredient with an unknown unit")
+	}
+	delivery := Delivery{Supplier: Supplier{Name: "Malterie"}, Date: now.AddDate(0, 0, -10), Lots: []Lot{
+		{IngredientID: malt.ID, Number: "M-LATE", BestBefore: date(300), Quantity: 25},
+		{IngredientID: malt.ID, Number: "M-SOON", BestBefore: date(30), Quantity: 3},
+		{IngredientID: malt.ID, Number: "M-EXPIRED", BestBefore: date(-1), Quantity: 10},
+		{IngredientID: hop.ID, Number: "H-1", Quantity: 1},
+		{IngredientID: yeast.ID, Number: "Y-1", Quantity: 1},
+	}}
+	if err := DB.Create(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	lots := map[string]*Lot{}
+	for i := range delivery.Lots {
+		lots[delivery.Lots[i].Number] = &delivery.Lots[i]
+	}
+
+	recipe := Recipe{Name: "IPA", Fermentables: []Fermentable{{Name: "pale ale", Weight: 5}, {Name: "Crystal", Weight: 0.5}}, Hops: []Hop{{Name: "Cascade", Weight: 30}, {Name: "Cascade", Weight: 50}}, Yeasts: []Yeast{{Name: "US-05"}}}
+	DB.Create(&recipe)
+	stocks, err := RecipeInventory(DB, recipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stocks) != 4 || stocks[0].InStock != 38 || stocks[0].Needed != 5 || stocks[1].Tracked || stocks[2].Needed != 0.08 || stocks[2].Unit != "kg" || !stocks[3].Enough() {
+		t.Errorf("got recipe inventory %+v, want malt, untracked crystal, summed hops in kg and yeast", stocks)
+	}
+
+	// Starting the brew takes the lots first expired first out, leaving aside the expired ones
+	b := Batch{RecipeID: recipe.ID, StartVolume: 20}
+	DB.Create(&b)
+	if err := b.ChangeStep(DB, StepBrewing, "USER"); err != nil {
+		t.Fatal(err)
+	}
+	remaining := func(number string) float64 {
+		r, _ := lotRemaining(DB, lots[number].ID)
+		return r
+	}
+	if remaining("M-SOON") != 0 || remaining("M-LATE") != 23 || remaining("M-EXPIRED") != 10 || remaining("H-1") != 0.92 || remaining("Y-1") != 0 {
+		t.Errorf("got remaining %v, %v, %v, %v, %v, want 0, 23, 10, 0.92, 0", remaining("M-SOON"), remaining("M-LATE"), remaining("M-EXPIRED"), remaining("H-1"), remaining("Y-1"))
+	}
+
+	// Not enough yeast left : the brew can't start
+	other := Batch{RecipeID: recipe.ID, StartVolume: 20}
+	DB.Create(&other)
+	if err := other.ChangeStep(DB, StepBrewing, "USER"); err == nil {
+		t.Error("got no error starting a brew without enough yeast")
+	}
+	DB.First(&other, other.ID)
+	if other.Step != StepPlanned || remaining("M-LATE") != 23 {
+		t.Errorf("got step %v and %v left, want the brew still planned and nothing taken", other.Step, remaining("M-LATE"))
+	}
+
+	// Lots chosen by hand are kept, even expired
+	if err := DB.Create(&Consumption{BatchID: other.ID, LotID: lots["M-EXPIRED"].ID, Quantity: 5}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&Consumption{BatchID: other.ID, LotID: lots["Y-1"].ID, Quantity: 1}).Error; err == nil {
+		t.Error("got no error using more than left of a lot")
+	}
+
+	// Going back to planned gives the ingredients back, deleting a used lot is not allowed
+	if err := DB.Delete(lots["M-SOON"]).Error; err == nil {
+		t.Error("got no error deleting a used lot")
+	}
+	if err := b.ChangeStep(DB, StepPlanned, "ADMIN", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining("M-SOON") != 3 || remaining("Y-1") != 1 {
+		t.Errorf("got remaining %v and %v, want the lots back", remaining("M-SOON"), remaining("Y-1"))
+	}
+	if err := other.ChangeStep(DB, StepBrewing, "USER"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining("M-EXPIRED") != 5 || remaining("M-SOON") != 3 || remaining("Y-1") != 0 {
+		t.Errorf("got remaining %v, %v, %v, want only the chosen malt lot used", remaining("M-EXPIRED"), remaining("M-SOON"), remaining("Y-1"))
+	}
+
+	// A lot can't be reduced below what was used
+	lots["M-EXPIRED"].Quantity = 4
+	if err := DB.Save(lots["M-EXPIRED"]).Error; err == nil {
+		t.Error("got no error reducing a lot below what was used")
+	}
+}
@@ -0,0 +1,602 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/nicolaspernoud/malt_app/internal/pdf"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// DefaultVATRate is the VAT rate of the new orders, in %
+const DefaultVATRate = 20
+
+// Invoicing errors
+const (
+	errOrderInvoiced = "An invoiced order can't be changed"
+	errOrderEmpty    = "An order needs lines to be invoiced"
+	errLineQuantity  = "A line sells either units of a format, or a volume from a container"
+	errNoPrice       = "There is no price for this line in the customer price list"
+	errInvoiceIssued = "An invoice can't be changed once issued"
+	errSaleOfOrder   = "The sale of an order line is changed from its order"
+)
+
+// Customer buys beer, at the prices of its price list
+type Customer struct {
+	gorm.Model
+	Name        string
+	Address     string `gorm:"type:text"`
+	Email       string
+	VATNumber   string
+	PriceList   PriceList `gorm:"association_autoupdate:false;association_autocreate:false"`
+	PriceListID uint
+}
+
+// PriceList is a set of prices given to customers
+type PriceList struct {
+	gorm.Model
+	Name   string
+	Prices []Price
+}
+
+// Price is the price excluding VAT of a unit of a packaging format, or of a liter sold from a container if without format
+type Price struct {
+	gorm.Model
+	PriceListID uint            `gorm:"index"`
+	Format      PackagingFormat `gorm:"foreignkey:FormatID;association_autoupdate:false;association_autocreate:false"`
+	FormatID    uint
+	UnitPrice   float64
+}
+
+// Order is a customer order, its lines creating the sales of the batches
+type Order struct {
+	gorm.Model
+	Customer   Customer `gorm:"association_autoupdate:false;association_autocreate:false"`
+	CustomerID uint
+	Date       time.Time
+	Reference  string  // the customer reference
+	VATRate    float64 // %
+	Lines      []OrderLine
+	Total      float64 `gorm:"-"` // excluding VAT
+	Invoice    string  `gorm:"-"` // the invoice number, if invoiced
+}
+
+// OrderLine sells either units of a packaging format, or a volume of a batch from a container
+type OrderLine struct {
+	gorm.Model
+	OrderID   uint  `gorm:"index"`
+	Batch     Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID   uint
+	Format    PackagingFormat `gorm:"foreignkey:FormatID;association_autoupdate:false;association_autocreate:false"`
+	FormatID  uint
+	Units     int
+	From      Container `gorm:"foreignkey:FromID;association_autoupdate:false;association_autocreate:false"`
+	FromID    uint
+	Volume    int
+	UnitPrice float64 // excluding VAT, per unit or liter, taken from the customer price list if not given
+	Amount    float64 // excluding VAT
+	Kegs      []Keg   `gorm:"many2many:order_line_kegs;association_autoupdate:false;association_autocreate:false"` // the serials of the kegs sold, given to the sale
+	SaleID    uint
+}
+
+// Invoice is an order invoiced, numbered without gaps within its year
+type Invoice struct {
+	gorm.Model
+	Number       string `gorm:"unique_index"`
+	Year         int    `gorm:"unique_index:idx_invoices_year_sequence"`
+	Sequence     int    `gorm:"unique_index:idx_invoices_year_sequence"`
+	Date         time.Time
+	Order        Order `gorm:"association_autoupdate:false;association_autocreate:false"`
+	OrderID      uint  `gorm:"unique_index"`
+	Customer     string
+	Total        float64 // excluding VAT
+	VAT          float64
+	TotalWithVAT float64
+}
+
+// InvoiceSequence is the last invoice number given in a year
+type InvoiceSequence struct {
+	Year int `gorm:"primary_key;auto_increment:false"`
+	Last int
+}
+
+// InvoiceIssuer is the company issuing the invoices
+type InvoiceIssuer struct {
+	Name      string
+	Address   string
+	VATNumber string
+}
+
+// Issuer is printed on the invoices
+var Issuer = InvoiceIssuer{Name: "Malt App"}
+
+// IssuerFromEnv gives the invoice issuer set by the INVOICE_ISSUER_NAME, INVOICE_ISSUER_ADDRESS (lines separated by "|") and INVOICE_ISSUER_VAT_NUMBER environment variables, if set
+func IssuerFromEnv() (InvoiceIssuer, bool) {
+	i := InvoiceIssuer{Name: os.Getenv("INVOICE_ISSUER_NAME"), Address: strings.Replace(os.Getenv("INVOICE_ISSUER_ADDRESS"), "|", "\n", -1), VATNumber: os.Getenv("INVOICE_ISSUER_VAT_NUMBER")}
+	return i, i.Name != ""
+}
+
+// orderInvoiced tells if the order was invoiced
+func orderInvoiced(tx *gorm.DB, orderID uint) (bool, error) {
+	if orderID == 0 {
+		return false, nil
+	}
+	var count int
+	err := tx.New().Model(&Invoice{}).Where("order_id = ?", orderID).Count(&count).Error
+	return count > 0, err
+}
+
+// Stringify gives the order number and its customer reference
+func (o Order) Stringify() string {
+	return strings.TrimSpace(fmt.Sprintf("#%d %s", o.ID, o.Reference))
+}
+
+// BeforeSave prevents an invoiced order from being changed, and sets the VAT rate of the new orders
+func (o *Order) BeforeSave(tx *gorm.DB) error {
+	if invoiced, err := orderInvoiced(tx, o.ID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(o, "Lines", errOrderInvoiced)
+		}
+		return err
+	}
+	if o.ID == 0 && o.VATRate == 0 {
+		o.VATRate = DefaultVATRate
+	}
+	if o.Date.IsZero() {
+		o.Date = time.Now()
+	}
+	return nil
+}
+
+// BeforeDelete prevents an invoiced order from being deleted
+func (o *Order) BeforeDelete(tx *gorm.DB) error {
+	if invoiced, err := orderInvoiced(tx, o.ID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(o, "Lines", errOrderInvoiced)
+		}
+		return err
+	}
+	return nil
+}
+
+// AfterDelete deletes the order lines, and so their sales
+func (o *Order) AfterDelete(tx *gorm.DB) error {
+	if o.ID == 0 {
+		return nil
+	}
+	var lines []OrderLine
+	if err := tx.New().Where("order_id = ?", o.ID).Find(&lines).Error; err != nil {
+		return err
+	}
+	for i := range lines {
+		if err := tx.New().Delete(&lines[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BeforeSave checks the line and works out its amount, at the customer price if no price is given
+func (l *OrderLine) BeforeSave(tx *gorm.DB) error {
+	tx = tx.New()
+	if invoiced, err := orderInvoiced(tx, l.OrderID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(l, "Units", errOrderInvoiced)
+		}
+		return err
+	}
+	l.BatchID = keyOf(l.BatchID, l.Batch.ID)
+	l.FormatID = keyOf(l.FormatID, l.Format.ID)
+	l.FromID = keyOf(l.FromID, l.From.ID)
+	quantity := float64(l.Volume)
+	if l.FormatID != 0 {
+		quantity = float64(l.Units)
+		l.FromID, l.Volume = 0, 0
+	} else {
+		l.Units = 0
+	}
+	if quantity <= 0 || (l.FormatID == 0 && l.FromID == 0) {
+		return validations.NewError(l, "Units", errLineQuantity)
+	}
+	if l.UnitPrice == 0 {
+		var price Price
+		err := tx.Joins("JOIN customers ON customers.price_list_id = prices.price_list_id").Joins("JOIN orders ON orders.customer_id = customers.id").
+			Where("orders.id = ? AND prices.format_id = ?", l.OrderID, l.FormatID).First(&price).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return validations.NewError(l, "UnitPrice", errNoPrice)
+		}
+		if err != nil {
+			return err
+		}
+		l.UnitPrice = price.UnitPrice
+	}
+	l.Amount = brewcalc.Round(quantity*l.UnitPrice, 2)
+	return nil
+}
+
+// AfterSave creates or updates the sale of the line, which checks the stocks
+func (l *OrderLine) AfterSave(tx *gorm.DB) error {
+	tx = tx.New()
+	var order Order
+	if err := tx.First(&order, l.OrderID).Error; err != nil {
+		return err
+	}
+	var sale Sale
+	if l.SaleID != 0 {
+		if err := tx.First(&sale, l.SaleID).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+	}
+	sale.BatchID, sale.Date, sale.FromID, sale.Volume, sale.FormatID, sale.Units, sale.CustomerID = l.BatchID, order.Date, l.FromID, l.Volume, l.FormatID, l.Units, order.CustomerID
+	// The sale takes the kegs of the line, the ones taken off the line going back to the brewery
+	if err := tx.Model(l).Related(&sale.Kegs, "Kegs").Error; err != nil {
+		return err
+	}
+	if sale.ID != 0 {
+		if err := tx.Model(&sale).Association("Kegs").Replace(sale.Kegs).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Save(&sale).Error; err != nil {
+		return err
+	}
+	if sale.ID != l.SaleID {
+		l.SaleID = sale.ID
+		return tx.Model(l).UpdateColumn("sale_id", sale.ID).Error
+	}
+	return nil
+}
+
+// BeforeDelete prevents the lines of an invoiced order from being deleted
+func (l *OrderLine) BeforeDelete(tx *gorm.DB) error {
+	if invoiced, err := orderInvoiced(tx, l.OrderID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(l, "Units", errOrderInvoiced)
+		}
+		return err
+	}
+	return nil
+}
+
+// AfterDelete deletes the sale of the line
+func (l *OrderLine) AfterDelete(tx *gorm.DB) error {
+	if l.SaleID == 0 {
+		return nil
+	}
+	return tx.New().Delete(&Sale{Model: gorm.Model{ID: l.SaleID}}).Error
+}
+
+// checkOrderSale prevents the sale of an order line from being changed or deleted otherwise than from its line, and once the order is invoiced.
+// The line saves its sale as the line and its order give it, and deletes it once deleted itself.
+func checkOrderSale(tx *gorm.DB, s *Sale, deleting bool) error {
+	if s.ID == 0 {
+		return nil
+	}
+	var line OrderLine
+	if err := tx.Where("sale_id = ?", s.ID).First(&line).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	var order Order
+	if err := tx.First(&order, line.OrderID).Error; err != nil {
+		return err
+	}
+	fromID := keyOf(s.FromID, s.From.ID)
+	if !deleting && s.BatchID == line.BatchID && fromID == line.FromID && s.Volume == line.Volume && s.FormatID == line.FormatID && s.Units == line.Units &&
+		s.Date.Equal(order.Date) && s.CustomerID == order.CustomerID {
+		return nil
+	}
+	if invoiced, err := orderInvoiced(tx, order.ID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(s, "Volume", errOrderInvoiced)
+		}
+		return err
+	}
+	return validations.NewError(s, "Volume", errSaleOfOrder)
+}
+
+// BeforeUpdate prevents an invoice from being changed
+func (i *Invoice) BeforeUpdate() error {
+	return validations.NewError(i, "Number", errInvoiceIssued)
+}
+
+// BeforeDelete prevents an invoice from being deleted, which would leave a gap in the numbering
+func (i *Invoice) BeforeDelete() error {
+	return validations.NewError(i, "Number", errInvoiceIssued)
+}
+
+// invoiceMutex serializes the invoice numbering within the application, the database write lock serializing it between processes
+var invoiceMutex sync.Mutex
+
+// nextInvoiceSequence takes the next invoice number of the year, within the transaction creating the invoice so that a failure leaves no gap
+func nextInvoiceSequence(tx *gorm.DB, year int) (int, error) {
+	// Creating the sequence of the year if needed then updating it takes the write lock before reading the number, even across processes
+	if err := tx.Exec("INSERT OR IGNORE INTO invoice_sequences (year, last) VALUES (?, 0)", year).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&InvoiceSequence{}).Where("year = ?", year).UpdateColumn("last", gorm.Expr("last + 1")).Error; err != nil {
+		return 0, err
+	}
+	var seq InvoiceSequence
+	err := tx.Where("year = ?", year).First(&seq).Error
+	return seq.Last, err
+}
+
+// IssueInvoice invoices the order at the given date, with the next number of the year
+func IssueInvoice(db *gorm.DB, orderID uint, date time.Time) (Invoice, error) {
+	invoiceMutex.Lock()
+	defer invoiceMutex.Unlock()
+	tx := db.New().Begin()
+	inv, err := issueInvoice(tx, orderID, date)
+	if err != nil {
+		tx.Rollback()
+		return inv, err
+	}
+	return inv, tx.Commit().Error
+}
+
+// issueInvoice creates the invoice of the order within a transaction
+func issueInvoice(tx *gorm.DB, orderID uint, date time.Time) (Invoice, error) {
+	var order Order
+	if err := tx.Preload("Lines").Preload("Customer").First(&order, orderID).Error; err != nil {
+		return Invoice{}, err
+	}
+	if invoiced, err := orderInvoiced(tx, order.ID); err != nil || invoiced {
+		if err == nil {
+			err = validations.NewError(&order, "Lines", errOrderInvoiced)
+		}
+		return Invoice{}, err
+	}
+	if len(order.Lines) == 0 {
+		return Invoice{}, validations.NewError(&order, "Lines", errOrderEmpty)
+	}
+	seq, err := nextInvoiceSequence(tx, date.Year())
+	if err != nil {
+		return Invoice{}, err
+	}
+	inv := Invoice{Number: fmt.Sprintf("%d-%04d", date.Year(), seq), Year: date.Year(), Sequence: seq, Date: date, OrderID: order.ID, Customer: strings.TrimSpace(order.Customer.Name + "\n" + order.Customer.Address)}
+	for _, l := range order.Lines {
+		inv.Total += l.Amount
+	}
+	inv.Total = brewcalc.Round(inv.Total, 2)
+	inv.VAT = brewcalc.Round(inv.Total*order.VATRate/100, 2)
+	inv.TotalWithVAT = brewcalc.Round(inv.Total+inv.VAT, 2)
+	return inv, tx.Create(&inv).Error
+}
+
+// LoadOrders works out the totals and invoice numbers of the given orders, with a query for each
+func LoadOrders(db *gorm.DB, orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	var totals []struct {
+		OrderID uint
+		Total   float64
+	}
+	if err := db.Table("order_lines").Select("order_id, SUM(amount) AS total").Where("deleted_at IS NULL AND order_id IN (?)", ids).Group("order_id").Scan(&totals).Error; err != nil {
+		return err
+	}
+	var invoices []Invoice
+	if err := db.Where("order_id IN (?)", ids).Find(&invoices).Error; err != nil {
+		return err
+	}
+	for _, o := range orders {
+		o.Total, o.Invoice = 0, ""
+		for _, t := range totals {
+			if t.OrderID == o.ID {
+				o.Total = brewcalc.Round(t.Total, 2)
+			}
+		}
+		for _, i := range invoices {
+			if i.OrderID == o.ID {
+				o.Invoice = i.Number
+			}
+		}
+	}
+	return nil
+}
+
+// formatAmount formats an amount in euros, as "1 234,50 €"
+func formatAmount(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	units, cents := s[:len(s)-3], s[len(s)-2:]
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "\u202f" + units[i:]
+	}
+	return sign + units + "," + cents + " €"
+}
+
+// WriteInvoicePDF writes the invoice as a PDF document
+func WriteInvoicePDF(w io.Writer, db *gorm.DB, inv Invoice) error {
+	var order Order
+	if err := db.Preload("Customer").Preload("Lines").Preload("Lines.Batch").Preload("Lines.Format").Preload("Lines.From").First(&order, inv.OrderID).Error; err != nil {
+		return err
+	}
+	doc := pdf.New()
+	page := doc.AddPage()
+	const left, right = 50.0, pdf.PageWidth - 50
+	lines := func(x, y float64, text string) float64 {
+		for _, l := range strings.Split(text, "\n") {
+			page.Text(x, y, 10, false, l)
+			y += 13
+		}
+		return y
+	}
+
+	// Header : the issuer, the invoice number and the customer
+	page.Text(left, 60, 14, true, Issuer.Name)
+	y := lines(left, 78, Issuer.Address)
+	if Issuer.VATNumber != "" {
+		lines(left, y, "VAT number: "+Issuer.VATNumber)
+	}
+	page.TextRight(right, 60, 18, true, "Invoice "+inv.Number)
+	page.TextRight(right, 78, 10, false, "Date: "+inv.Date.Format("02/01/2006"))
+	page.TextRight(right, 91, 10, false, "Order: #"+strconv.Itoa(int(order.ID))+" "+order.Reference)
+	page.Text(320, 140, 10, true, "Customer")
+	y = lines(320, 155, inv.Customer)
+	if order.Customer.VATNumber != "" {
+		lines(320, y, "VAT number: "+order.Customer.VATNumber)
+	}
+
+	// Lines
+	header := func(y float64) {
+		page.Text(left, y, 10, true, "Description")
+		page.TextRight(380, y, 10, true, "Quantity")
+		page.TextRight(470, y, 10, true, "Unit price")
+		page.TextRight(right, y, 10, true, "Amount")
+		page.Line(left, y+5, right, y+5)
+	}
+	y = 250
+	header(y)
+	for _, l := range order.Lines {
+		y += 18
+		if y > pdf.PageHeight-150 {
+			page = doc.AddPage()
+			y = 60
+			header(y)
+			y += 18
+		}
+		description, quantity := l.Batch.Stringify()+" - "+l.Format.Name, strconv.Itoa(l.Units)
+		if l.FormatID == 0 {
+			description, quantity = l.Batch.Stringify()+" - "+l.From.Name, strconv.Itoa(l.Volume)+" L"
+		}
+		page.Text(left, y, 10, false, description)
+		page.TextRight(380, y, 10, false, quantity)
+		page.TextRight(470, y, 10, false, formatAmount(l.UnitPrice))
+		page.TextRight(right, y, 10, false, formatAmount(l.Amount))
+	}
+
+	// Totals
+	y += 10
+	page.Line(320, y, right, y)
+	for _, t := range []struct {
+		label  string
+		amount float64
+		bold   bool
+	}{
+		{"Total excluding VAT", inv.Total, false},
+		{fmt.Sprintf("VAT %s %%", strconv.FormatFloat(order.VATRate, 'f', -1, 64)), inv.VAT, false},
+		{"Total including VAT", inv.TotalWithVAT, true},
+	} {
+		y += 16
+		page.Text(320, y, 10, t.bold, t.label)
+		page.TextRight(right, y, 10, t.bold, formatAmount(t.amount))
+	}
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// configureInvoicing adds the customers, price lists, orders and invoices admins, an action issuing the invoice of an order, and the invoices download as PDF
+func configureInvoicing(Admin *admin.Admin) {
+	menu := []string{"Sales"}
+	Admin.AddResource(&Customer{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.CRUD, roles.Anyone)})
+	priceList := Admin.AddResource(&PriceList{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	priceList.Meta(&admin.Meta{Name: "Prices"}).Resource.Meta(&admin.Meta{Name: "UnitPrice", Label: "Unit price (per unit, or per liter without format)"})
+
+	order := Admin.AddResource(&Order{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.CRUD, roles.Anyone)})
+	order.IndexAttrs("Date", "Customer", "Reference", "Total", "Invoice")
+	order.NewAttrs("Date", "Customer", "Reference", "VATRate", "Lines")
+	order.EditAttrs("Date", "Customer", "Reference", "VATRate", "Lines")
+	order.ShowAttrs("Date", "Customer", "Reference", "VATRate", "Lines", "Total", "Invoice")
+	noop := func(interface{}, *resource.MetaValue, *qor.Context) {}
+	for _, name := range []string{"Total", "Invoice"} {
+		order.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: noop})
+	}
+	lines := order.Meta(&admin.Meta{Name: "Lines"}).Resource
+	lines.EditAttrs("Batch", "Format", "Units", "Kegs", "From", "Volume", "UnitPrice", "Amount")
+	lines.NewAttrs("Batch", "Format", "Units", "Kegs", "From", "Volume", "UnitPrice")
+	lines.Meta(&admin.Meta{Name: "Amount", Type: "readonly", Setter: noop})
+	lines.Meta(&admin.Meta{Name: "Kegs", Label: "Kegs (serials)", Type: "select_many"})
+
+	findMany := order.FindManyHandler
+	order.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findMany(result, context); err != nil {
+			return err
+		}
+		if orders, ok := result.(*[]*Order); ok {
+			return LoadOrders(context.GetDB().New(), *orders...)
+		}
+		return nil
+	}
+	findOne := order.FindOneHandler
+	order.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOne(result, metaValues, context); err != nil {
+			return err
+		}
+		if o, ok := result.(*Order); ok {
+			return LoadOrders(context.GetDB().New(), o)
+		}
+		return nil
+	}
+
+	order.Action(&admin.Action{
+		Name:       "Issue invoice",
+		Permission: anyone,
+		Modes:      []string{"show", "menu_item"},
+		Visible: func(record interface{}, context *admin.Context) bool {
+			o, ok := record.(*Order)
+			return !ok || o.Invoice == ""
+		},
+		Handler: func(argument *admin.ActionArgument) error {
+			for _, record := range argument.FindSelectedRecords() {
+				o, ok := record.(*Order)
+				if !ok {
+					return errors.New("not an order")
+				}
+				if _, err := IssueInvoice(argument.Context.GetDB(), o.ID, time.Now()); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	invoice := Admin.AddResource(&Invoice{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.Read, roles.Anyone)})
+	invoice.IndexAttrs("Number", "Date", "Order", "Customer", "Total", "TotalWithVAT")
+	invoice.RegisterRoute("GET", invoice.ParamIDName()+"/pdf", func(context *admin.Context) {
+		var inv Invoice
+		if err := context.GetDB().New().First(&inv, context.ResourceID).Error; err != nil {
+			http.NotFound(context.Writer, context.Request)
+			return
+		}
+		var doc bytes.Buffer
+		if err := WriteInvoicePDF(&doc, context.GetDB().New(), inv); err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		context.Writer.Header().Set("Content-Type", "application/pdf")
+		context.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=invoice_%s.pdf", inv.Number))
+		doc.WriteTo(context.Writer)
+	}, &admin.RouteConfig{PermissionMode: roles.Read})
+	invoice.Action(&admin.Action{
+		Name:  "Download PDF",
+		Modes: []string{"show", "menu_item"},
+		URL: func(record interface{}, context *admin.Context) string {
+			return context.URLFor(record) + "/pdf"
+		},
+	})
+}
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		name string
+		v    float64
+		want string
+	}{
+		{"cents", 0.5, "0,50 €"},
+		{"thousands", 1234.5, "1\u202f234,50 €"},
+		{"millions", -1234567, "-1\u202f234\u202f567,00 €"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAmount(tt.v); got != tt.want {
+				t.Errorf("formatAmount() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvoicing(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	fermenter, _ := fermenterID(DB)
+	bottle, keg := PackagingFormat{Name: "Bottle 33cl", Volume: 0.33}, PackagingFormat{Name: "Keg 20L", Volume: 20}
+	DB.Create(&bottle)
+	DB.Create(&keg)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 60, Date: date}
+	DB.Create(&b)
+	DB.Create(&PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Volume: 10, Units: 24})
+	prices := PriceList{Name: "Bars", Prices: []Price{{FormatID: bottle.ID, UnitPrice: 2.5}, {UnitPrice: 4}}}
+	DB.Create(&prices)
+	customer := Customer{Name: "Le Bar", Address: "1 rue de la Soif\n69000 Lyon", PriceListID: prices.ID}
+	DB.Create(&customer)
+
+	// The lines create the sales, at the price list prices unless given
+	order := Order{CustomerID: customer.ID, Date: date, Reference: "PO-1", Lines: []OrderLine{
+		{BatchID: b.ID, FormatID: bottle.ID, Units: 12},
+		{BatchID: b.ID, FromID: fermenter, Volume: 5, UnitPrice: 3},
+	}}
+	if err := DB.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.VATRate != DefaultVATRate || order.Lines[0].Amount != 30 || order.Lines[1].Amount != 15 {
+		t.Errorf("got VAT rate %v and amounts %v and %v, want %v, 30 and 15", order.VATRate, order.Lines[0].Amount, order.Lines[1].Amount, DefaultVATRate)
+	}
+	var sales []Sale
+	DB.Where("batch_id = ?", b.ID).Order("id").Find(&sales)
+	if len(sales) != 2 || sales[0].Units != 12 || sales[0].Liters != 3.96 || sales[1].Volume != 5 || sales[1].FromID != fermenter || !sales[1].Date.Equal(date) {
+		t.Errorf("got sales %+v, want the sales of the lines", sales)
+	}
+	for _, l := range []OrderLine{
+		{OrderID: order.ID, BatchID: b.ID, FormatID: bottle.ID, Units: 13},
+		{OrderID: order.ID, BatchID: b.ID, FormatID: keg.ID, Units: 1},
+		{OrderID: order.ID, BatchID: b.ID, Volume: 5},
+	} {
+		if err := DB.Create(&l).Error; err == nil {
+			t.Errorf("got no error creating the line %+v", l)
+		}
+	}
+
+	// Editing a line updates its sale
+	order.Lines[1].Volume = 10
+	if err := DB.Save(&order.Lines[1]).Error; err != nil {
+		t.Fatal(err)
+	}
+	LoadBatches(DB, &b)
+	if order.Lines[1].Amount != 30 || b.Stock != "Fermenter: 40" || b.Packaged != "Bottle 33cl: 12" {
+		t.Errorf("got amount %v, stock %v and packaged %v, want 30, 40 L and 12 bottles left", order.Lines[1].Amount, b.Stock, b.Packaged)
+	}
+
+	// The sales of the lines are changed from their order only
+	sale := Sale{Model: sales[1].Model}
+	DB.First(&sale)
+	sale.Volume = 8
+	if err := DB.Save(&sale).Error; err == nil {
+		t.Error("got no error changing the sale of an order line")
+	}
+	if err := DB.Delete(&sale).Error; err == nil {
+		t.Error("got no error deleting the sale of an order line")
+	}
+
+	// Invoicing
+	inv, err := IssueInvoice(DB, order.ID, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Number != "2026-0001" || inv.Total != 60 || inv.VAT != 12 || inv.TotalWithVAT != 72 || inv.Customer != "Le Bar\n1 rue de la Soif\n69000 Lyon" {
+		t.Errorf("got invoice %+v, want 2026-0001 of 60 € excluding VAT", inv)
+	}
+	if _, err := IssueInvoice(DB, order.ID, date); err == nil {
+		t.Error("got no error invoicing an order twice")
+	}
+	order.Reference = "PO-2"
+	if err := DB.Save(&order).Error; err == nil {
+		t.Error("got no error changing an invoiced order")
+	}
+	if err := DB.Delete(&order.Lines[0]).Error; err == nil {
+		t.Error("got no error deleting a line of an invoiced order")
+	}
+	if err := DB.Delete(&inv).Error; err == nil {
+		t.Error("got no error deleting an invoice")
+	}
+	DB.First(&sale, sales[0].ID)
+	sale.Units = 6
+	if err := DB.Save(&sale).Error; err == nil {
+		t.Error("got no error changing the sale of an invoiced order")
+	}
+	DB.First(&sale, sales[1].ID)
+	if err := DB.Save(&sale).Error; err != nil {
+		t.Errorf("got error %v saving an unchanged sale of an invoiced order, as with its batch", err)
+	}
+	LoadOrders(DB, &order)
+	if order.Total != 60 || order.Invoice != "2026-0001" {
+		t.Errorf("got order total %v and invoice %v, want 60 and 2026-0001", order.Total, order.Invoice)
+	}
+
+	// An order failing to be invoiced leaves no gap in the numbering, which restarts every year
+	empty := Order{CustomerID: customer.ID, Date: date}
+	DB.Create(&empty)
+	if _, err := IssueInvoice(DB, empty.ID, date); err == nil {
+		t.Error("got no error invoicing an empty order")
+	}
+	next := func(year int) string {
+		o := Order{CustomerID: customer.ID, Date: date, Lines: []OrderLine{{BatchID: b.ID, FromID: fermenter, Volume: 1}}}
+		if err := DB.Create(&o).Error; err != nil {
+			t.Fatal(err)
+		}
+		inv, err := IssueInvoice(DB, o.ID, time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv.Number
+	}
+	if n := next(2026); n != "2026-0002" {
+		t.Errorf("got invoice %v, want 2026-0002", n)
+	}
+	if n := next(2027); n != "2027-0001" {
+		t.Errorf("got invoice %v, want 2027-0001", n)
+	}
+
+	// Concurrent invoicing
+	var orders []Order
+	for i := 0; i < 10; i++ {
+		o := Order{CustomerID: customer.ID, Date: date, Lines: []OrderLine{{BatchID: b.ID, FromID: fermenter, Volume: 1}}}
+		DB.Create(&o)
+		orders = append(orders, o)
+	}
+	var wg sync.WaitGroup
+	numbers := make([]string, len(orders))
+	for i := range orders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inv, err := IssueInvoice(DB, orders[i].ID, date)
+			if err != nil {
+				t.Error(err)
+			}
+			numbers[i] = inv.Number
+		}(i)
+	}
+	wg.Wait()
+	sort.Strings(numbers)
+	if numbers[0] != "2026-0003" || numbers[9] != "2026-0012" {
+		t.Errorf("got invoices %v, want 2026-0003 to 2026-0012", numbers)
+	}
+
+	// PDF
+	var doc bytes.Buffer
+	if err := WriteInvoicePDF(&doc, DB, inv); err != nil {
+		t.Fatal(err)
+	}
+	if out := doc.String(); !strings.HasPrefix(out, "%PDF") || !strings.Contains(out, "(Invoice 2026-0001)") || !strings.Contains(out, "(72,00 \x80)") || !strings.Contains(out, "(#1 IPA - Bottle 33cl)") {
+		t.Errorf("got PDF %q, want the invoice number, lines and totals", out)
+	}
+}
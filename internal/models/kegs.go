@@ -0,0 +1,390 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Keg locations
+const (
+	KegAtBrewery  = "Brewery"
+	KegAtCustomer = "Customer"
+	KegLost       = "Lost"
+)
+
+// KegOverdueDays is the number of days after which a keg at a customer is overdue
+var KegOverdueDays = 90
+
+// Keg errors
+const (
+	errKegNotKegged     = "Keg serials can only be assigned to sales of kegs"
+	errKegSerials       = "A sale of kegs needs the serials of its kegs"
+	errKegCount         = "The number of kegs must match the units sold"
+	errKegType          = "This keg doesn't hold the volume of the format sold"
+	errKegNoCustomer    = "A sale of kegs needs a customer, who is charged the deposit"
+	errKegNotAtBrewery  = "This keg is not at the brewery"
+	errKegNotAtCustomer = "This keg is not at a customer"
+)
+
+// Keg is a returnable keg, of a container type, tracked from the brewery to the customers and back
+type Keg struct {
+	gorm.Model
+	Serial      string    `gorm:"unique_index"`
+	Container   Container `gorm:"association_autoupdate:false;association_autocreate:false"` // the keg type
+	ContainerID uint
+	Deposit     float64 // charged to the customer for each delivery, refunded on return
+	Location    string
+	Customer    Customer `gorm:"association_autoupdate:false;association_autocreate:false"`
+	CustomerID  uint
+	SaleID      uint      // the sale that took the keg to the customer
+	Since       time.Time // the date of the last location change
+	Fills       []KegFill
+}
+
+// Stringify gives the keg serial
+func (k Keg) Stringify() string {
+	return k.Serial
+}
+
+// KegFill is a batch filled into a keg, and the sale that delivered it if any
+type KegFill struct {
+	gorm.Model
+	KegID   uint
+	Batch   Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID uint
+	Date    time.Time
+	SaleID  uint
+}
+
+// KegDeposit is a deposit charged to a customer for a keg, or refunded if negative
+type KegDeposit struct {
+	gorm.Model
+	Date       time.Time
+	Customer   Customer `gorm:"association_autoupdate:false;association_autocreate:false"`
+	CustomerID uint
+	Keg        Keg `gorm:"association_autoupdate:false;association_autocreate:false"`
+	KegID      uint
+	SaleID     uint
+	Amount     float64
+}
+
+// BeforeSave puts a new keg at the brewery
+func (k *Keg) BeforeSave() error {
+	k.ContainerID = keyOf(k.ContainerID, k.Container.ID)
+	if k.Location == "" {
+		k.Location = KegAtBrewery
+	}
+	if k.Since.IsZero() {
+		k.Since = time.Now()
+	}
+	return nil
+}
+
+// AfterDelete deletes the fills of the keg
+func (k *Keg) AfterDelete(tx *gorm.DB) error {
+	return tx.New().Where("keg_id = ?", k.ID).Delete(KegFill{}).Error
+}
+
+// BeforeSave sets the batch key from the batch set by the admin
+func (f *KegFill) BeforeSave() error {
+	f.BatchID = keyOf(f.BatchID, f.Batch.ID)
+	return nil
+}
+
+// validateKegs checks that a sale of kegs has the serials of as many kegs as sold, of the volume sold, and at the brewery unless already delivered by the sale
+func validateKegs(tx *gorm.DB, s *Sale) error {
+	var format PackagingFormat
+	if s.FormatID != 0 {
+		if err := tx.First(&format, s.FormatID).Error; err != nil {
+			return err
+		}
+	}
+	kegs := s.Kegs
+	// A sale saved without its kegs loaded keeps the ones assigned
+	if len(kegs) == 0 && s.ID != 0 {
+		if err := tx.Model(s).Related(&kegs, "Kegs").Error; err != nil {
+			return err
+		}
+	}
+	if format.Kind != KindKeg {
+		if len(kegs) > 0 {
+			return validations.NewError(s, "Kegs", errKegNotKegged)
+		}
+		return nil
+	}
+	if len(kegs) == 0 {
+		return validations.NewError(s, "Kegs", errKegSerials)
+	}
+	if len(kegs) != s.Units {
+		return validations.NewError(s, "Kegs", errKegCount)
+	}
+	if s.CustomerID == 0 {
+		return validations.NewError(s, "Customer", errKegNoCustomer)
+	}
+	for _, k := range kegs {
+		var keg Keg
+		if err := tx.Preload("Container").First(&keg, k.ID).Error; err != nil {
+			return err
+		}
+		if float64(keg.Container.Volume) != format.Volume {
+			return validations.NewError(s, "Kegs", errKegType+" : "+keg.Serial)
+		}
+		if keg.Location != KegAtBrewery && (s.ID == 0 || keg.SaleID != s.ID) {
+			return validations.NewError(s, "Kegs", errKegNotAtBrewery+" : "+keg.Serial)
+		}
+	}
+	return nil
+}
+
+// deliverKegs takes the kegs assigned to the sale to its customer, charging their deposit and recording their fill, and brings back to the brewery the kegs no longer assigned
+func deliverKegs(tx *gorm.DB, s *Sale) error {
+	var assigned []uint
+	if err := tx.Table("sale_kegs").Where("sale_id = ?", s.ID).Pluck("keg_id", &assigned).Error; err != nil {
+		return err
+	}
+	var delivered []Keg
+	if err := tx.Where("sale_id = ?", s.ID).Find(&delivered).Error; err != nil {
+		return err
+	}
+	for _, k := range delivered {
+		if !containsID(assigned, k.ID) {
+			if err := undeliverKeg(tx, k, s.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range assigned {
+		var k Keg
+		if err := tx.First(&k, id).Error; err != nil {
+			return err
+		}
+		if k.SaleID == s.ID {
+			continue
+		}
+		columns := map[string]interface{}{"location": KegAtCustomer, "customer_id": s.CustomerID, "sale_id": s.ID, "since": s.Date}
+		if err := tx.Model(&k).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+		if k.Deposit != 0 {
+			if err := tx.Create(&KegDeposit{Date: s.Date, CustomerID: s.CustomerID, KegID: k.ID, SaleID: s.ID, Amount: k.Deposit}).Error; err != nil {
+				return err
+			}
+		}
+		// The sale delivers the last fill of its batch, or a fill is recorded
+		var fill KegFill
+		err := tx.Where("keg_id = ? AND batch_id = ? AND sale_id = 0", k.ID, s.BatchID).Order("date DESC, id DESC").First(&fill).Error
+		if gorm.IsRecordNotFoundError(err) {
+			err = tx.Create(&KegFill{KegID: k.ID, BatchID: s.BatchID, Date: s.Date, SaleID: s.ID}).Error
+		} else if err == nil {
+			err = tx.Model(&fill).UpdateColumn("sale_id", s.ID).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// undeliverKeg brings back to the brewery a keg wrongly delivered by the sale, cancelling its deposit
+func undeliverKeg(tx *gorm.DB, k Keg, saleID uint) error {
+	if err := tx.Where("keg_id = ? AND sale_id = ?", k.ID, saleID).Delete(KegDeposit{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&KegFill{}).Where("keg_id = ? AND sale_id = ?", k.ID, saleID).UpdateColumn("sale_id", 0).Error; err != nil {
+		return err
+	}
+	return tx.Model(&k).UpdateColumns(map[string]interface{}{"location": KegAtBrewery, "customer_id": 0, "sale_id": 0}).Error
+}
+
+// releaseKegs brings back to the brewery the kegs of a deleted sale
+func releaseKegs(tx *gorm.DB, saleID uint) error {
+	var delivered []Keg
+	if err := tx.Where("sale_id = ?", saleID).Find(&delivered).Error; err != nil {
+		return err
+	}
+	for _, k := range delivered {
+		if err := undeliverKeg(tx, k, saleID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReturnKeg brings a keg back to the brewery from its customer, refunding the deposit charged for its delivery
+func ReturnKeg(db *gorm.DB, kegID uint, date time.Time) error {
+	tx := db.New().Begin()
+	if err := returnKeg(tx, kegID, date); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// returnKeg brings a keg back within a transaction
+func returnKeg(tx *gorm.DB, kegID uint, date time.Time) error {
+	var k Keg
+	if err := tx.First(&k, kegID).Error; err != nil {
+		return err
+	}
+	if k.Location == KegAtBrewery {
+		return validations.NewError(&k, "Location", errKegNotAtCustomer)
+	}
+	var deposit struct{ Amount float64 }
+	if err := tx.Table("keg_deposits").Select("COALESCE(SUM(amount), 0) AS amount").Where("deleted_at IS NULL AND keg_id = ? AND sale_id = ?", k.ID, k.SaleID).Scan(&deposit).Error; err != nil {
+		return err
+	}
+	if deposit.Amount > 0 {
+		if err := tx.Create(&KegDeposit{Date: date, CustomerID: k.CustomerID, KegID: k.ID, SaleID: k.SaleID, Amount: -deposit.Amount}).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&k).UpdateColumns(map[string]interface{}{"location": KegAtBrewery, "customer_id": 0, "sale_id": 0, "since": date}).Error
+}
+
+// LoseKeg declares lost a keg at a customer, the deposit charged being kept
+func LoseKeg(db *gorm.DB, kegID uint, date time.Time) error {
+	var k Keg
+	if err := db.First(&k, kegID).Error; err != nil {
+		return err
+	}
+	if k.Location != KegAtCustomer {
+		return validations.NewError(&k, "Location", errKegNotAtCustomer)
+	}
+	return db.Model(&k).UpdateColumns(map[string]interface{}{"location": KegLost, "since": date}).Error
+}
+
+// OverdueKeg is a keg at a customer for longer than the overdue days
+type OverdueKeg struct {
+	Keg  Keg
+	Days int
+}
+
+// CustomerDeposits sums the keg deposits of a customer
+type CustomerDeposits struct {
+	Customer Customer
+	Kegs     int // at the customer
+	Charged  float64
+	Refunded float64
+	Held     float64
+}
+
+// KegReport lists the overdue kegs, and the deposits held per customer
+type KegReport struct {
+	Date     time.Time
+	Days     int
+	Overdue  []OverdueKeg
+	Deposits []CustomerDeposits
+}
+
+// KegsReport works out the kegs at the customers for more than the days at the date, and the deposits of the customers
+func KegsReport(db *gorm.DB, date time.Time, days int) (KegReport, error) {
+	r := KegReport{Date: date, Days: days}
+	var kegs []Keg
+	if err := db.Preload("Container").Preload("Customer").Where("location = ? AND since < ?", KegAtCustomer, date.AddDate(0, 0, -days)).Order("since, serial").Find(&kegs).Error; err != nil {
+		return r, err
+	}
+	for _, k := range kegs {
+		r.Overdue = append(r.Overdue, OverdueKeg{Keg: k, Days: int(date.Sub(k.Since).Hours() / 24)})
+	}
+	var rows []struct {
+		CustomerID uint
+		Charged    float64
+		Refunded   float64
+	}
+	if err := db.Table("keg_deposits").Select("customer_id, SUM(CASE WHEN amount > 0 THEN amount ELSE 0 END) AS charged, -SUM(CASE WHEN amount < 0 THEN amount ELSE 0 END) AS refunded").
+		Where("deleted_at IS NULL").Group("customer_id").Scan(&rows).Error; err != nil {
+		return r, err
+	}
+	for _, row := range rows {
+		d := CustomerDeposits{Charged: brewcalc.Round(row.Charged, 2), Refunded: brewcalc.Round(row.Refunded, 2), Held: brewcalc.Round(row.Charged-row.Refunded, 2)}
+		if err := db.Unscoped().First(&d.Customer, row.CustomerID).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return r, err
+		}
+		if err := db.Model(&Keg{}).Where("customer_id = ? AND location = ?", row.CustomerID, KegAtCustomer).Count(&d.Kegs).Error; err != nil {
+			return r, err
+		}
+		r.Deposits = append(r.Deposits, d)
+	}
+	return r, nil
+}
+
+// configureKegs adds the kegs admin, with actions returning them or declaring them lost, the keg deposits, the overdue kegs report, and the keg serials of the sales
+func configureKegs(Admin *admin.Admin, batch *admin.Resource) {
+	menu := []string{"Sales"}
+	keg := Admin.AddResource(&Keg{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	keg.IndexAttrs("Serial", "Container", "Location", "Customer", "Since", "Deposit")
+	keg.NewAttrs("Serial", "Container", "Deposit")
+	keg.EditAttrs("Serial", "Container", "Deposit", "Fills")
+	keg.ShowAttrs("Serial", "Container", "Deposit", "Location", "Customer", "Since", "Fills")
+	keg.Meta(&admin.Meta{Name: "Container", Label: "Type"})
+	keg.Meta(&admin.Meta{Name: "Deposit", Label: "Deposit (€)"})
+	keg.Filter(&admin.Filter{Name: "Location", Config: &admin.SelectOneConfig{Collection: []string{KegAtBrewery, KegAtCustomer, KegLost}}})
+	noop := func(interface{}, *resource.MetaValue, *qor.Context) {}
+	for _, name := range []string{"Location", "Customer", "Since"} {
+		keg.Meta(&admin.Meta{Name: name, Type: "readonly", Setter: noop})
+	}
+	keg.Meta(&admin.Meta{Name: "Fills"}).Resource.EditAttrs("Batch", "Date")
+
+	for _, a := range []struct {
+		name     string
+		location string
+		move     func(*gorm.DB, uint, time.Time) error
+	}{
+		{"Return to brewery", KegAtBrewery, ReturnKeg},
+		{"Declare lost", KegLost, LoseKeg},
+	} {
+		a := a
+		keg.Action(&admin.Action{
+			Name:       a.name,
+			Permission: anyone,
+			Modes:      []string{"show", "menu_item"},
+			Visible: func(record interface{}, context *admin.Context) bool {
+				k, ok := record.(*Keg)
+				return !ok || (k.Location != a.location && k.Location != KegAtBrewery)
+			},
+			Handler: func(argument *admin.ActionArgument) error {
+				for _, record := range argument.FindSelectedRecords() {
+					k, ok := record.(*Keg)
+					if !ok {
+						return errors.New("not a keg")
+					}
+					if err := a.move(argument.Context.GetDB(), k.ID, time.Now()); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+
+	deposit := Admin.AddResource(&KegDeposit{}, &admin.Config{Menu: menu, Permission: roles.Allow(roles.Read, roles.Anyone)})
+	deposit.IndexAttrs("Date", "Customer", "Keg", "Amount")
+	deposit.Filter(&admin.Filter{Name: "Customer", Config: &admin.SelectOneConfig{RemoteDataResource: Admin.GetResource("Customer")}})
+
+	sales := batch.Meta(&admin.Meta{Name: "Sales"}).Resource
+	sales.Meta(&admin.Meta{Name: "Kegs", Label: "Kegs (serials)", Type: "select_many"})
+
+	Admin.GetRouter().Get("/overdue_kegs", func(context *admin.Context) {
+		days, err := strconv.Atoi(context.Request.URL.Query().Get("days"))
+		if err != nil || days < 0 {
+			days = KegOverdueDays
+		}
+		r, err := KegsReport(context.GetDB().New(), time.Now(), days)
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		context.Execute("overdue_kegs", r)
+	})
+	Admin.AddMenu(&admin.Menu{Name: "Overdue kegs", Link: "/admin/overdue_kegs", Ancestors: menu})
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKegs(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 1, 10, 0, 0, 0, 0, time.Local)
+	fermenter, _ := fermenterID(DB)
+	kegType := Container{Name: "Keg 20L", Volume: 20}
+	DB.Create(&kegType)
+	kegFormat, bottle := PackagingFormat{Name: "Keg 20L", Kind: KindKeg, Volume: 20}, PackagingFormat{Name: "Bottle 33cl", Kind: KindBottle, Volume: 0.33}
+	DB.Create(&kegFormat)
+	DB.Create(&bottle)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: date}
+	DB.Create(&b)
+	DB.Create(&PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: kegFormat.ID, Volume: 60, Units: 3})
+	DB.Create(&PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Volume: 10, Units: 30})
+	bar, pub := Customer{Name: "Le Bar"}, Customer{Name: "Le Pub"}
+	DB.Create(&bar)
+	DB.Create(&pub)
+	var kegs []Keg
+	for _, serial := range []string{"K001", "K002", "K003"} {
+		k := Keg{Serial: serial, ContainerID: kegType.ID, Deposit: 30}
+		DB.Create(&k)
+		kegs = append(kegs, k)
+	}
+	DB.Create(&KegFill{KegID: kegs[0].ID, BatchID: b.ID, Date: date})
+
+	// The kegs sold must match the units of a sale of kegs to a customer, and be at the brewery
+	for _, s := range []Sale{
+		{BatchID: b.ID, Date: date, FormatID: bottle.ID, Units: 1, CustomerID: bar.ID, Kegs: []Keg{kegs[0]}},
+		{BatchID: b.ID, Date: date, FormatID: kegFormat.ID, Units: 2, CustomerID: bar.ID, Kegs: []Keg{kegs[0]}},
+		{BatchID: b.ID, Date: date, FormatID: kegFormat.ID, Units: 1, Kegs: []Keg{kegs[0]}},
+	} {
+		if err := DB.Create(&s).Error; err == nil {
+			t.Errorf("got no error creating the sale %+v", s)
+		}
+	}
+	sale := Sale{BatchID: b.ID, Date: date.AddDate(0, 0, 1), FormatID: kegFormat.ID, Units: 2, CustomerID: bar.ID, Kegs: []Keg{kegs[0], kegs[1]}}
+	if err := DB.Create(&sale).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Create(&Sale{BatchID: b.ID, Date: date, FormatID: kegFormat.ID, Units: 1, CustomerID: pub.ID, Kegs: []Keg{kegs[1]}}).Error; err == nil {
+		t.Error("got no error selling a keg at a customer")
+	}
+	DB.Preload("Fills").Find(&kegs)
+	if kegs[0].Location != KegAtCustomer || kegs[0].CustomerID != bar.ID || kegs[0].SaleID != sale.ID || !kegs[0].Since.Equal(sale.Date) || kegs[2].Location != KegAtBrewery {
+		t.Errorf("got kegs %+v, want the kegs sold at the bar", kegs)
+	}
+	if len(kegs[0].Fills) != 1 || kegs[0].Fills[0].SaleID != sale.ID || len(kegs[1].Fills) != 1 || kegs[1].Fills[0].BatchID != b.ID {
+		t.Errorf("got fills %+v and %+v, want the fill delivered by the sale", kegs[0].Fills, kegs[1].Fills)
+	}
+	if err := DB.Save(&sale).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns refund the deposit, lost kegs keep it
+	if err := ReturnKeg(DB, kegs[2].ID, date); err == nil {
+		t.Error("got no error returning a keg at the brewery")
+	}
+	if err := ReturnKeg(DB, kegs[0].ID, date.AddDate(0, 0, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoseKeg(DB, kegs[0].ID, date); err == nil {
+		t.Error("got no error losing a keg at the brewery")
+	}
+	r, err := KegsReport(DB, date.AddDate(0, 0, 100), 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Overdue) != 1 || r.Overdue[0].Keg.Serial != "K002" || r.Overdue[0].Days != 99 || r.Overdue[0].Keg.Customer.Name != "Le Bar" {
+		t.Errorf("got overdue kegs %+v, want K002 at the bar for 99 days", r.Overdue)
+	}
+	if len(r.Deposits) != 1 || r.Deposits[0].Kegs != 1 || r.Deposits[0].Charged != 60 || r.Deposits[0].Refunded != 30 || r.Deposits[0].Held != 30 {
+		t.Errorf("got deposits %+v, want 30 € held by the bar", r.Deposits)
+	}
+	if err := LoseKeg(DB, kegs[1].ID, date.AddDate(0, 0, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := KegsReport(DB, date.AddDate(0, 0, 100), 90); len(r.Overdue) != 0 || r.Deposits[0].Held != 30 {
+		t.Errorf("got report %+v, want no overdue keg and the deposit of the lost keg kept", r)
+	}
+
+	// Deleting the sale brings its kegs back and cancels their deposits
+	DB.Delete(&sale)
+	DB.Find(&kegs)
+	if kegs[1].Location != KegAtBrewery || kegs[1].SaleID != 0 {
+		t.Errorf("got keg %+v, want it back at the brewery", kegs[1])
+	}
+
+	// A sale of kegs needs their serials, of kegs holding the volume sold
+	bigType := Container{Name: "Keg 30L", Volume: 30}
+	DB.Create(&bigType)
+	big := Keg{Serial: "K030", ContainerID: bigType.ID}
+	DB.Create(&big)
+	for _, s := range []Sale{
+		{BatchID: b.ID, Date: date, FormatID: kegFormat.ID, Units: 1, CustomerID: pub.ID},
+		{BatchID: b.ID, Date: date, FormatID: kegFormat.ID, Units: 1, CustomerID: pub.ID, Kegs: []Keg{big}},
+	} {
+		if err := DB.Create(&s).Error; err == nil {
+			t.Errorf("got no error creating the sale %+v", s)
+		}
+	}
+
+	// The kegs of an order line go with its sale
+	order := Order{CustomerID: pub.ID, Date: date, Lines: []OrderLine{{BatchID: b.ID, FormatID: kegFormat.ID, Units: 1, UnitPrice: 80, Kegs: []Keg{kegs[2]}}}}
+	if err := DB.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+	line := order.Lines[0]
+	line.Kegs = []Keg{kegs[0]}
+	DB.Model(&line).Association("Kegs").Replace(line.Kegs)
+	if err := DB.Save(&line).Error; err != nil {
+		t.Fatal(err)
+	}
+	DB.Find(&kegs)
+	if kegs[0].Location != KegAtCustomer || kegs[0].CustomerID != pub.ID || kegs[0].SaleID != line.SaleID || kegs[2].Location != KegAtBrewery {
+		t.Errorf("got kegs %+v, want the keg of the line at the pub and the one taken off the line back", kegs)
+	}
+}
@@ -0,0 +1,398 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// FermenterName is the name of the container holding the beer before any transfer
+const FermenterName = "Fermenter"
+
+// Sources of the stock ledger entries
+const (
+	sourceBatch     = "batch"
+	sourceEvent     = "event"
+	sourceTransfer  = "transfer"
+	sourceSale      = "sale"
+	sourceBlend     = "blend"
+	sourcePackaging = "packaging"
+)
+
+// StockEntry is a line of the stock ledger : a volume of a batch entering (positive) or leaving (negative) a container
+type StockEntry struct {
+	ID          uint `gorm:"primary_key"`
+	BatchID     uint `gorm:"index"`
+	ContainerID uint `gorm:"index"`
+	Date        time.Time
+	Volume      int
+	SourceType  string `gorm:"index:idx_stock_entries_source"`
+	SourceID    uint   `gorm:"index:idx_stock_entries_source"`
+}
+
+// StockLine is the volume of a batch held by a container
+type StockLine struct {
+	ContainerID   uint
+	ContainerName string
+	Volume        int
+}
+
+// fermenterID returns the id of the fermenter container, creating it if needed
+func fermenterID(tx *gorm.DB) (uint, error) {
+	var fermenter Container
+	err := tx.Where(Container{Name: FermenterName}).FirstOrCreate(&fermenter).Error
+	return fermenter.ID, err
+}
+
+// startContainerID returns the id of the container a batch is brewed into : the fermenter reserved for its fermentation, or the fermenter container
+func startContainerID(tx *gorm.DB, batchID uint) (uint, error) {
+	var reservation Reservation
+	err := tx.Where("batch_id = ? AND phase = ?", batchID, PhaseFermentation).Order("start").First(&reservation).Error
+	if err == nil {
+		return reservation.ContainerID, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
+	return fermenterID(tx)
+}
+
+// ledgerEntries returns the stock entries generated by a batch, an event, a transfer, a sale, a packaging run or a blend
+func ledgerEntries(tx *gorm.DB, record interface{}) ([]StockEntry, error) {
+	switch r := record.(type) {
+	case *Batch:
+		// A blended batch starts empty, its beer comes from the blend, and a planned batch holds no beer until brewed
+		if r.StartVolume == 0 || r.Step == StepPlanned {
+			return nil, nil
+		}
+		fermenter, err := startContainerID(tx, r.ID)
+		return []StockEntry{{BatchID: r.ID, ContainerID: fermenter, Date: r.Date, Volume: r.StartVolume, SourceType: sourceBatch, SourceID: r.ID}}, err
+	case *Event:
+		if r.ContainerID != 0 {
+			return []StockEntry{{BatchID: r.BatchID, ContainerID: r.ContainerID, Date: r.Date, Volume: r.Volume, SourceType: sourceEvent, SourceID: r.ID}}, nil
+		}
+		fermenter, err := startContainerID(tx, r.BatchID)
+		return []StockEntry{{BatchID: r.BatchID, ContainerID: fermenter, Date: r.Date, Volume: r.Volume, SourceType: sourceEvent, SourceID: r.ID}}, err
+	case *Transfer:
+		return []StockEntry{
+			{BatchID: r.BatchID, ContainerID: r.FromID, Date: r.Date, Volume: -r.Volume, SourceType: sourceTransfer, SourceID: r.ID},
+			{BatchID: r.BatchID, ContainerID: r.ToID, Date: r.Date, Volume: r.Volume, SourceType: sourceTransfer, SourceID: r.ID},
+		}, nil
+	case *Sale:
+		// Units sold were taken from their container by their packaging run
+		if r.FormatID != 0 {
+			return nil, nil
+		}
+		return []StockEntry{{BatchID: r.BatchID, ContainerID: r.FromID, Date: r.Date, Volume: -r.Volume, SourceType: sourceSale, SourceID: r.ID}}, nil
+	case *PackagingRun:
+		return []StockEntry{{BatchID: r.BatchID, ContainerID: r.FromID, Date: r.Date, Volume: -r.Volume, SourceType: sourcePackaging, SourceID: r.ID}}, nil
+	case *Blend:
+		entries := []StockEntry{{BatchID: r.BatchID, ContainerID: r.ContainerID, Date: r.Date, Volume: r.Volume, SourceType: sourceBlend, SourceID: r.ID}}
+		for _, s := range r.Sources {
+			entries = append(entries, StockEntry{BatchID: s.BatchID, ContainerID: s.ContainerID, Date: r.Date, Volume: -s.Volume, SourceType: sourceBlend, SourceID: r.ID})
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("no stock entries for %T", record)
+}
+
+// writeEntries replaces the ledger entries of a source by the given ones
+func writeEntries(tx *gorm.DB, sourceType string, sourceID uint, entries []StockEntry) error {
+	containers, err := entryContainers(tx, "source_type = ? AND source_id = ?", sourceType, sourceID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("source_type = ? AND source_id = ?", sourceType, sourceID).Delete(StockEntry{}).Error; err != nil {
+		return err
+	}
+	for i := range entries {
+		if err := tx.Create(&entries[i]).Error; err != nil {
+			return err
+		}
+		containers = append(containers, entries[i].ContainerID)
+	}
+	return refreshStates(tx, containers...)
+}
+
+// recordEntries updates the ledger for a saved event, transfer or sale
+func recordEntries(tx *gorm.DB, sourceType string, record interface{}, sourceID uint) error {
+	if sourceID == 0 {
+		return nil
+	}
+	entries, err := ledgerEntries(tx, record)
+	if err != nil {
+		return err
+	}
+	return writeEntries(tx, sourceType, sourceID, entries)
+}
+
+// removeEntries removes the ledger entries of a deleted event, transfer or sale
+func removeEntries(tx *gorm.DB, sourceType string, sourceID uint) error {
+	if sourceID == 0 {
+		return nil
+	}
+	return writeEntries(tx, sourceType, sourceID, nil)
+}
+
+// syncBatchLedger regenerates all the ledger entries of a batch from its events, transfers, sales, packaging runs and blends
+func syncBatchLedger(tx *gorm.DB, b *Batch) error {
+	containers, err := entryContainers(tx, "batch_id = ?", b.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("batch_id = ?", b.ID).Delete(StockEntry{}).Error; err != nil {
+		return err
+	}
+	var records []interface{}
+	records = append(records, b)
+	var events []Event
+	if err := tx.Where("batch_id = ?", b.ID).Find(&events).Error; err != nil {
+		return err
+	}
+	for i := range events {
+		records = append(records, &events[i])
+	}
+	var transfers []Transfer
+	if err := tx.Where("batch_id = ?", b.ID).Find(&transfers).Error; err != nil {
+		return err
+	}
+	for i := range transfers {
+		records = append(records, &transfers[i])
+	}
+	var sales []Sale
+	if err := tx.Where("batch_id = ?", b.ID).Find(&sales).Error; err != nil {
+		return err
+	}
+	for i := range sales {
+		records = append(records, &sales[i])
+	}
+	var runs []PackagingRun
+	if err := tx.Where("batch_id = ?", b.ID).Find(&runs).Error; err != nil {
+		return err
+	}
+	for i := range runs {
+		records = append(records, &runs[i])
+	}
+	var batchBlends []Blend
+	if err := tx.Preload("Sources").Where("batch_id = ? OR id IN (SELECT blend_id FROM blend_sources WHERE batch_id = ? AND deleted_at IS NULL)", b.ID, b.ID).Find(&batchBlends).Error; err != nil {
+		return err
+	}
+	for i := range batchBlends {
+		records = append(records, &batchBlends[i])
+	}
+	for _, r := range records {
+		entries, err := ledgerEntries(tx, r)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			// A blend also has entries for the other batches blended
+			if entries[i].BatchID != b.ID {
+				continue
+			}
+			if err := tx.Create(&entries[i]).Error; err != nil {
+				return err
+			}
+			containers = append(containers, entries[i].ContainerID)
+		}
+	}
+	return refreshStates(tx, containers...)
+}
+
+// RebuildLedger regenerates the whole stock ledger from the batches, events, transfers and sales
+func RebuildLedger(db *gorm.DB) error {
+	tx := db.Begin()
+	if err := tx.Delete(StockEntry{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	var batches []Batch
+	if err := tx.Find(&batches).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range batches {
+		if err := syncBatchLedger(tx, &batches[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// endOfDay gives the start of the day after the date, the entries of the day being held as of the date
+func endOfDay(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, day.Location())
+}
+
+// asOf restricts the query to the records of the table dated up to the end of the day, or doesn't if the day is zero
+func asOf(query *gorm.DB, table string, day time.Time) *gorm.DB {
+	if day.IsZero() {
+		return query
+	}
+	return query.Where(table+".date < ?", endOfDay(day))
+}
+
+// LoadStock works out the volumes and stocks of the given batches from the stock ledger, with a single query
+func LoadStock(db *gorm.DB, batches ...*Batch) error {
+	return LoadStockAt(db, time.Time{}, batches...)
+}
+
+// LoadStockAt works out the volumes and stocks of the given batches as of the end of the day, from the stock ledger entries dated up to it
+func LoadStockAt(db *gorm.DB, day time.Time, batches ...*Batch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, b := range batches {
+		ids = append(ids, b.ID)
+	}
+	var rows []struct {
+		BatchID       uint
+		ContainerID   uint
+		ContainerName string
+		SourceType    string
+		Volume        int
+	}
+	err := asOf(db.Table("stock_entries"), "stock_entries", day).
+		Select("stock_entries.batch_id, stock_entries.container_id, containers.name AS container_name, stock_entries.source_type, SUM(stock_entries.volume) AS volume").
+		Joins("LEFT JOIN containers ON containers.id = stock_entries.container_id").
+		Where("stock_entries.batch_id IN (?)", ids).
+		Group("stock_entries.batch_id, stock_entries.container_id, containers.name, stock_entries.source_type").
+		Order("stock_entries.batch_id, stock_entries.container_id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, b := range batches {
+		b.CurrentVolume = 0
+		b.Stocks = nil
+		for _, r := range rows {
+			if r.BatchID != b.ID {
+				continue
+			}
+			if r.SourceType == sourceBatch || r.SourceType == sourceEvent || r.SourceType == sourceBlend {
+				b.CurrentVolume += r.Volume
+			}
+			if n := len(b.Stocks); n > 0 && b.Stocks[n-1].ContainerID == r.ContainerID {
+				b.Stocks[n-1].Volume += r.Volume
+			} else {
+				b.Stocks = append(b.Stocks, StockLine{ContainerID: r.ContainerID, ContainerName: r.ContainerName, Volume: r.Volume})
+			}
+		}
+		// The batches mixed before the blends were recorded have no blend entries
+		if b.Step == StepMixed {
+			b.CurrentVolume = 0
+		}
+		if b.Step == StepPlanned || b.Step == StepBrewing {
+			b.Stocks = nil
+			b.Stock = "brew not yet fermented"
+			continue
+		}
+		b.Stock = FormatStocks(b.Stocks)
+	}
+	return nil
+}
+
+// FormatStocks formats the stock lines for display, as "Fermenter: 120, Keg: 40"
+func FormatStocks(stocks []StockLine) string {
+	var lines []string
+	for _, s := range stocks {
+		lines = append(lines, fmt.Sprintf("%s: %d", s.ContainerName, s.Volume))
+	}
+	return strings.Join(lines, ", ")
+}
+
+// AfterSave regenerates the batch ledger entries, taking into account the nested events, transfers and sales edited with it, then checks the stocks
+func (b *Batch) AfterSave(tx *gorm.DB) error {
+	if err := syncBatchLedger(tx, b); err != nil {
+		return err
+	}
+	if err := checkPendingStocks(tx); err != nil {
+		return err
+	}
+	return checkStartContainer(tx, b)
+}
+
+// checkStartContainer checks that a brewed batch fits in the container it is brewed into
+func checkStartContainer(tx *gorm.DB, b *Batch) error {
+	if b.StartVolume == 0 || b.Step == StepPlanned {
+		return nil
+	}
+	container, err := startContainerID(tx, b.ID)
+	if err != nil {
+		return err
+	}
+	return validateCapacity(tx, b, container)
+}
+
+// AfterDelete removes the batch ledger entries and container reservations, and gives its ingredients back to the inventory
+func (b *Batch) AfterDelete(tx *gorm.DB) error {
+	if b.ID == 0 {
+		return nil
+	}
+	containers, err := entryContainers(tx, "batch_id = ?", b.ID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Where("batch_id = ?", b.ID).Delete(StockEntry{}).Error; err != nil {
+		return err
+	}
+	if err := refreshStates(tx, containers...); err != nil {
+		return err
+	}
+	if err := tx.New().Where("batch_id = ?", b.ID).Delete(Reservation{}).Error; err != nil {
+		return err
+	}
+	return releaseIngredients(tx, b.ID)
+}
+
+// BeforeSave sets the container key from the container set by the admin
+func (e *Event) BeforeSave() error {
+	e.ContainerID = keyOf(e.ContainerID, e.Container.ID)
+	return nil
+}
+
+// AfterSave records the event into the stock ledger
+func (e *Event) AfterSave(tx *gorm.DB) error {
+	return recordEntries(tx, sourceEvent, e, e.ID)
+}
+
+// AfterDelete removes the event from the stock ledger
+func (e *Event) AfterDelete(tx *gorm.DB) error {
+	return removeEntries(tx, sourceEvent, e.ID)
+}
+
+// AfterSave records the transfer into the stock ledger and checks the resulting stocks
+func (t *Transfer) AfterSave(tx *gorm.DB) error {
+	if err := recordEntries(tx, sourceTransfer, t, t.ID); err != nil {
+		return err
+	}
+	return checkStock(tx, t)
+}
+
+// AfterDelete removes the transfer from the stock ledger
+func (t *Transfer) AfterDelete(tx *gorm.DB) error {
+	return removeEntries(tx, sourceTransfer, t.ID)
+}
+
+// AfterSave records the sale into the stock ledger and checks the resulting stocks
+func (s *Sale) AfterSave(tx *gorm.DB) error {
+	if err := recordEntries(tx, sourceSale, s, s.ID); err != nil {
+		return err
+	}
+	if err := deliverKegs(tx.New(), s); err != nil {
+		return err
+	}
+	return checkStock(tx, s)
+}
+
+// AfterDelete removes the sale from the stock ledger, and brings its kegs back
+func (s *Sale) AfterDelete(tx *gorm.DB) error {
+	if err := removeEntries(tx, sourceSale, s.ID); err != nil {
+		return err
+	}
+	return releaseKegs(tx.New(), s.ID)
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// initTestDB sets up a fresh business database in a temporary directory
+func initTestDB(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "malt_app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	InitDB(filepath.Join(dir, "business.db"))
+	return func() {
+		DB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	defer initTestDB(t)()
+
+	keg := Container{Name: "Keg", Volume: 20, State: StateSanitized}
+	DB.Create(&keg)
+	var fermenter Container
+	DB.Where(Container{Name: FermenterName}).First(&fermenter)
+
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: time.Now()}
+	if err := DB.Create(&b).Error; err != nil {
+		t.Fatal(err)
+	}
+	DB.Create(&Event{BatchID: b.ID, Name: "Dry hopping loss", Volume: -10})
+	transfer := Transfer{BatchID: b.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 20}
+	DB.Create(&transfer)
+	DB.Create(&Sale{BatchID: b.ID, FromID: keg.ID, Volume: 5})
+
+	check := func(wantVolume int, wantStock string) {
+		t.Helper()
+		var got Batch
+		DB.First(&got, b.ID)
+		if err := LoadStock(DB, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.CurrentVolume != wantVolume {
+			t.Errorf("CurrentVolume = %v, want %v", got.CurrentVolume, wantVolume)
+		}
+		if got.Stock != wantStock {
+			t.Errorf("Stock = %v, want %v", got.Stock, wantStock)
+		}
+	}
+	check(90, "Fermenter: 70, Keg: 15")
+
+	// The stock lines must be typed and ordered by container
+	var got Batch
+	DB.First(&got, b.ID)
+	LoadStock(DB, &got)
+	want := []StockLine{{fermenter.ID, FermenterName, 70}, {keg.ID, "Keg", 15}}
+	if !reflect.DeepEqual(got.Stocks, want) {
+		t.Errorf("Stocks = %v, want %v", got.Stocks, want)
+	}
+
+	// Editing and deleting rows must update the ledger
+	transfer.Volume = 10
+	DB.Save(&transfer)
+	check(90, "Fermenter: 80, Keg: 5")
+	DB.Delete(&transfer)
+	check(90, "Fermenter: 90, Keg: -5")
+
+	// Rebuilding the ledger must give back the same stocks
+	DB.Exec("DELETE FROM stock_entries")
+	check(0, "")
+	if err := RebuildLedger(DB); err != nil {
+		t.Fatal(err)
+	}
+	check(90, "Fermenter: 90, Keg: -5")
+}
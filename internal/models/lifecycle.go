@@ -0,0 +1,304 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/auth"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Batch steps
+const (
+	StepPlanned      = "planned"
+	StepBrewing      = "brewing"
+	StepFermenting   = "fermenting"
+	StepConditioning = "conditioning"
+	StepPackaged     = "packaged"
+	StepSoldOut      = "sold out"
+	StepArchived     = "archived"
+	// StepMixed is the step of a batch blended into another one
+	StepMixed = "mixed"
+)
+
+// Step is a step of the batch lifecycle
+type Step struct {
+	Name            string
+	Action          string // Label of the action moving a batch to this step
+	AllowsTransfers bool
+	AllowsSales     bool
+}
+
+// Steps is the batch lifecycle, in order
+var Steps = []Step{
+	{Name: StepPlanned, Action: "Plan"},
+	{Name: StepBrewing, Action: "Start brewing"},
+	{Name: StepFermenting, Action: "Start fermenting", AllowsTransfers: true},
+	{Name: StepConditioning, Action: "Start conditioning", AllowsTransfers: true, AllowsSales: true},
+	{Name: StepPackaged, Action: "Package", AllowsTransfers: true, AllowsSales: true},
+	{Name: StepSoldOut, Action: "Mark as sold out"},
+	{Name: StepArchived, Action: "Archive"},
+	{Name: StepMixed, Action: "Mark as mixed"},
+}
+
+// Transition is an allowed change of a batch step
+type Transition struct {
+	From       string
+	To         string
+	Permission *roles.Permission
+}
+
+var (
+	anyone     = roles.Allow(roles.Update, roles.Anyone)
+	adminsOnly = roles.Allow(roles.Update, "admin")
+)
+
+// Transitions are the allowed changes of a batch step : everyone can move a batch forward, only admins can move it back or archive it
+var Transitions = []Transition{
+	{StepPlanned, StepBrewing, anyone},
+	{StepBrewing, StepFermenting, anyone},
+	{StepFermenting, StepConditioning, anyone},
+	{StepConditioning, StepPackaged, anyone},
+	{StepPackaged, StepSoldOut, anyone},
+	{StepFermenting, StepMixed, anyone},
+	{StepConditioning, StepMixed, anyone},
+	{StepBrewing, StepPlanned, adminsOnly},
+	{StepFermenting, StepBrewing, adminsOnly},
+	{StepConditioning, StepFermenting, adminsOnly},
+	{StepPackaged, StepConditioning, adminsOnly},
+	{StepSoldOut, StepPackaged, adminsOnly},
+	{StepPlanned, StepArchived, adminsOnly},
+	{StepSoldOut, StepArchived, adminsOnly},
+	{StepMixed, StepArchived, adminsOnly},
+}
+
+// Step change errors
+const (
+	errUnknownStep         = "This batch step does not exist"
+	errForbiddenTransition = "This batch step change is not allowed"
+	errStepNotEditable     = "The batch step can only be changed through its actions"
+	errNoTransfers         = "Transfers are not allowed at this batch step"
+	errNoSales             = "Sales are not allowed at this batch step"
+)
+
+// StepChange records a change of the batch step
+type StepChange struct {
+	gorm.Model
+	BatchID uint
+	From    string
+	To      string
+	Date    time.Time
+	User    string
+}
+
+// FindStep returns the step with the given name
+func FindStep(name string) (Step, bool) {
+	for _, s := range Steps {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Step{}, false
+}
+
+// FindTransition returns the transition between the given steps
+func FindTransition(from string, to string) (Transition, bool) {
+	for _, t := range Transitions {
+		if t.From == from && t.To == to {
+			return t, true
+		}
+	}
+	return Transition{}, false
+}
+
+// Allowed tells if the transition is allowed for the given roles
+func (t Transition) Allowed(roleNames ...string) bool {
+	var r []interface{}
+	for _, name := range roleNames {
+		r = append(r, name)
+	}
+	return t.Permission.HasPermission(roles.Update, r...)
+}
+
+// ChangeStep moves the batch to the given step if the transition is allowed for the given roles, and records the change
+func (b *Batch) ChangeStep(db *gorm.DB, to string, user string, roleNames ...string) error {
+	t, ok := FindTransition(b.Step, to)
+	if !ok || !t.Allowed(roleNames...) {
+		return validations.NewError(b, "Step", errForbiddenTransition)
+	}
+	tx := db.New().Begin()
+	if err := moveStep(tx, b, t, user, time.Now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// moveStep moves the batch along the transition within a transaction, and records the change.
+// The batch must still be at the start of the transition, so that two concurrent changes don't both apply.
+func moveStep(tx *gorm.DB, b *Batch, t Transition, user string, now time.Time) error {
+	update := tx.Model(b).Where("step = ?", t.From).UpdateColumn("step", t.To)
+	if update.Error != nil {
+		return update.Error
+	}
+	if update.RowsAffected == 0 {
+		return validations.NewError(b, "Step", errForbiddenTransition)
+	}
+	if err := tx.Create(&StepChange{BatchID: b.ID, From: t.From, To: t.To, Date: now, User: user}).Error; err != nil {
+		return err
+	}
+	// Starting the brew puts the beer in the stock ledger and takes the ingredients from the inventory, going back to planned takes them out and gives them back
+	switch {
+	case t.From == StepPlanned && t.To == StepBrewing:
+		if err := recordBatchEntry(tx, b.ID); err != nil {
+			return err
+		}
+		return consumeIngredients(tx, b, now)
+	case t.From == StepBrewing && t.To == StepPlanned:
+		if err := recordBatchEntry(tx, b.ID); err != nil {
+			return err
+		}
+		return releaseIngredients(tx, b.ID)
+	}
+	return nil
+}
+
+// recordBatchEntry writes the stock entry of the volume brewed, as of the batch step, and checks that it fits in the container it is brewed into
+func recordBatchEntry(tx *gorm.DB, batchID uint) error {
+	var b Batch
+	if err := tx.First(&b, batchID).Error; err != nil {
+		return err
+	}
+	if err := recordEntries(tx, sourceBatch, &b, b.ID); err != nil {
+		return err
+	}
+	return checkStartContainer(tx, &b)
+}
+
+// BeforeCreate starts the batches as planned by default
+func (b *Batch) BeforeCreate() error {
+	if b.Step == "" {
+		b.Step = StepPlanned
+	}
+	if _, ok := FindStep(b.Step); !ok {
+		return validations.NewError(b, "Step", errUnknownStep)
+	}
+	return nil
+}
+
+// checkStepUnchanged prevents a saved batch step to be changed otherwise than with ChangeStep
+func checkStepUnchanged(tx *gorm.DB, b *Batch) error {
+	if b.ID == 0 {
+		return nil
+	}
+	var saved Batch
+	if err := tx.Select("step").First(&saved, b.ID).Error; err != nil {
+		return err
+	}
+	if saved.Step != b.Step {
+		return validations.NewError(b, "Step", errStepNotEditable)
+	}
+	return nil
+}
+
+// checkStepAllows checks that the batch step allows transfers, sales or packaging
+func checkStepAllows(tx *gorm.DB, record interface{}, batchID uint) error {
+	var b Batch
+	if err := tx.Select("step").First(&b, batchID).Error; err != nil {
+		return err
+	}
+	step, _ := FindStep(b.Step)
+	switch record.(type) {
+	case *Transfer:
+		if !step.AllowsTransfers {
+			return validations.NewError(record, "Date", errNoTransfers)
+		}
+	case *Sale:
+		if !step.AllowsSales {
+			return validations.NewError(record, "Date", errNoSales)
+		}
+	case *PackagingRun:
+		if !step.AllowsSales {
+			return validations.NewError(record, "Date", errNoPackaging)
+		}
+	}
+	return nil
+}
+
+// BeforeSave checks that the batch step allows transfers
+func (t *Transfer) BeforeSave(tx *gorm.DB) error {
+	if err := checkStepAllows(tx, t, t.BatchID); err != nil {
+		return err
+	}
+	return checkSanitized(tx.New(), t)
+}
+
+// BeforeSave checks that the batch step allows sales and that a sale of an order is changed from its line, works out the liter equivalent of the sale and checks its kegs
+func (s *Sale) BeforeSave(tx *gorm.DB) error {
+	if err := checkStepAllows(tx, s, s.BatchID); err != nil {
+		return err
+	}
+	if err := prepareSale(tx, s); err != nil {
+		return err
+	}
+	s.CustomerID = keyOf(s.CustomerID, s.Customer.ID)
+	if err := checkOrderSale(tx.New(), s, false); err != nil {
+		return err
+	}
+	return validateKegs(tx.New(), s)
+}
+
+// BeforeDelete prevents the sale of an order line from being deleted otherwise than with its line
+func (s *Sale) BeforeDelete(tx *gorm.DB) error {
+	return checkOrderSale(tx.New(), s, true)
+}
+
+// userName returns the login of the given QOR user
+func userName(user qor.CurrentUser) string {
+	if u, ok := user.(auth.User); ok {
+		return u.Login
+	}
+	if user != nil {
+		return user.DisplayName()
+	}
+	return ""
+}
+
+// configureLifecycle makes the batch step read only and adds the step transitions as actions
+func configureLifecycle(batch *admin.Resource) {
+	batch.Meta(&admin.Meta{Name: "Step", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	batch.Meta(&admin.Meta{Name: "StepChanges", Permission: roles.Allow(roles.Read, roles.Anyone)})
+	for _, s := range Steps {
+		to := s.Name
+		batch.Action(&admin.Action{
+			Name:       s.Action,
+			Permission: anyone,
+			Modes:      []string{"show", "edit", "menu_item"},
+			Visible: func(record interface{}, context *admin.Context) bool {
+				b, ok := record.(*Batch)
+				if !ok {
+					return false
+				}
+				t, ok := FindTransition(b.Step, to)
+				return ok && t.Allowed(context.Roles...)
+			},
+			Handler: func(argument *admin.ActionArgument) error {
+				for _, record := range argument.FindSelectedRecords() {
+					b, ok := record.(*Batch)
+					if !ok {
+						return errors.New("not a batch")
+					}
+					if err := b.ChangeStep(argument.Context.GetDB(), to, userName(argument.Context.CurrentUser), argument.Context.Roles...); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+}
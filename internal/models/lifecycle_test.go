@@ -0,0 +1,123 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestBatch_ChangeStep(t *testing.T) {
+	defer initTestDB(t)()
+
+	b := Batch{Recipe: Recipe{Name: "IPA"}, StartVolume: 100}
+	DB.Create(&b)
+	if b.Step != StepPlanned {
+		t.Fatalf("new batch step = %v, want %v", b.Step, StepPlanned)
+	}
+
+	tests := []struct {
+		name    string
+		to      string
+		roles   []string
+		wantErr bool
+	}{
+		{"user_cannot_skip_steps", StepFermenting, nil, true},
+		{"user_moves_forward", StepBrewing, nil, false},
+		{"user_cannot_move_back", StepPlanned, nil, true},
+		{"admin_moves_back", StepPlanned, []string{"admin"}, false},
+		{"user_cannot_archive", StepArchived, nil, true},
+		{"admin_archives", StepArchived, []string{"admin"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := b.Step
+			err := b.ChangeStep(DB, tt.to, "USER", tt.roles...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ChangeStep() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got Batch
+			DB.First(&got, b.ID)
+			want := tt.to
+			if tt.wantErr {
+				want = from
+			}
+			if got.Step != want {
+				t.Errorf("step = %v, want %v", got.Step, want)
+			}
+			b = got
+		})
+	}
+
+	var count int
+	var changes []StepChange
+	DB.Where("batch_id = ?", b.ID).Order("id").Find(&changes)
+	if len(changes) != 3 || changes[2].From != StepPlanned || changes[2].To != StepArchived || changes[2].User != "USER" {
+		t.Errorf("got step changes %+v, want 3 changes ending with planned to archived by USER", changes)
+	}
+
+	// A planned batch holds no beer until brewed
+	brew := Batch{RecipeID: b.RecipeID, StartVolume: 50}
+	DB.Create(&brew)
+	stock := func() int {
+		var entries int
+		DB.Model(&StockEntry{}).Where("batch_id = ?", brew.ID).Count(&entries)
+		return entries
+	}
+	if n := stock(); n != 0 {
+		t.Errorf("got %d stock entries for a planned batch, want none", n)
+	}
+	if err := brew.ChangeStep(DB, StepBrewing, "USER"); err != nil {
+		t.Fatal(err)
+	}
+	if n := stock(); n != 1 {
+		t.Errorf("got %d stock entries once brewing, want 1", n)
+	}
+	if err := brew.ChangeStep(DB, StepPlanned, "USER", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if n := stock(); n != 0 {
+		t.Errorf("got %d stock entries back to planned, want none", n)
+	}
+
+	// A change made from a stale step, as a double click, doesn't apply twice
+	other := Batch{RecipeID: b.RecipeID, StartVolume: 100}
+	DB.Create(&other)
+	stale := other
+	if err := other.ChangeStep(DB, StepBrewing, "USER"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.ChangeStep(DB, StepBrewing, "USER"); err == nil {
+		t.Error("got no error changing the step from a stale one")
+	}
+	DB.Model(&StepChange{}).Where("batch_id = ?", other.ID).Count(&count)
+	if count != 1 {
+		t.Errorf("got %d step changes, want 1", count)
+	}
+
+	// The step cannot be changed by saving the batch
+	b.Step = StepPlanned
+	if err := DB.Save(&b).Error; err == nil {
+		t.Error("got no error changing the step by saving the batch")
+	}
+}
+
+func TestStepAllows(t *testing.T) {
+	defer initTestDB(t)()
+
+	var fermenter Container
+	DB.Where(Container{Name: FermenterName}).First(&fermenter)
+	keg := Container{Name: "Keg", State: StateSanitized}
+	DB.Create(&keg)
+	planned := Batch{Recipe: Recipe{Name: "IPA"}, StartVolume: 100}
+	DB.Create(&planned)
+	fermenting := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepFermenting, StartVolume: 100}
+	DB.Create(&fermenting)
+
+	if err := DB.Create(&Transfer{BatchID: planned.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 10}).Error; err == nil {
+		t.Error("got no error transferring a planned batch")
+	}
+	if err := DB.Create(&Transfer{BatchID: fermenting.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 10}).Error; err != nil {
+		t.Errorf("got error %v transferring a fermenting batch", err)
+	}
+	if err := DB.Create(&Sale{BatchID: fermenting.ID, FromID: keg.ID, Volume: 10}).Error; err == nil {
+		t.Error("got no error selling a fermenting batch")
+	}
+}
@@ -0,0 +1,265 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Measurement kinds
+const (
+	KindGravity     = "gravity"
+	KindTemperature = "temperature"
+	KindPH          = "pH"
+	KindCO2         = "CO2"
+)
+
+// SourceManual is the source of the readings entered by hand
+const SourceManual = "manual"
+
+// MeasurementKind is a kind of reading, with its units and how to convert them into the first one
+type MeasurementKind struct {
+	Name    string
+	Units   []string
+	convert map[string]func(float64) float64
+}
+
+// MeasurementKinds are the kinds of readings that can be taken on a batch
+var MeasurementKinds = []MeasurementKind{
+	{Name: KindGravity, Units: []string{"SG", "°P", "°Bx"}, convert: map[string]func(float64) float64{"°P": brewcalc.PlatoToGravity, "°Bx": brewcalc.PlatoToGravity}},
+	{Name: KindTemperature, Units: []string{"°C", "°F"}, convert: map[string]func(float64) float64{"°F": func(v float64) float64 { return (v - 32) * 5 / 9 }}},
+	{Name: KindPH, Units: []string{"pH"}},
+	{Name: KindCO2, Units: []string{"vol", "g/L"}, convert: map[string]func(float64) float64{"g/L": func(v float64) float64 { return v / 1.96 }}},
+}
+
+// Error messages
+const (
+	errUnknownKind = "unknown measurement kind"
+	errUnknownUnit = "unit not suited to the measurement kind"
+)
+
+// Measurement is a reading taken on a batch, by hand or by a sensor
+type Measurement struct {
+	gorm.Model
+	Batch   Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID uint  `gorm:"index"`
+	Date    time.Time
+	Kind    string
+	Value   float64
+	Unit    string
+	Source  string
+}
+
+// FindMeasurementKind gives the measurement kind with the given name
+func FindMeasurementKind(name string) (MeasurementKind, bool) {
+	for _, k := range MeasurementKinds {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return MeasurementKind{}, false
+}
+
+// HasUnit tells if the unit can be used for the kind
+func (k MeasurementKind) HasUnit(unit string) bool {
+	for _, u := range k.Units {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalized gives the measurement value in the first unit of its kind
+func (m Measurement) Normalized() float64 {
+	k, _ := FindMeasurementKind(m.Kind)
+	if convert, ok := k.convert[m.Unit]; ok {
+		return convert(m.Value)
+	}
+	return m.Value
+}
+
+// BeforeSave checks the measurement kind and unit, defaulting to the first unit of the kind, to a manual reading and to the current time
+func (m *Measurement) BeforeSave() error {
+	k, ok := FindMeasurementKind(m.Kind)
+	if !ok {
+		return validations.NewError(m, "Kind", errUnknownKind)
+	}
+	if m.Unit == "" {
+		m.Unit = k.Units[0]
+	}
+	if !k.HasUnit(m.Unit) {
+		return validations.NewError(m, "Unit", errUnknownUnit)
+	}
+	if m.Source == "" {
+		m.Source = SourceManual
+	}
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+	return nil
+}
+
+// LoadReadings works out the apparent attenuation and the actual ABV of the batches from their first and last gravity readings, with one query for all the batches
+func LoadReadings(db *gorm.DB, batches ...*Batch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, b := range batches {
+		ids = append(ids, b.ID)
+	}
+	var gravities []Measurement
+	if err := db.Where("batch_id IN (?) AND kind = ?", ids, KindGravity).Order("date, id").Find(&gravities).Error; err != nil {
+		return err
+	}
+	for _, b := range batches {
+		var first, last *Measurement
+		for i := range gravities {
+			if gravities[i].BatchID == b.ID {
+				if first == nil {
+					first = &gravities[i]
+				}
+				last = &gravities[i]
+			}
+		}
+		b.ApparentAttenuation, b.ABV = 0, 0
+		if first == nil || first == last {
+			continue
+		}
+		og, fg := first.Normalized(), last.Normalized()
+		b.ApparentAttenuation = brewcalc.Round(brewcalc.ApparentAttenuation(og, fg), 1)
+		b.ABV = brewcalc.Round(brewcalc.ABV(og, fg), 1)
+	}
+	return nil
+}
+
+// Chart dimensions, in SVG user units
+const (
+	chartWidth  = 600
+	chartHeight = 150
+)
+
+// MeasurementChart is the line chart of the readings of a kind, in the first unit of the kind
+type MeasurementChart struct {
+	Kind    string
+	Unit    string
+	ViewBox string // SVG view box, with a margin around the points
+	Height  int
+	Points  string // SVG polyline points
+	Min     float64
+	Max     float64
+	First   time.Time
+	Last    time.Time
+	Count   int
+}
+
+// MeasurementCharts draws a chart for each kind of the given readings, which must be sorted by date
+func MeasurementCharts(measurements []Measurement) []MeasurementChart {
+	var charts []MeasurementChart
+	for _, k := range MeasurementKinds {
+		var readings []Measurement
+		for _, m := range measurements {
+			if m.Kind == k.Name {
+				readings = append(readings, m)
+			}
+		}
+		if len(readings) == 0 {
+			continue
+		}
+		c := MeasurementChart{Kind: k.Name, Unit: k.Units[0], ViewBox: fmt.Sprintf("-5 -5 %d %d", chartWidth+10, chartHeight+10), Height: chartHeight, Min: math.Inf(1), Max: math.Inf(-1), First: readings[0].Date, Last: readings[len(readings)-1].Date, Count: len(readings)}
+		for _, m := range readings {
+			c.Min = math.Min(c.Min, m.Normalized())
+			c.Max = math.Max(c.Max, m.Normalized())
+		}
+		span, valueSpan := c.Last.Sub(c.First).Seconds(), c.Max-c.Min
+		var points []string
+		for _, m := range readings {
+			x, y := 0.0, chartHeight/2.0
+			if span > 0 {
+				x = m.Date.Sub(c.First).Seconds() / span * chartWidth
+			}
+			if valueSpan > 0 {
+				y = (c.Max - m.Normalized()) / valueSpan * chartHeight
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		c.Points = strings.Join(points, " ")
+		c.Min, c.Max = brewcalc.Round(c.Min, 3), brewcalc.Round(c.Max, 3)
+		charts = append(charts, c)
+	}
+	return charts
+}
+
+// configureMeasurements adds the readings admin, and shows the batch readings as charts along with the values worked out from them
+func configureMeasurements(Admin *admin.Admin, batch *admin.Resource) {
+	measurement := Admin.AddResource(&Measurement{}, &admin.Config{Menu: []string{"Batches"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.Create, roles.Anyone).Allow(roles.CRUD, "admin")})
+	var kinds, units []string
+	for _, k := range MeasurementKinds {
+		kinds = append(kinds, k.Name)
+		units = append(units, k.Units...)
+	}
+	measurement.Meta(&admin.Meta{Name: "Kind", Type: "select_one", Config: &admin.SelectOneConfig{Collection: kinds}})
+	measurement.Meta(&admin.Meta{Name: "Unit", Type: "select_one", Config: &admin.SelectOneConfig{Collection: units}})
+	measurement.IndexAttrs("Batch", "Date", "Kind", "Value", "Unit", "Source")
+	measurement.Filter(&admin.Filter{Name: "Kind", Config: &admin.SelectOneConfig{Collection: kinds}})
+
+	// Load the batches of the readings, to name them in the list
+	findMany := measurement.FindManyHandler
+	measurement.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findMany(result, context); err != nil {
+			return err
+		}
+		measurements, ok := result.(*[]*Measurement)
+		if !ok || len(*measurements) == 0 {
+			return nil
+		}
+		var ids []uint
+		for _, m := range *measurements {
+			ids = append(ids, m.BatchID)
+		}
+		var batches []Batch
+		if err := context.GetDB().New().Where("id IN (?)", ids).Find(&batches).Error; err != nil {
+			return err
+		}
+		for _, m := range *measurements {
+			for _, b := range batches {
+				if b.ID == m.BatchID {
+					m.Batch = b
+				}
+			}
+		}
+		return nil
+	}
+
+	Admin.RegisterFuncMap("measurement_charts", MeasurementCharts)
+	batch.Meta(&admin.Meta{
+		Name:   "Measurements",
+		Type:   "measurement_chart",
+		Setter: func(interface{}, *resource.MetaValue, *qor.Context) {},
+		Valuer: func(record interface{}, context *qor.Context) interface{} {
+			var measurements []Measurement
+			if b, ok := record.(*Batch); ok && b.ID != 0 {
+				context.GetDB().New().Where("batch_id = ?", b.ID).Order("date, id").Find(&measurements)
+			}
+			return measurements
+		},
+	})
+	batch.Meta(&admin.Meta{Name: "ApparentAttenuation", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+	// The ABV of a blended batch is the unrounded one of its blend
+	batch.Meta(&admin.Meta{Name: "ABV", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}, Valuer: func(record interface{}, context *qor.Context) interface{} {
+		if b, ok := record.(*Batch); ok {
+			return brewcalc.Round(b.ABV, 1)
+		}
+		return nil
+	}})
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadReadings(t *testing.T) {
+	defer initTestDB(t)()
+
+	b := Batch{Recipe: Recipe{Name: "IPA"}, StartVolume: 20}
+	DB.Create(&b)
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, m := range []Measurement{
+		{Kind: KindGravity, Value: 1.060},
+		{Kind: KindTemperature, Value: 19},
+		{Kind: KindGravity, Value: 1.020},
+		{Kind: KindGravity, Value: 1.012},
+	} {
+		m.BatchID, m.Date = b.ID, start.Add(time.Duration(i)*24*time.Hour)
+		if err := DB.Create(&m).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := LoadReadings(DB, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.ApparentAttenuation != 80 || b.ABV != 6.3 {
+		t.Errorf("got attenuation %v and ABV %v, want 80 and 6.3", b.ApparentAttenuation, b.ABV)
+	}
+
+	var readings []Measurement
+	DB.Where("batch_id = ?", b.ID).Order("date").Find(&readings)
+	if readings[0].Unit != "SG" || readings[0].Source != SourceManual {
+		t.Errorf("got unit %v and source %v, want SG read by hand", readings[0].Unit, readings[0].Source)
+	}
+	charts := MeasurementCharts(readings)
+	if len(charts) != 2 || charts[0].Kind != KindGravity || charts[0].Points != "0.0,0.0 400.0,125.0 600.0,150.0" {
+		t.Errorf("got charts %+v, want a gravity chart and a temperature chart", charts)
+	}
+}
+
+func TestMeasurement_BeforeSave(t *testing.T) {
+	defer initTestDB(t)()
+
+	tests := []struct {
+		name    string
+		m       Measurement
+		wantErr bool
+	}{
+		{"plato_gravity", Measurement{Kind: KindGravity, Unit: "°P", Value: 12}, false},
+		{"unknown_kind", Measurement{Kind: "color", Value: 12}, true},
+		{"wrong_unit", Measurement{Kind: KindTemperature, Unit: "SG", Value: 1.050}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DB.Create(&tt.m).Error; (err != nil) != tt.wantErr {
+				t.Errorf("Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,14 +1,13 @@
 package models
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/nicolaspernoud/malt_app/internal/auth"
 	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
 	"github.com/qor/roles"
 )
 
@@ -20,53 +19,90 @@ var (
 // Recipe is a beer recipe
 type Recipe struct {
 	gorm.Model
-	Name string
+	Name         string
+	BatchSize    float64 // L
+	Efficiency   float64 // %
+	IBUFormula   string
+	BoilTime     int // min
+	Fermentables []Fermentable
+	Hops         []Hop
+	Yeasts       []Yeast
+	MashSteps    []MashStep
+
+	// The expected durations, in days, reserving the containers of the planned batches
+	FermentationDays int
+	ConditioningDays int
 }
 
 // Batch is made from a recipe and has a list of events altering (or not) it's volume
 type Batch struct {
 	gorm.Model
-	Recipe        Recipe `gorm:"foreignkey:RecipeID;not null"`
-	RecipeID      uint   `gorm:"not null"`
-	Date          time.Time
-	Step          string
-	StartVolume   int
-	CurrentVolume int
-	Events        []Event
-	Transfers     []Transfer
-	Sales         []Sale
-	Stock         string
+	Recipe              Recipe `gorm:"foreignkey:RecipeID;not null"`
+	RecipeID            uint   `gorm:"not null"`
+	RecipeSnapshot      string `gorm:"type:text"`
+	Date                time.Time
+	Step                string
+	StartVolume         int
+	CurrentVolume       int
+	LabourHours         float64 // the hours worked on the batch, costed at the overhead rate
+	Events              []Event
+	Transfers           []Transfer
+	Sales               []Sale
+	PackagingRuns       []PackagingRun
+	StepChanges         []StepChange
+	Measurements        []Measurement
+	Consumptions        []Consumption
+	Reservations        []Reservation
+	Stock               string
+	Stocks              []StockLine `gorm:"-"`
+	ApparentAttenuation float64     `gorm:"-"` // %
+	ABV                 float64     `gorm:"-"` // %
+	BlendedFrom         string      `gorm:"-"`
+	BlendedInto         string      `gorm:"-"`
+	Packaged            string      `gorm:"-"` // units left of each packaging format
 }
 
 // Event is attached to a batch and can alter its volume
 type Event struct {
 	gorm.Model
-	BatchID uint
-	Name    string
-	Date    time.Time
-	Volume  int
+	BatchID     uint
+	Name        string
+	Date        time.Time
+	Volume      int
+	Container   Container `gorm:"foreignkey:ContainerID;association_autoupdate:false;association_autocreate:false"` // the container the batch was brewed into if none
+	ContainerID uint
+	Kind        string // the inventory adjustments are tagged as losses or gains
+	User        string
 }
 
 // Transfer is a special event attached to a batch and can alter its stock
 type Transfer struct {
 	gorm.Model
-	BatchID uint
-	Date    time.Time
-	From    Container `gorm:"foreignkey:FromID"`
-	FromID  uint
-	To      Container `gorm:"foreignkey:ToID"`
-	ToID    uint
-	Volume  int
+	BatchID  uint
+	Date     time.Time
+	From     Container `gorm:"foreignkey:FromID"`
+	FromID   uint
+	To       Container `gorm:"foreignkey:ToID"`
+	ToID     uint
+	Volume   int
+	Override bool // an admin allowed the transfer into a container not sanitized
 }
 
-// Sale is a special event attached to a batch and can alter its stock
+// Sale is a special event attached to a batch and can alter its stock, either a volume sold from a container or units of a packaging format
 type Sale struct {
 	gorm.Model
-	BatchID uint
-	Date    time.Time
-	From    Container `gorm:"foreignkey:FromID"`
-	FromID  uint
-	Volume  int
+	BatchID    uint
+	Date       time.Time
+	From       Container `gorm:"foreignkey:FromID"`
+	FromID     uint
+	Volume     int
+	Format     PackagingFormat `gorm:"foreignkey:FormatID;association_autoupdate:false;association_autocreate:false"`
+	FormatID   uint
+	Units      int
+	Liters     float64  // the liter equivalent of the volume or units sold
+	Customer   Customer `gorm:"association_autoupdate:false;association_autocreate:false"`
+	CustomerID uint
+	Kegs       []Keg `gorm:"many2many:sale_kegs;association_autoupdate:false;association_autocreate:false"` // the serials of the kegs sold
 }
 
 // Container is where the beer is stored
@@ -74,62 +110,57 @@ type Container struct {
 	gorm.Model
 	Name   string
 	Volume int
+	State  string
+	Filled int    `gorm:"-"`
+	Stock  string `gorm:"-"`
 }
 
-// AfterFind calculates the batch volumes according to the events
-func (b *Batch) AfterFind() (err error) {
-	b.Stock = "brew not yet fermented"
-	if b.Step == "mixed" {
-		b.CurrentVolume = 0
-		return
-	}
-	// Work out the fermentation tank volume
-	var events []Event
-	DB.Where("batch_id = ?", b.ID).Find(&events)
-	b.CurrentVolume = b.StartVolume
-	for _, e := range events {
-		b.CurrentVolume += e.Volume
-	}
-	// Work out the stocks between containers ; TODO : check that volumes are less than the fermentation tank volume
-	if b.Step != "fermented" {
-		return
-	}
-	var containers []Container
-	DB.Find(&containers)
-	m := make(map[string]int)
-	// Get the transfers
-	var transfers []Transfer
-	DB.Preload("From").Preload("To").Where("batch_id = ?", b.ID).Find(&transfers)
-	// Get the sales
-	var sales []Sale
-	DB.Preload("From").Where("batch_id = ?", b.ID).Find(&sales)
-	// Init the stock with the fermenter volume
-	m["Fermenter"] = b.CurrentVolume
-	// For each volumes sustract the froms and add the to
-	for _, t := range transfers {
-		m[t.From.Name] -= t.Volume
-		m[t.To.Name] += t.Volume
-	}
-	for _, s := range sales {
-		m[s.From.Name] -= s.Volume
-	}
-	var stocks string
-	for key, val := range m {
-		stocks += fmt.Sprintf("%s: %s, ", key, strconv.Itoa(val))
+// InitDB opens the business database and migrates the models
+func InitDB(path string) {
+	// The transactions take the write lock as they begin, so that concurrent saves wait for each other instead of failing on a locked database
+	DB, _ = gorm.Open("sqlite3", path+"?_txlock=immediate")
+	models := []interface{}{&Recipe{}, &Batch{}, &Event{}, &Transfer{}, &Container{}, &Sale{}, &StockEntry{}, &StepChange{}, &Fermentable{}, &Hop{}, &Yeast{}, &MashStep{}, &Measurement{}, &Device{}, &DeviceAssignment{}, &Alert{}, &Supplier{}, &Ingredient{}, &Delivery{}, &Lot{}, &Consumption{}, &StockMovement{}, &Blend{}, &BlendSource{}, &PackagingFormat{}, &PackagingRun{}, &Customer{}, &PriceList{}, &Price{}, &Order{}, &OrderLine{}, &Invoice{}, &InvoiceSequence{}, &ExciseRate{}, &InventoryCount{}, &InventoryCountLine{}, &Keg{}, &KegFill{}, &KegDeposit{}, &CleaningOperation{}, &Reservation{}, &CalendarFeed{}, &OverheadRate{}}
+	DB.AutoMigrate(models...)
+
+	// Move the batches from the former steps to the lifecycle ones
+	DB.Exec("UPDATE batches SET step = ? WHERE step = ?", StepFermenting, "brewed")
+	DB.Exec("UPDATE batches SET step = ? WHERE step = ?", StepConditioning, "fermented")
+	// The batches without step were brewed already, the ones with sales can still be sold
+	DB.Exec("UPDATE batches SET step = ? WHERE step = '' AND id IN (SELECT batch_id FROM sales WHERE deleted_at IS NULL)", StepConditioning)
+	DB.Exec("UPDATE batches SET step = ? WHERE step = ''", StepFermenting)
+	// The planned batches hold no beer until brewed
+	DB.Exec("DELETE FROM stock_entries WHERE source_type = ? AND batch_id IN (SELECT id FROM batches WHERE step = ?)", sourceBatch, StepPlanned)
+
+	// Give the sales made before the packaging formats their liter equivalent
+	DB.Exec("UPDATE sales SET liters = volume WHERE COALESCE(format_id, 0) = 0 AND COALESCE(liters, 0) = 0")
+
+	// Snapshot the recipes of the batches created before the snapshots
+	var unsnapshotted []Batch
+	DB.Where("COALESCE(recipe_snapshot, '') = ''").Find(&unsnapshotted)
+	for _, b := range unsnapshotted {
+		if snapshot, err := snapshotRecipe(DB, b.RecipeID); err == nil {
+			DB.Model(&b).UpdateColumn("recipe_snapshot", snapshot)
+		}
 	}
-	b.Stock = strings.TrimSuffix(stocks, ", ")
-	return
+
+	// Give the devices made before the gravity units the unit of the gravity readings they posted
+	DB.Exec("UPDATE devices SET gravity_unit = ? WHERE COALESCE(gravity_unit, '') = '' AND name IN (SELECT source FROM measurements WHERE kind = ? AND unit = ?)", "°P", KindGravity, "°P")
+	DB.Exec("UPDATE devices SET gravity_unit = ? WHERE COALESCE(gravity_unit, '') = ''", GravityUnits[0])
+
+	// Create the fermenter container if it doesn't exists
+	DB.FirstOrCreate(&Container{}, Container{Name: FermenterName})
+
+	// Give the containers made before the states the state of their content, the empty ones having to be cleaned before use
+	var stateless []uint
+	DB.Model(&Container{}).Where("COALESCE(state, '') = ''").Pluck("id", &stateless)
+	DB.Model(&Container{}).Where("id IN (?)", stateless).UpdateColumn("state", StateEmptyDirty)
+	refreshStates(DB, stateless...)
 }
 
 // CreateAdmin creates an admin based on the models
 func CreateAdmin(siteName string) *admin.Admin {
 	// Set up the business database
-	DB, _ = gorm.Open("sqlite3", "./data/business.db")
-	models := []interface{}{&Recipe{}, &Batch{}, &Event{}, &Transfer{}, &Container{}, &Sale{}}
-	DB.AutoMigrate(models...)
-
-	// Create the fermenter container if it doesn't exists
-	DB.FirstOrCreate(&Container{}, Container{Name: "Fermenter"})
+	InitDB("./data/business.db")
 
 	// Initialize
 	Admin := admin.New(&admin.AdminConfig{
@@ -144,7 +175,71 @@ func CreateAdmin(siteName string) *admin.Admin {
 	Admin.AddResource(&Container{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
 
 	batch := Admin.GetResource("Batch")
-	batch.Meta(&admin.Meta{Name: "Step", Type: "select_one", Config: &admin.SelectOneConfig{Collection: []string{"mixed", "brewed", "fermented"}}})
+	configureLifecycle(batch)
+	configureRecipe(Admin.GetResource("Recipe"), batch)
+	configureEstimates(Admin.GetResource("Recipe"))
+	configureBeerXML(Admin.GetResource("Recipe"))
+	configureBeerJSON(Admin.GetResource("Recipe"), batch)
+	configureMeasurements(Admin, batch)
+	configureSensors(Admin)
+	configureAlerts(Admin)
+	configureInventory(Admin, Admin.GetResource("Recipe"), batch, Admin.GetResource("Container"))
+	configureTraceability(Admin.GetResource("Lot"), batch)
+	configureBlends(Admin, batch)
+	configurePackaging(Admin, batch)
+	configureInvoicing(Admin)
+	configureExcise(Admin)
+	configureDRM(Admin)
+	configureStockSnapshots(batch)
+	configureInventoryCounts(Admin, batch)
+	configureKegs(Admin, batch)
+	configureCleaning(Admin, batch, Admin.GetResource("Container"))
+	configurePlanning(Admin, Admin.GetResource("Recipe"), batch)
+	configureCalendar(Admin)
+	configureCosts(Admin, batch)
+	batch.IndexAttrs("-RecipeSnapshot", "-Measurements", "-Consumptions", "-BlendedFrom", "-BlendedInto", "-PackagingRuns", "-Reservations", "-LabourHours")
+	batch.Meta(&admin.Meta{Name: "Stocks", Type: "stock_table", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+
+	// Work out the batches volumes from the stock ledger and their attenuation from their readings, with one query for a whole page
+	findMany := batch.FindManyHandler
+	batch.FindManyHandler = func(result interface{}, context *qor.Context) error {
+		if err := findMany(result, context); err != nil {
+			return err
+		}
+		if batches, ok := result.(*[]*Batch); ok {
+			if err := LoadBatches(context.GetDB().New(), *batches...); err != nil {
+				return err
+			}
+			// The stock filter gives the stocks as of a day
+			if day := stockDay(context.Request); !day.IsZero() {
+				if err := LoadStockAt(context.GetDB().New(), day, *batches...); err != nil {
+					return err
+				}
+				return LoadPackagedAt(context.GetDB().New(), day, *batches...)
+			}
+		}
+		return nil
+	}
+	findOne := batch.FindOneHandler
+	batch.FindOneHandler = func(result interface{}, metaValues *resource.MetaValues, context *qor.Context) error {
+		if err := findOne(result, metaValues, context); err != nil {
+			return err
+		}
+		if b, ok := result.(*Batch); ok {
+			return LoadBatches(context.GetDB().New(), b)
+		}
+		return nil
+	}
+	save := batch.SaveHandler
+	batch.SaveHandler = func(result interface{}, context *qor.Context) error {
+		if err := save(result, context); err != nil {
+			return err
+		}
+		if b, ok := result.(*Batch); ok {
+			return LoadBatches(context.GetDB().New(), b)
+		}
+		return nil
+	}
 
 	/*transferMeta := batch.Meta(&admin.Meta{Name: "Transfers"})
 	transfer := transferMeta.Resource
@@ -158,6 +253,20 @@ func CreateAdmin(siteName string) *admin.Admin {
 	return Admin
 }
 
+// LoadBatches works out the batches fields that are not stored: their stock, the values worked out from their readings, their blends and their packaged units
+func LoadBatches(db *gorm.DB, batches ...*Batch) error {
+	if err := LoadStock(db, batches...); err != nil {
+		return err
+	}
+	if err := LoadReadings(db, batches...); err != nil {
+		return err
+	}
+	if err := LoadBlends(db, batches...); err != nil {
+		return err
+	}
+	return LoadPackaged(db, batches...)
+}
+
 /*func getContainersAsOptions(_ interface{}, context *admin.Context) (options [][]string) {
 	options = append(options, []string{"0", "Fermenter"})
 	var containers []Container
@@ -169,3 +278,11 @@ func CreateAdmin(siteName string) *admin.Admin {
 	}
 	return options
 }*/
+
+// keyOf gives the foreign key, or else the key of its association: the admin sets the associations, their keys are only set once saved
+func keyOf(key uint, association uint) uint {
+	if key == 0 {
+		return association
+	}
+	return key
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nicolaspernoud/malt_app/internal/brewcalc"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+	"github.com/qor/roles"
+	"github.com/qor/validations"
+)
+
+// Packaging kinds
+const (
+	KindBottle = "Bottle"
+	KindCan    = "Can"
+	KindKeg    = "Keg"
+)
+
+// PackagingKinds are the kinds of packaging formats
+var PackagingKinds = []string{KindBottle, KindCan, KindKeg}
+
+// Packaging errors
+const (
+	errNoPackaging         = "Packaging is not allowed at this batch step"
+	errPackagingEmpty      = "A packaging run needs a format, a volume and units"
+	errPackagingOverfilled = "The units hold more than the volume taken"
+	errNotEnoughUnits      = "There are not enough packaged units of this format"
+)
+
+// PackagingFormat is a unit the beer is sold in, as a 33cl bottle or a 20L keg
+type PackagingFormat struct {
+	gorm.Model
+	Name     string
+	Kind     string
+	Volume   float64 // L per unit
+	UnitCost float64 // € per unit, the packaging materials as the bottle, the cap and the label
+}
+
+// PackagingRun fills units of a format with a volume of a batch taken from a container, the rest being lost
+type PackagingRun struct {
+	gorm.Model
+	BatchID  uint `gorm:"index"`
+	Date     time.Time
+	From     Container `gorm:"foreignkey:FromID;association_autoupdate:false;association_autocreate:false"`
+	FromID   uint
+	Format   PackagingFormat `gorm:"foreignkey:FormatID;association_autoupdate:false;association_autocreate:false"`
+	FormatID uint            `gorm:"index"`
+	Volume   int             // L taken from the container
+	Units    int
+	Losses   float64 // L, the volume not filled into units
+}
+
+// BeforeSave checks the batch step and the units filled, and works out the losses
+func (p *PackagingRun) BeforeSave(tx *gorm.DB) error {
+	if err := checkStepAllows(tx, p, p.BatchID); err != nil {
+		return err
+	}
+	p.FromID = keyOf(p.FromID, p.From.ID)
+	p.FormatID = keyOf(p.FormatID, p.Format.ID)
+	if p.FormatID == 0 || p.Volume <= 0 || p.Units <= 0 {
+		return validations.NewError(p, "Units", errPackagingEmpty)
+	}
+	var format PackagingFormat
+	if err := tx.New().First(&format, p.FormatID).Error; err != nil {
+		return err
+	}
+	filled := float64(p.Units) * format.Volume
+	p.Losses = brewcalc.Round(float64(p.Volume)-filled, 2)
+	if p.Losses < 0 {
+		return validations.NewError(p, "Units", errPackagingOverfilled)
+	}
+	return nil
+}
+
+// AfterSave records the volume taken into the stock ledger and checks the resulting stocks
+func (p *PackagingRun) AfterSave(tx *gorm.DB) error {
+	if err := recordEntries(tx, sourcePackaging, p, p.ID); err != nil {
+		return err
+	}
+	return checkStock(tx, p)
+}
+
+// AfterDelete removes the packaging run from the stock ledger, and checks that its units were not sold
+func (p *PackagingRun) AfterDelete(tx *gorm.DB) error {
+	if err := removeEntries(tx, sourcePackaging, p.ID); err != nil {
+		return err
+	}
+	return validateUnits(tx, p, p.BatchID, p.FormatID)
+}
+
+// prepareSale works out the liter equivalent of a sale, a sale of units taking no volume from a container as it was taken by their packaging run
+func prepareSale(tx *gorm.DB, s *Sale) error {
+	s.FormatID = keyOf(s.FormatID, s.Format.ID)
+	if s.FormatID == 0 {
+		s.Units = 0
+		s.Liters = float64(s.Volume)
+		return nil
+	}
+	var format PackagingFormat
+	if err := tx.New().First(&format, s.FormatID).Error; err != nil {
+		return err
+	}
+	s.FromID, s.Volume = 0, 0
+	s.Liters = brewcalc.Round(float64(s.Units)*format.Volume, 2)
+	return nil
+}
+
+// validateUnits checks that no more units of a batch format were sold than packaged
+func validateUnits(tx *gorm.DB, record interface{}, batchID uint, formatID uint) error {
+	if batchID == 0 || formatID == 0 {
+		return nil
+	}
+	var packaged, sold struct{ Units int }
+	if err := tx.Table("packaging_runs").Select("COALESCE(SUM(units), 0) AS units").Where("batch_id = ? AND format_id = ? AND deleted_at IS NULL", batchID, formatID).Scan(&packaged).Error; err != nil {
+		return err
+	}
+	if err := tx.Table("sales").Select("COALESCE(SUM(units), 0) AS units").Where("batch_id = ? AND format_id = ? AND deleted_at IS NULL", batchID, formatID).Scan(&sold).Error; err != nil {
+		return err
+	}
+	if sold.Units > packaged.Units {
+		return validations.NewError(record, "Units", errNotEnoughUnits)
+	}
+	return nil
+}
+
+// LoadPackaged works out the units left of each format packaged for the given batches, with a query for the runs and one for the sales
+func LoadPackaged(db *gorm.DB, batches ...*Batch) error {
+	return LoadPackagedAt(db, time.Time{}, batches...)
+}
+
+// LoadPackagedAt works out the units left of each format packaged for the given batches as of the end of the day
+func LoadPackagedAt(db *gorm.DB, day time.Time, batches ...*Batch) error {
+	if len(batches) == 0 {
+		return nil
+	}
+	var ids []uint
+	for _, b := range batches {
+		ids = append(ids, b.ID)
+	}
+	type units struct {
+		BatchID uint
+		Format  string
+		Units   int
+	}
+	var packaged, sold []units
+	if err := asOf(db.Table("packaging_runs"), "packaging_runs", day).Select("packaging_runs.batch_id, packaging_formats.name AS format, SUM(packaging_runs.units) AS units").
+		Joins("JOIN packaging_formats ON packaging_formats.id = packaging_runs.format_id").
+		Where("packaging_runs.deleted_at IS NULL AND packaging_runs.batch_id IN (?)", ids).
+		Group("packaging_runs.batch_id, packaging_formats.name").Order("packaging_formats.name").Scan(&packaged).Error; err != nil {
+		return err
+	}
+	if err := asOf(db.Table("sales"), "sales", day).Select("sales.batch_id, packaging_formats.name AS format, SUM(sales.units) AS units").
+		Joins("JOIN packaging_formats ON packaging_formats.id = sales.format_id").
+		Where("sales.deleted_at IS NULL AND sales.batch_id IN (?)", ids).
+		Group("sales.batch_id, packaging_formats.name").Scan(&sold).Error; err != nil {
+		return err
+	}
+	for _, b := range batches {
+		var lines []string
+		for _, p := range packaged {
+			if p.BatchID != b.ID {
+				continue
+			}
+			left := p.Units
+			for _, s := range sold {
+				if s.BatchID == p.BatchID && s.Format == p.Format {
+					left -= s.Units
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s: %d", p.Format, left))
+		}
+		b.Packaged = strings.Join(lines, ", ")
+	}
+	return nil
+}
+
+// configurePackaging adds the packaging formats settings, the packaging runs of the batches and the units sold
+func configurePackaging(Admin *admin.Admin, batch *admin.Resource) {
+	format := Admin.AddResource(&PackagingFormat{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	format.Meta(&admin.Meta{Name: "Kind", Type: "select_one", Config: &admin.SelectOneConfig{Collection: PackagingKinds}})
+	format.Meta(&admin.Meta{Name: "Volume", Label: "Volume (L per unit)"})
+
+	noop := func(interface{}, *resource.MetaValue, *qor.Context) {}
+	runs := batch.Meta(&admin.Meta{Name: "PackagingRuns"}).Resource
+	runs.EditAttrs("Date", "From", "Format", "Volume", "Units", "Losses")
+	runs.NewAttrs("Date", "From", "Format", "Volume", "Units")
+	runs.Meta(&admin.Meta{Name: "Losses", Type: "readonly", Setter: noop})
+	sales := batch.Meta(&admin.Meta{Name: "Sales"}).Resource
+	sales.Meta(&admin.Meta{Name: "Liters", Type: "readonly", Setter: noop})
+	batch.Meta(&admin.Meta{Name: "Packaged", Type: "readonly", Setter: noop})
+}
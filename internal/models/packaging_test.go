@@ -0,0 +1,86 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPackaging(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	fermenter, _ := fermenterID(DB)
+	bottle := PackagingFormat{Name: "Bottle 33cl", Kind: KindBottle, Volume: 0.33}
+	keg := PackagingFormat{Name: "Keg 20L", Kind: KindKeg, Volume: 20}
+	DB.Create(&bottle)
+	DB.Create(&keg)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 60, Date: date}
+	DB.Create(&b)
+	planned := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepPlanned, StartVolume: 20, Date: date}
+	DB.Create(&planned)
+
+	tests := []struct {
+		name       string
+		run        PackagingRun
+		wantErr    bool
+		wantLosses float64
+	}{
+		{"not_at_step", PackagingRun{BatchID: planned.ID, FromID: fermenter, FormatID: bottle.ID, Volume: 10, Units: 24}, true, 0},
+		{"no_units", PackagingRun{BatchID: b.ID, FromID: fermenter, FormatID: bottle.ID, Volume: 10}, true, 0},
+		{"overfilled", PackagingRun{BatchID: b.ID, FromID: fermenter, FormatID: bottle.ID, Volume: 10, Units: 31}, true, 0},
+		{"not_enough_beer", PackagingRun{BatchID: b.ID, FromID: fermenter, FormatID: keg.ID, Volume: 80, Units: 4}, true, 0},
+		{"bottles", PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Volume: 10, Units: 24}, false, 2.08},
+		{"kegs", PackagingRun{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: keg.ID, Volume: 40, Units: 2}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DB.Create(&tt.run).Error; (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.run.Losses != tt.wantLosses {
+				t.Errorf("got losses %v, want %v", tt.run.Losses, tt.wantLosses)
+			}
+		})
+	}
+
+	// Units sold take no volume from a container, and can't exceed the units packaged
+	sale := Sale{BatchID: b.ID, Date: date, FromID: fermenter, FormatID: bottle.ID, Units: 20, Volume: 5}
+	if err := DB.Create(&sale).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sale.Liters != 6.6 || sale.Volume != 0 || sale.FromID != 0 {
+		t.Errorf("got sale of %v L (volume %v from %v), want 6.6 L from no container", sale.Liters, sale.Volume, sale.FromID)
+	}
+	if err := DB.Create(&Sale{BatchID: b.ID, Date: date, FormatID: bottle.ID, Units: 5}).Error; err == nil {
+		t.Error("got no error selling more units than packaged")
+	}
+	bulk := Sale{BatchID: b.ID, Date: date, FromID: fermenter, Volume: 5}
+	if err := DB.Create(&bulk).Error; err != nil || bulk.Liters != 5 {
+		t.Errorf("got bulk sale of %v L, error %v, want 5 L", bulk.Liters, err)
+	}
+
+	check := func() {
+		t.Helper()
+		var got Batch
+		DB.First(&got, b.ID)
+		if err := LoadBatches(DB, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Stock != "Fermenter: 5" || got.Packaged != "Bottle 33cl: 4, Keg 20L: 2" {
+			t.Errorf("got stock %v and packaged %v, want 5 L left and the unsold units", got.Stock, got.Packaged)
+		}
+	}
+	check()
+	if err := RebuildLedger(DB); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// A run can't be reduced below the units sold
+	var run PackagingRun
+	DB.Where("format_id = ?", bottle.ID).First(&run)
+	run.Units = 10
+	if err := DB.Save(&run).Error; err == nil {
+		t.Error("got no error packaging fewer units than sold")
+	}
+}
@@ -0,0 +1,453 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/validations"
+)
+
+// Reservation phases
+const (
+	PhaseFermentation = "Fermentation"
+	PhaseConditioning = "Conditioning"
+)
+
+// Phases are the phases a batch reserves a container for
+var Phases = []string{PhaseFermentation, PhaseConditioning}
+
+// Default durations, in days, of the phases of the recipes giving none
+var (
+	DefaultFermentationDays = 14
+	DefaultConditioningDays = 14
+)
+
+// Planning errors
+const (
+	errReservationDates    = "A reservation must end after it starts"
+	errReservationConflict = "The container is already booked"
+	errScheduleNotPlanned  = "Only the planned batches can be scheduled"
+	errContainerHeld       = "The container holds a batch until it is emptied"
+)
+
+// Reservation books a container for a phase of a batch
+type Reservation struct {
+	gorm.Model
+	BatchID     uint
+	Phase       string
+	Container   Container `gorm:"association_autoupdate:false;association_autocreate:false"`
+	ContainerID uint
+	Start       time.Time
+	End         time.Time
+}
+
+// Occupation is a period a container is busy, reserved for a phase of a batch or holding it
+type Occupation struct {
+	Batch Batch
+	Phase string // the phase of a reservation, none when the container holds the batch
+	Start time.Time
+	End   time.Time // none while the container still holds the batch
+}
+
+// Overlaps tells if the occupation overlaps the period
+func (o Occupation) Overlaps(start, end time.Time) bool {
+	return o.Start.Before(end) && (o.End.IsZero() || start.Before(o.End))
+}
+
+// Label names the batch, and the phase of a reservation
+func (o Occupation) Label() string {
+	if o.Phase == "" {
+		return o.Batch.Stringify()
+	}
+	return o.Batch.Stringify() + " (" + o.Phase + ")"
+}
+
+// phaseDays gives the expected duration of the phase, from the recipe of the batch
+func phaseDays(b Batch, phase string) int {
+	recipe, _ := b.SnapshotRecipe()
+	if phase == PhaseConditioning {
+		if recipe.ConditioningDays > 0 {
+			return recipe.ConditioningDays
+		}
+		return DefaultConditioningDays
+	}
+	if recipe.FermentationDays > 0 {
+		return recipe.FermentationDays
+	}
+	return DefaultFermentationDays
+}
+
+// Occupations gives the periods the container is reserved, or holds beer from the stock ledger, leaving out the given batch.
+// A container still holding a batch is busy with no end, until the ledger shows it empty.
+func Occupations(db *gorm.DB, containerID, except uint) ([]Occupation, error) {
+	var reservations []Reservation
+	if err := db.Where("container_id = ? AND batch_id <> ?", containerID, except).Order("start").Find(&reservations).Error; err != nil {
+		return nil, err
+	}
+	var entries []StockEntry
+	if err := db.Where("container_id = ? AND batch_id <> ?", containerID, except).Order("date, id").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	var ids []uint
+	for _, r := range reservations {
+		ids = append(ids, r.BatchID)
+	}
+	for _, e := range entries {
+		ids = append(ids, e.BatchID)
+	}
+	batches := map[uint]Batch{}
+	if len(ids) > 0 {
+		var found []Batch
+		if err := db.Where("id IN (?)", ids).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for _, b := range found {
+			batches[b.ID] = b
+		}
+	}
+
+	var occupations []Occupation
+	for _, r := range reservations {
+		b, ok := batches[r.BatchID]
+		if !ok {
+			continue
+		}
+		occupations = append(occupations, Occupation{Batch: b, Phase: r.Phase, Start: r.Start, End: r.End})
+	}
+	volumes, starts := map[uint]int{}, map[uint]time.Time{}
+	for _, e := range entries {
+		before := volumes[e.BatchID]
+		volumes[e.BatchID] += e.Volume
+		switch {
+		case before <= 0 && volumes[e.BatchID] > 0:
+			starts[e.BatchID] = e.Date
+		case before > 0 && volumes[e.BatchID] <= 0:
+			occupations = append(occupations, Occupation{Batch: batches[e.BatchID], Start: starts[e.BatchID], End: e.Date})
+		}
+	}
+	for id, volume := range volumes {
+		if volume > 0 {
+			occupations = append(occupations, Occupation{Batch: batches[id], Start: starts[id]})
+		}
+	}
+	sort.Slice(occupations, func(i, j int) bool { return occupations[i].Start.Before(occupations[j].Start) })
+	return occupations, nil
+}
+
+// earliestSlot gives the earliest start, from the given one, of a period of the given duration free of the occupations,
+// or none if it would overlap a batch the container still holds
+func earliestSlot(occupations []Occupation, from time.Time, duration time.Duration) time.Time {
+	start := from
+	for moved := true; moved; {
+		moved = false
+		for _, o := range occupations {
+			if o.Overlaps(start, start.Add(duration)) {
+				if o.End.IsZero() {
+					return time.Time{}
+				}
+				start, moved = o.End, true
+			}
+		}
+	}
+	return start
+}
+
+// EarliestSlot gives the earliest start, from the given one, of a period of the given days the container is free, leaving out the given batch.
+// There is none while the container holds a batch from before the end of the period.
+func EarliestSlot(db *gorm.DB, containerID, except uint, from time.Time, days int) (time.Time, error) {
+	occupations, err := Occupations(db, containerID, except)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return earliestSlot(occupations, from, time.Duration(days)*24*time.Hour), nil
+}
+
+// BeforeSave dates the reservation from the batch and its recipe durations if needed, and checks that the container is free
+func (r *Reservation) BeforeSave(tx *gorm.DB) error {
+	tx = tx.New()
+	r.ContainerID = keyOf(r.ContainerID, r.Container.ID)
+	if r.Phase == "" {
+		r.Phase = PhaseFermentation
+	}
+	var b Batch
+	if err := tx.First(&b, r.BatchID).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	if r.Start.IsZero() {
+		r.Start = b.Date
+		if r.Phase == PhaseConditioning {
+			r.Start = r.Start.AddDate(0, 0, phaseDays(b, PhaseFermentation))
+		}
+	}
+	if r.End.IsZero() {
+		r.End = r.Start.AddDate(0, 0, phaseDays(b, r.Phase))
+	}
+	if !r.End.After(r.Start) {
+		return validations.NewError(r, "End", errReservationDates)
+	}
+	occupations, err := Occupations(tx, r.ContainerID, r.BatchID)
+	if err != nil {
+		return err
+	}
+	for _, o := range occupations {
+		if o.Overlaps(r.Start, r.End) {
+			slot := earliestSlot(occupations, r.Start, r.End.Sub(r.Start))
+			if slot.IsZero() {
+				return validations.NewError(r, "Container", fmt.Sprintf("%s : %s, since %s", errContainerHeld, o.Label(), o.Start.Format("2006-01-02")))
+			}
+			return validations.NewError(r, "Container", fmt.Sprintf("%s : %s, %s - %s. The earliest free slot starts on %s", errReservationConflict, o.Label(), o.Start.Format("2006-01-02"), o.End.Format("2006-01-02"), slot.Format("2006-01-02")))
+		}
+	}
+	return nil
+}
+
+// AfterSave moves a brewed batch into the fermenter reserved for its fermentation
+func (r *Reservation) AfterSave(tx *gorm.DB) error {
+	return syncReservedBatch(tx, r)
+}
+
+// AfterDelete moves a brewed batch back out of the fermenter it no longer reserves
+func (r *Reservation) AfterDelete(tx *gorm.DB) error {
+	return syncReservedBatch(tx, r)
+}
+
+// syncReservedBatch regenerates the ledger entries of the brewed batch of a fermentation reservation, which start in the reserved fermenter
+func syncReservedBatch(tx *gorm.DB, r *Reservation) error {
+	if r.BatchID == 0 || r.Phase != PhaseFermentation {
+		return nil
+	}
+	tx = tx.New()
+	var b Batch
+	if err := tx.First(&b, r.BatchID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if b.Step == StepPlanned {
+		return nil
+	}
+	if err := syncBatchLedger(tx, &b); err != nil {
+		return err
+	}
+	return checkStartContainer(tx, &b)
+}
+
+// ScheduleBatch reserves the containers of a planned batch at the earliest free slots from its date : the fermenter for the fermentation, then the conditioning container right after.
+// The former reservations of the batch are replaced, and the batch is moved to the start of its fermentation.
+func ScheduleBatch(db *gorm.DB, batchID, fermenterID, conditioningID uint) ([]Reservation, error) {
+	tx := db.New().Begin()
+	reservations, err := scheduleBatch(tx, batchID, fermenterID, conditioningID, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return reservations, tx.Commit().Error
+}
+
+// scheduleBatch schedules the batch within a transaction
+func scheduleBatch(tx *gorm.DB, batchID, fermenterID, conditioningID uint, now time.Time) ([]Reservation, error) {
+	var b Batch
+	if err := tx.First(&b, batchID).Error; err != nil {
+		return nil, err
+	}
+	if b.Step != StepPlanned {
+		return nil, validations.NewError(&b, "Step", errScheduleNotPlanned)
+	}
+	if conditioningID == 0 {
+		conditioningID = fermenterID
+	}
+	fermenting, err := Occupations(tx, fermenterID, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	conditioning, err := Occupations(tx, conditioningID, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	fermentation := time.Duration(phaseDays(b, PhaseFermentation)) * 24 * time.Hour
+	conditioningDuration := time.Duration(phaseDays(b, PhaseConditioning)) * 24 * time.Hour
+	// Move the fermentation later until the conditioning container is free when it ends
+	from := b.Date
+	if today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()); from.Before(today) {
+		from = today
+	}
+	var start time.Time
+	for {
+		start = earliestSlot(fermenting, from, fermentation)
+		if start.IsZero() {
+			return nil, validations.NewError(&b, "Fermenter", errContainerHeld)
+		}
+		next := earliestSlot(conditioning, start.Add(fermentation), conditioningDuration)
+		if next.IsZero() {
+			return nil, validations.NewError(&b, "Conditioning", errContainerHeld)
+		}
+		if next.Equal(start.Add(fermentation)) {
+			break
+		}
+		from = next.Add(-fermentation)
+	}
+
+	if err := tx.Where("batch_id = ?", b.ID).Delete(Reservation{}).Error; err != nil {
+		return nil, err
+	}
+	if !start.Equal(b.Date) {
+		b.Date = start
+		if err := tx.Model(&b).UpdateColumn("date", start).Error; err != nil {
+			return nil, err
+		}
+		if err := syncBatchLedger(tx, &b); err != nil {
+			return nil, err
+		}
+	}
+	reservations := []Reservation{
+		{BatchID: b.ID, Phase: PhaseFermentation, ContainerID: fermenterID, Start: start, End: start.Add(fermentation)},
+		{BatchID: b.ID, Phase: PhaseConditioning, ContainerID: conditioningID, Start: start.Add(fermentation), End: start.Add(fermentation + conditioningDuration)},
+	}
+	for i := range reservations {
+		if err := tx.Create(&reservations[i]).Error; err != nil {
+			return nil, err
+		}
+	}
+	return reservations, nil
+}
+
+// GanttBar is an occupation on the Gantt chart, placed in percent of the period shown
+type GanttBar struct {
+	Occupation
+	Left  float64
+	Width float64
+}
+
+// GanttRow is a container on the Gantt chart
+type GanttRow struct {
+	Container Container
+	Bars      []GanttBar
+}
+
+// Gantt is the occupation of the containers over a period
+type Gantt struct {
+	From  time.Time
+	To    time.Time
+	Weeks []time.Time
+	Rows  []GanttRow
+}
+
+// PlanningGantt gives the occupations of all the containers for the given weeks from the day
+func PlanningGantt(db *gorm.DB, from time.Time, weeks int) (Gantt, error) {
+	g := Gantt{From: from, To: from.AddDate(0, 0, 7*weeks)}
+	for i := 0; i < weeks; i++ {
+		g.Weeks = append(g.Weeks, from.AddDate(0, 0, 7*i))
+	}
+	var containers []Container
+	if err := db.Order("name").Find(&containers).Error; err != nil {
+		return g, err
+	}
+	span := g.To.Sub(g.From).Hours()
+	for _, c := range containers {
+		occupations, err := Occupations(db, c.ID, 0)
+		if err != nil {
+			return g, err
+		}
+		row := GanttRow{Container: c}
+		for _, o := range occupations {
+			if !o.Overlaps(g.From, g.To) {
+				continue
+			}
+			start, end := o.Start, o.End
+			if start.Before(g.From) {
+				start = g.From
+			}
+			if end.IsZero() || end.After(g.To) {
+				end = g.To
+			}
+			row.Bars = append(row.Bars, GanttBar{Occupation: o, Left: start.Sub(g.From).Hours() * 100 / span, Width: end.Sub(start).Hours() * 100 / span})
+		}
+		g.Rows = append(g.Rows, row)
+	}
+	return g, nil
+}
+
+// scheduleRequest is the argument of the action scheduling a planned batch
+type scheduleRequest struct {
+	Fermenter    uint
+	Conditioning uint
+}
+
+// containerOptions gives the containers to choose from
+func containerOptions(_ interface{}, context *qor.Context) (options [][]string) {
+	var containers []Container
+	context.GetDB().New().Order("name").Find(&containers)
+	for _, c := range containers {
+		options = append(options, []string{strconv.Itoa(int(c.ID)), c.Name})
+	}
+	return options
+}
+
+// configurePlanning adds the expected durations to the recipes, the reservations to the batches, the scheduling action and the planning chart
+func configurePlanning(Admin *admin.Admin, recipe *admin.Resource, batch *admin.Resource) {
+	recipe.Meta(&admin.Meta{Name: "FermentationDays", Label: "Fermentation (days)"})
+	recipe.Meta(&admin.Meta{Name: "ConditioningDays", Label: "Conditioning (days)"})
+
+	reservations := batch.Meta(&admin.Meta{Name: "Reservations"}).Resource
+	reservations.Meta(&admin.Meta{Name: "Phase", Type: "select_one", Config: &admin.SelectOneConfig{Collection: Phases}})
+
+	request := Admin.NewResource(&scheduleRequest{})
+	request.Meta(&admin.Meta{Name: "Fermenter", Type: "select_one", Config: &admin.SelectOneConfig{Collection: containerOptions}})
+	request.Meta(&admin.Meta{Name: "Conditioning", Label: "Conditioning container (the fermenter if none)", Type: "select_one", Config: &admin.SelectOneConfig{Collection: containerOptions}})
+	batch.Action(&admin.Action{
+		Name:       "Reserve containers",
+		Permission: adminsOnly,
+		Modes:      []string{"show", "menu_item"},
+		Resource:   request,
+		Visible: func(record interface{}, context *admin.Context) bool {
+			b, ok := record.(*Batch)
+			return !ok || b.Step == StepPlanned
+		},
+		Handler: func(argument *admin.ActionArgument) error {
+			r, ok := argument.Argument.(*scheduleRequest)
+			if !ok || r.Fermenter == 0 {
+				return errors.New("no fermenter given")
+			}
+			for _, record := range argument.FindSelectedRecords() {
+				b, ok := record.(*Batch)
+				if !ok {
+					return errors.New("not a batch")
+				}
+				if _, err := ScheduleBatch(argument.Context.GetDB(), b.ID, r.Fermenter, r.Conditioning); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	Admin.GetRouter().Get("/planning", func(context *admin.Context) {
+		from, err := parseDay(context.Request.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if from.IsZero() {
+			from = time.Now().AddDate(0, 0, -7)
+		}
+		weeks, _ := strconv.Atoi(context.Request.URL.Query().Get("weeks"))
+		if weeks <= 0 {
+			weeks = 8
+		}
+		gantt, err := PlanningGantt(context.GetDB().New(), time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local), weeks)
+		if err != nil {
+			http.Error(context.Writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		context.Execute("planning", gantt)
+	})
+	Admin.AddMenu(&admin.Menu{Name: "Planning", Link: "/admin/planning", Ancestors: []string{"Batches"}})
+}
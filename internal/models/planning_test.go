@@ -0,0 +1,131 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanning(t *testing.T) {
+	defer initTestDB(t)()
+
+	now := time.Now()
+	base := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, 30)
+	day := func(days int) time.Time { return base.AddDate(0, 0, days) }
+	fv1, fv2, bright := Container{Name: "FV1", Volume: 100}, Container{Name: "FV2", Volume: 100}, Container{Name: "Bright tank", Volume: 100, State: StateSanitized}
+	DB.Create(&fv1)
+	DB.Create(&fv2)
+	DB.Create(&bright)
+	recipe := Recipe{Name: "IPA", FermentationDays: 10, ConditioningDays: 7}
+	DB.Create(&recipe)
+	planned := func() Batch {
+		b := Batch{RecipeID: recipe.ID, Step: StepPlanned, StartVolume: 100, Date: base}
+		DB.Create(&b)
+		return b
+	}
+	a, b, c := planned(), planned(), planned()
+
+	// The batch reserves the fermenter for the fermentation, then the conditioning container right after
+	reservations, err := ScheduleBatch(DB, a.ID, fv1.ID, fv2.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reservations) != 2 || !reservations[0].Start.Equal(day(0)) || !reservations[0].End.Equal(day(10)) || reservations[1].ContainerID != fv2.ID || !reservations[1].End.Equal(day(17)) {
+		t.Errorf("got reservations %+v, want FV1 for 10 days then FV2 for 7 days", reservations)
+	}
+
+	// A conflicting reservation is refused, suggesting the earliest free slot
+	err = DB.Create(&Reservation{BatchID: b.ID, Phase: PhaseFermentation, ContainerID: fv1.ID, Start: day(5)}).Error
+	if err == nil || !strings.Contains(err.Error(), day(10).Format("2006-01-02")) {
+		t.Errorf("got error %v, want a conflict suggesting %s", err, day(10).Format("2006-01-02"))
+	}
+
+	// The batches are moved to the earliest slots where both containers are free
+	if _, err := ScheduleBatch(DB, b.ID, fv1.ID, fv2.ID); err != nil {
+		t.Fatal(err)
+	}
+	DB.First(&b, b.ID)
+	if !b.Date.Equal(day(10)) {
+		t.Errorf("got date %v, want %v", b.Date, day(10))
+	}
+	if _, err := ScheduleBatch(DB, c.ID, fv2.ID, fv1.ID); err != nil {
+		t.Fatal(err)
+	}
+	DB.First(&c, c.ID)
+	if !c.Date.Equal(day(27)) {
+		t.Errorf("got date %v, want %v", c.Date, day(27))
+	}
+
+	// A container holding a batch is busy until it is emptied, refusing the reservations to come
+	d := Batch{RecipeID: recipe.ID, Step: StepConditioning, StartVolume: 100, Date: now.AddDate(0, 0, -10)}
+	DB.Create(&d)
+	DB.Create(&Transfer{BatchID: d.ID, Date: now.AddDate(0, 0, -5), FromID: fermenterIDOf(t), ToID: bright.ID, Volume: 100})
+	occupations, err := Occupations(DB, bright.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occupations) != 1 || occupations[0].Batch.ID != d.ID || !occupations[0].End.IsZero() {
+		t.Errorf("got occupations %+v, want the bright tank held by the conditioning batch with no end", occupations)
+	}
+	err = DB.Create(&Reservation{BatchID: c.ID, Phase: PhaseConditioning, ContainerID: bright.ID, Start: day(60)}).Error
+	if err == nil || !strings.Contains(err.Error(), errContainerHeld) {
+		t.Errorf("got error %v, want the bright tank held by the conditioning batch", err)
+	}
+	if _, err := ScheduleBatch(DB, d.ID, fv1.ID, 0); err == nil {
+		t.Error("got no error scheduling a batch not planned")
+	}
+
+	gantt, err := PlanningGantt(DB, base, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range gantt.Rows {
+		if row.Container.ID == fv1.ID && (len(row.Bars) != 2 || row.Bars[0].Left != 0 || row.Bars[1].Left != 10*100/28.0) {
+			t.Errorf("got FV1 bars %+v, want the fermentations of the first two batches, the third conditioning after the chart", row.Bars)
+		}
+	}
+}
+
+func TestPlanning_BrewIntoReservedFermenter(t *testing.T) {
+	defer initTestDB(t)()
+
+	now := time.Now()
+	fv1, fv2 := Container{Name: "FV1", Volume: 50}, Container{Name: "FV2", Volume: 50}
+	DB.Create(&fv1)
+	DB.Create(&fv2)
+	recipe := Recipe{Name: "IPA"}
+	DB.Create(&recipe)
+	brew := func(volume int, fermenter Container) (Batch, error) {
+		b := Batch{RecipeID: recipe.ID, Step: StepPlanned, StartVolume: volume, Date: now}
+		DB.Create(&b)
+		if err := DB.Create(&Reservation{BatchID: b.ID, Phase: PhaseFermentation, ContainerID: fermenter.ID}).Error; err != nil {
+			t.Fatal(err)
+		}
+		return b, b.ChangeStep(DB, StepBrewing, "USER")
+	}
+
+	// The beer brewed, and its events without container, go into the reserved fermenter
+	b, err := brew(40, fv1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB.Create(&Event{BatchID: b.ID, Name: "Trub loss", Date: now, Volume: -2})
+	var entries []StockEntry
+	DB.Where("batch_id = ?", b.ID).Find(&entries)
+	if len(entries) != 2 || entries[0].ContainerID != fv1.ID || entries[1].ContainerID != fv1.ID {
+		t.Errorf("got entries %+v, want the brew and its loss in FV1", entries)
+	}
+
+	// A batch larger than its reserved fermenter is not brewed
+	if _, err := brew(60, fv2); err == nil || !strings.Contains(err.Error(), errOverCapacity) {
+		t.Errorf("got error %v, want the fermenter over capacity", err)
+	}
+}
+
+func fermenterIDOf(t *testing.T) uint {
+	id, err := fermenterID(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
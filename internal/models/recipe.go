@@ -0,0 +1,123 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor"
+	"github.com/qor/qor/resource"
+)
+
+// Fermentable types, hop uses, yeast types and forms, as in BeerXML
+var (
+	FermentableTypes = []string{"Grain", "Sugar", "Extract", "Dry Extract", "Adjunct"}
+	HopUses          = []string{"Boil", "Dry Hop", "Mash", "First Wort", "Aroma"}
+	YeastTypes       = []string{"Ale", "Lager", "Wheat", "Wine", "Champagne"}
+	YeastForms       = []string{"Liquid", "Dry", "Slant", "Culture"}
+)
+
+// Fermentable is a malt, sugar or extract of a recipe
+type Fermentable struct {
+	gorm.Model
+	RecipeID  uint
+	Name      string
+	Type      string
+	Weight    float64 // kg
+	Color     float64 // EBC
+	Potential float64 // specific gravity of one pound in one gallon, as 1.037
+}
+
+// Hop is a hop addition of a recipe
+type Hop struct {
+	gorm.Model
+	RecipeID uint
+	Name     string
+	Weight   float64 // g
+	Alpha    float64 // %
+	Use      string
+	Time     int // min
+}
+
+// Yeast is a yeast of a recipe
+type Yeast struct {
+	gorm.Model
+	RecipeID       uint
+	Name           string
+	Type           string
+	Form           string
+	Attenuation    float64 // %
+	MinTemperature float64 // °C
+	MaxTemperature float64 // °C
+}
+
+// MashStep is a step of a recipe mash schedule
+type MashStep struct {
+	gorm.Model
+	RecipeID    uint
+	Name        string
+	Temperature float64 // °C
+	Time        int     // min
+}
+
+// PreloadRecipe preloads the recipe ingredients and mash steps
+func PreloadRecipe(db *gorm.DB) *gorm.DB {
+	return db.Preload("Fermentables").Preload("Hops").Preload("Yeasts").Preload("MashSteps")
+}
+
+// AfterCreate snapshots the recipe of the batch, so that later edits of the recipe don't rewrite the batch history
+func (b *Batch) AfterCreate(tx *gorm.DB) error {
+	if b.RecipeSnapshot != "" {
+		return nil
+	}
+	snapshot, err := snapshotRecipe(tx, b.RecipeID)
+	if err != nil {
+		return err
+	}
+	b.RecipeSnapshot = snapshot
+	return tx.Model(b).UpdateColumn("recipe_snapshot", b.RecipeSnapshot).Error
+}
+
+// snapshotRecipe gives the recipe with its ingredients and mash steps as JSON, the deleted recipes included
+func snapshotRecipe(db *gorm.DB, recipeID uint) (string, error) {
+	var recipe Recipe
+	if err := PreloadRecipe(db.New().Unscoped()).First(&recipe, recipeID).Error; err != nil {
+		return "", err
+	}
+	snapshot, err := json.Marshal(recipe)
+	return string(snapshot), err
+}
+
+// SnapshotRecipe returns the recipe as it was when the batch was created, or the current one for the batches created before the snapshots
+func (b *Batch) SnapshotRecipe() (Recipe, error) {
+	var recipe Recipe
+	if b.RecipeSnapshot == "" {
+		err := PreloadRecipe(DB.New().Unscoped()).First(&recipe, b.RecipeID).Error
+		return recipe, err
+	}
+	err := json.Unmarshal([]byte(b.RecipeSnapshot), &recipe)
+	return recipe, err
+}
+
+// configureRecipe sets up the nested ingredients and mash steps of the recipe admin
+func configureRecipe(recipe *admin.Resource, batch *admin.Resource) {
+	fermentables := recipe.Meta(&admin.Meta{Name: "Fermentables"}).Resource
+	fermentables.Meta(&admin.Meta{Name: "Type", Type: "select_one", Config: &admin.SelectOneConfig{Collection: FermentableTypes}})
+	hops := recipe.Meta(&admin.Meta{Name: "Hops"}).Resource
+	hops.Meta(&admin.Meta{Name: "Use", Type: "select_one", Config: &admin.SelectOneConfig{Collection: HopUses}})
+	yeasts := recipe.Meta(&admin.Meta{Name: "Yeasts"}).Resource
+	yeasts.Meta(&admin.Meta{Name: "Type", Type: "select_one", Config: &admin.SelectOneConfig{Collection: YeastTypes}})
+	yeasts.Meta(&admin.Meta{Name: "Form", Type: "select_one", Config: &admin.SelectOneConfig{Collection: YeastForms}})
+
+	batch.Meta(&admin.Meta{Name: "RecipeSnapshot", Type: "readonly", Setter: func(interface{}, *resource.MetaValue, *qor.Context) {}})
+}
+
+// Stringify names the batch after the recipe it was brewed from, to tell the batches apart in the admin
+func (b Batch) Stringify() string {
+	recipe, err := b.SnapshotRecipe()
+	if err != nil || recipe.Name == "" {
+		return fmt.Sprintf("#%d", b.ID)
+	}
+	return fmt.Sprintf("#%d %s", b.ID, recipe.Name)
+}
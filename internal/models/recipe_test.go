@@ -0,0 +1,91 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBatch_SnapshotRecipe(t *testing.T) {
+	defer initTestDB(t)()
+
+	recipe := Recipe{
+		Name:         "Pale Ale",
+		BoilTime:     60,
+		Fermentables: []Fermentable{{Name: "Pale malt", Type: "Grain", Weight: 5, Color: 6, Potential: 1.037}},
+		Hops:         []Hop{{Name: "Cascade", Weight: 40, Alpha: 6, Use: "Boil", Time: 60}},
+		Yeasts:       []Yeast{{Name: "US-05", Attenuation: 78, MinTemperature: 15, MaxTemperature: 24}},
+		MashSteps:    []MashStep{{Name: "Saccharification", Temperature: 67, Time: 60}},
+	}
+	DB.Create(&recipe)
+	b := Batch{RecipeID: recipe.ID, StartVolume: 20}
+	if err := DB.Create(&b).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Editing the recipe must not alter the batch snapshot
+	DB.Model(&recipe.Hops[0]).Update("weight", 80)
+	var got Batch
+	DB.First(&got, b.ID)
+	snapshot, err := got.SnapshotRecipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Name != "Pale Ale" || len(snapshot.Fermentables) != 1 || len(snapshot.Hops) != 1 || snapshot.Hops[0].Weight != 40 || len(snapshot.Yeasts) != 1 || len(snapshot.MashSteps) != 1 {
+		t.Errorf("got snapshot %+v, want the recipe as it was at the batch creation", snapshot)
+	}
+}
+
+func TestInitDB_SnapshotsFormerBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "malt_app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "business.db")
+	InitDB(path)
+	defer func() { DB.Close() }()
+
+	recipe := Recipe{Name: "Stout", Hops: []Hop{{Name: "Fuggle", Weight: 30}}}
+	DB.Create(&recipe)
+	b := Batch{RecipeID: recipe.ID, StartVolume: 20}
+	DB.Create(&b)
+	// The batches created before the snapshots have none
+	DB.Model(&b).UpdateColumn("recipe_snapshot", "")
+	DB.First(&b, b.ID)
+	if snapshot, err := b.SnapshotRecipe(); err != nil || snapshot.Name != "Stout" || len(snapshot.Hops) != 1 {
+		t.Errorf("SnapshotRecipe() without snapshot = %+v, %v, want the current recipe", snapshot, err)
+	}
+
+	DB.Close()
+	InitDB(path)
+	var got Batch
+	DB.First(&got, b.ID)
+	if got.RecipeSnapshot == "" {
+		t.Fatal("the batch recipe wasn't snapshotted by the migration")
+	}
+	DB.Model(&recipe.Hops[0]).Update("weight", 60)
+	if snapshot, err := got.SnapshotRecipe(); err != nil || snapshot.Name != "Stout" || len(snapshot.Hops) != 1 || snapshot.Hops[0].Weight != 30 {
+		t.Errorf("SnapshotRecipe() after the migration = %+v, %v, want the recipe as it was migrated", snapshot, err)
+	}
+}
+
+func TestRecipe_Estimate(t *testing.T) {
+	recipe := Recipe{
+		BatchSize:    20,
+		Efficiency:   75,
+		BoilTime:     60,
+		Fermentables: []Fermentable{{Type: "Grain", Weight: 4, Color: 8, Potential: 1.037}, {Type: "Sugar", Weight: 0.5, Potential: 1.046}},
+		Hops:         []Hop{{Alpha: 10, Weight: 30, Use: "Boil", Time: 60}, {Alpha: 5, Weight: 50, Use: "Dry Hop", Time: 0}},
+		Yeasts:       []Yeast{{Attenuation: 80}},
+	}
+	want := Estimates{BatchSize: 20, OriginalGravity: 1.056, FinalGravity: 1.011, ABV: 5.9, IBU: 32.8, SRM: 5.1, EBC: 10}
+	if got := recipe.Estimate(); got != want {
+		t.Errorf("Estimate() = %+v, want %+v", got, want)
+	}
+	recipe.IBUFormula = Rager
+	if got := recipe.Estimate().IBU; got != 44.9 {
+		t.Errorf("Estimate().IBU with Rager = %v, want 44.9", got)
+	}
+}
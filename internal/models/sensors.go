@@ -0,0 +1,259 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+)
+
+// GravityUnits are the units a device can give the gravity in
+var GravityUnits = []string{"SG", "°P"}
+
+// Device is a sensor posting readings, such as a floating hydrometer, authenticated by its own token
+type Device struct {
+	gorm.Model
+	Name        string `gorm:"unique_index"`
+	GravityUnit string // the unit of the gravity posted by an iSpindel, SG by default
+	TokenHash   string
+	LastSeen    *time.Time
+	Assignments []DeviceAssignment
+}
+
+// DeviceAssignment tells which batch a device measures from a date, and until a date if it was moved since
+type DeviceAssignment struct {
+	gorm.Model
+	DeviceID uint  `gorm:"index"`
+	Batch    Batch `gorm:"association_autoupdate:false;association_autocreate:false"`
+	BatchID  uint
+	Since    time.Time
+	Until    *time.Time
+}
+
+// Sensor errors
+var (
+	errInvalidToken  = errors.New("invalid device token")
+	errWrongDevice   = errors.New("the token doesn't belong to this device")
+	errNotAssigned   = errors.New("the device is not assigned to a batch")
+	errNoMeasurement = errors.New("no measurement in the payload")
+)
+
+// hashToken hashes a device token, only the hashes are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken gives the device a new random token and returns it, the former one stops working
+func (d *Device) NewToken(db *gorm.DB) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	d.TokenHash = hashToken(token)
+	return token, db.Model(d).UpdateColumn("token_hash", d.TokenHash).Error
+}
+
+// BeforeSave gives the device the default gravity unit
+func (d *Device) BeforeSave() error {
+	if d.GravityUnit == "" {
+		d.GravityUnit = GravityUnits[0]
+	}
+	return nil
+}
+
+// FindDevice finds the device of a token
+func FindDevice(db *gorm.DB, token string) (Device, error) {
+	var d Device
+	if token == "" || db.Where("token_hash = ?", hashToken(token)).First(&d).RecordNotFound() {
+		return d, errInvalidToken
+	}
+	return d, nil
+}
+
+// AssignedBatch gives the batch the device was measuring at the given date
+func (d Device) AssignedBatch(db *gorm.DB, date time.Time) (uint, error) {
+	var a DeviceAssignment
+	if db.Where("device_id = ? AND since <= ? AND (until IS NULL OR until > ?)", d.ID, date, date).Order("since DESC").First(&a).RecordNotFound() {
+		return 0, errNotAssigned
+	}
+	return a.BatchID, nil
+}
+
+// Record stores the readings of the device as measurements of the batch it is assigned to
+func (d Device) Record(db *gorm.DB, date time.Time, measurements []Measurement) error {
+	if len(measurements) == 0 {
+		return errNoMeasurement
+	}
+	batchID, err := d.AssignedBatch(db, date)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	for _, m := range measurements {
+		m.BatchID, m.Date, m.Source = batchID, date, d.Name
+		if err := tx.Create(&m).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Model(&d).UpdateColumn("last_seen", date).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// ISpindelPayload is the JSON posted by an iSpindel with the HTTP service
+type ISpindelPayload struct {
+	Name        string   `json:"name"`
+	Token       string   `json:"token"`
+	Angle       float64  `json:"angle"`
+	Temperature *float64 `json:"temperature"`
+	TempUnits   string   `json:"temp_units"`
+	Battery     float64  `json:"battery"`
+	Gravity     *float64 `json:"gravity"`
+}
+
+// Measurements gives the readings of an iSpindel payload, the gravity being in the given unit as the iSpindel doesn't tell it
+func (p ISpindelPayload) Measurements(gravityUnit string) []Measurement {
+	var measurements []Measurement
+	if p.Gravity != nil {
+		if gravityUnit == "" {
+			gravityUnit = GravityUnits[0]
+		}
+		measurements = append(measurements, Measurement{Kind: KindGravity, Value: *p.Gravity, Unit: gravityUnit})
+	}
+	if p.Temperature != nil {
+		switch strings.ToUpper(p.TempUnits) {
+		case "F":
+			measurements = append(measurements, Measurement{Kind: KindTemperature, Value: *p.Temperature, Unit: "°F"})
+		case "K":
+			measurements = append(measurements, Measurement{Kind: KindTemperature, Value: *p.Temperature - 273.15, Unit: "°C"})
+		default:
+			measurements = append(measurements, Measurement{Kind: KindTemperature, Value: *p.Temperature, Unit: "°C"})
+		}
+	}
+	return measurements
+}
+
+// SensorPayload is the generic JSON accepted from any sensor, without a date the readings are taken now
+type SensorPayload struct {
+	Device       string     `json:"device"`
+	Date         *time.Time `json:"date"`
+	Measurements []struct {
+		Kind  string  `json:"kind"`
+		Value float64 `json:"value"`
+		Unit  string  `json:"unit"`
+	} `json:"measurements"`
+}
+
+// deviceToken gets the device token from the authorization header, the token query parameter or the payload
+func deviceToken(r *http.Request, payloadToken string) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return payloadToken
+}
+
+// ServeSensorReadings stores the readings posted by a device, as an iSpindel payload on /api/sensors/ispindel or as a generic one on /api/sensors/readings
+func ServeSensorReadings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var name, token string
+	var measurements []Measurement
+	var ispindel *ISpindelPayload
+	date := time.Now()
+	switch r.URL.Path {
+	case "/api/sensors/ispindel":
+		var p ISpindelPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid payload: %v", err), http.StatusBadRequest)
+			return
+		}
+		name, token, ispindel = p.Name, deviceToken(r, p.Token), &p
+	case "/api/sensors/readings":
+		var p SensorPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid payload: %v", err), http.StatusBadRequest)
+			return
+		}
+		name, token = p.Device, deviceToken(r, "")
+		if p.Date != nil {
+			date = *p.Date
+		}
+		for _, m := range p.Measurements {
+			measurements = append(measurements, Measurement{Kind: m.Kind, Value: m.Value, Unit: m.Unit})
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	device, err := FindDevice(DB, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if name != "" && name != device.Name {
+		http.Error(w, errWrongDevice.Error(), http.StatusForbidden)
+		return
+	}
+	if ispindel != nil {
+		measurements = ispindel.Measurements(device.GravityUnit)
+	}
+	if err := device.Record(DB, date, measurements); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, "OK")
+}
+
+// configureSensors adds the devices admin, with their batch assignments and an action giving them a new token
+func configureSensors(Admin *admin.Admin) {
+	device := Admin.AddResource(&Device{}, &admin.Config{Menu: []string{"Settings"}, Permission: roles.Allow(roles.Read, roles.Anyone).Allow(roles.CRUD, "admin")})
+	device.IndexAttrs("Name", "GravityUnit", "LastSeen")
+	device.EditAttrs("Name", "GravityUnit", "Assignments")
+	device.NewAttrs("Name", "GravityUnit", "Assignments")
+	device.ShowAttrs("Name", "GravityUnit", "LastSeen", "Assignments")
+	device.Meta(&admin.Meta{Name: "GravityUnit", Type: "select_one", Config: &admin.SelectOneConfig{Collection: GravityUnits}})
+
+	device.Action(&admin.Action{
+		Name:       "New token",
+		Permission: adminsOnly,
+		Modes:      []string{"show", "edit", "menu_item"},
+		Handler: func(argument *admin.ActionArgument) error {
+			records := argument.FindSelectedRecords()
+			if len(records) != 1 {
+				return errors.New("select one device")
+			}
+			d, ok := records[0].(*Device)
+			if !ok {
+				return errors.New("not a device")
+			}
+			token, err := d.NewToken(argument.Context.GetDB())
+			if err != nil {
+				return err
+			}
+			w := sendFile(argument, "text/plain; charset=utf-8", d.Name+".token")
+			_, err = fmt.Fprintf(w, "%s\n", token)
+			return err
+		},
+	})
+}
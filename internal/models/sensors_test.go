@@ -0,0 +1,75 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeSensorReadings(t *testing.T) {
+	defer initTestDB(t)()
+
+	b := Batch{Recipe: Recipe{Name: "IPA"}, StartVolume: 20}
+	DB.Create(&b)
+	device := Device{Name: "iSpindel001", Assignments: []DeviceAssignment{{BatchID: b.ID, Since: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}}}
+	DB.Create(&device)
+	token, err := device.NewToken(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spare := Device{Name: "Spare"}
+	DB.Create(&spare)
+	spareToken, _ := spare.NewToken(DB)
+
+	tests := []struct {
+		name       string
+		route      string
+		auth       string
+		payload    string
+		wantStatus int
+	}{
+		{"ispindel", "/api/sensors/ispindel", "", `{"name":"iSpindel001","ID":1234,"token":"` + token + `","angle":30.5,"temperature":19.5,"temp_units":"C","battery":4.1,"gravity":1.048,"interval":900,"RSSI":-70}`, http.StatusCreated},
+		{"ispindel_fahrenheit", "/api/sensors/ispindel", "", `{"name":"iSpindel001","token":"` + token + `","temperature":67.1,"temp_units":"F","gravity":1.012}`, http.StatusCreated},
+		{"generic", "/api/sensors/readings", "Bearer " + token, `{"device":"iSpindel001","date":"2026-03-02T10:00:00Z","measurements":[{"kind":"pH","value":4.4,"unit":"pH"}]}`, http.StatusCreated},
+		{"wrong_token", "/api/sensors/ispindel", "", `{"name":"iSpindel001","token":"forged","gravity":1.048}`, http.StatusUnauthorized},
+		{"other_device_token", "/api/sensors/ispindel", "", `{"name":"iSpindel001","token":"` + spareToken + `","gravity":1.048}`, http.StatusForbidden},
+		{"not_assigned", "/api/sensors/ispindel", "", `{"name":"Spare","token":"` + spareToken + `","gravity":1.048}`, http.StatusUnprocessableEntity},
+		{"before_assignment", "/api/sensors/readings", "Bearer " + token, `{"date":"2026-02-01T10:00:00Z","measurements":[{"kind":"gravity","value":1.050}]}`, http.StatusUnprocessableEntity},
+		{"unknown_kind", "/api/sensors/readings", "Bearer " + token, `{"measurements":[{"kind":"color","value":12}]}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.route, strings.NewReader(tt.payload))
+			req.Header.Set("Authorization", tt.auth)
+			rr := httptest.NewRecorder()
+			ServeSensorReadings(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("got status %v (%v), want %v", rr.Code, strings.TrimSpace(rr.Body.String()), tt.wantStatus)
+			}
+		})
+	}
+
+	var measurements []Measurement
+	DB.Where("batch_id = ?", b.ID).Order("id").Find(&measurements)
+	if len(measurements) != 5 || measurements[0].Source != "iSpindel001" || measurements[2].Unit != "SG" || measurements[3].Unit != "°F" || measurements[4].Kind != KindPH {
+		t.Errorf("got measurements %+v, want the 5 readings of the iSpindel", measurements)
+	}
+	DB.First(&device, device.ID)
+	if device.LastSeen == nil {
+		t.Error("got no last seen date for the device")
+	}
+
+	// A finished beer read in °P is within the specific gravity range, the device tells the unit
+	device.GravityUnit = "°P"
+	DB.Save(&device)
+	req := httptest.NewRequest(http.MethodPost, "/api/sensors/ispindel", strings.NewReader(`{"name":"iSpindel001","token":"`+token+`","gravity":1.1}`))
+	rr := httptest.NewRecorder()
+	ServeSensorReadings(rr, req)
+	var last Measurement
+	DB.Where("batch_id = ?", b.ID).Order("id DESC").First(&last)
+	if rr.Code != http.StatusCreated || last.Value != 1.1 || last.Unit != "°P" {
+		t.Errorf("got status %v and measurement %+v, want 1.1 °P", rr.Code, last)
+	}
+}
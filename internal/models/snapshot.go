@@ -0,0 +1,134 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/qor/utils"
+)
+
+// StockSnapshot is the beer held as of the end of a day, by batch and by container
+type StockSnapshot struct {
+	At         string           `json:"at"`
+	Batches    []BatchStock     `json:"batches"`
+	Containers []ContainerStock `json:"containers"`
+}
+
+// BatchStock is the beer of a batch held in the containers, in liters, and packaged
+type BatchStock struct {
+	BatchID  uint             `json:"batch_id"`
+	Batch    string           `json:"batch"`
+	Volume   int              `json:"volume"`
+	Stocks   []ContainerStock `json:"stocks"`
+	Packaged string           `json:"packaged,omitempty"`
+}
+
+// ContainerStock is the beer held in a container, in liters
+type ContainerStock struct {
+	ContainerID uint   `json:"container_id"`
+	Container   string `json:"container"`
+	Volume      int    `json:"volume"`
+	Stock       string `json:"stock,omitempty"`
+}
+
+// StockAt works out the beer held as of the end of the day, from the stock ledger, the packaging runs and the sales dated up to it
+func StockAt(db *gorm.DB, day time.Time) (StockSnapshot, error) {
+	s := StockSnapshot{At: day.Format("2006-01-02"), Batches: []BatchStock{}, Containers: []ContainerStock{}}
+	var batches []*Batch
+	if err := db.Where("date < ? AND step NOT IN (?)", endOfDay(day), []string{StepPlanned, StepBrewing}).Order("id").Find(&batches).Error; err != nil {
+		return s, err
+	}
+	if err := LoadStockAt(db, day, batches...); err != nil {
+		return s, err
+	}
+	if err := LoadPackagedAt(db, day, batches...); err != nil {
+		return s, err
+	}
+	for _, b := range batches {
+		bs := BatchStock{BatchID: b.ID, Batch: b.Stringify(), Stocks: []ContainerStock{}, Packaged: b.Packaged}
+		for _, l := range b.Stocks {
+			if l.Volume != 0 {
+				bs.Volume += l.Volume
+				bs.Stocks = append(bs.Stocks, ContainerStock{ContainerID: l.ContainerID, Container: l.ContainerName, Volume: l.Volume})
+			}
+		}
+		if len(bs.Stocks) > 0 || bs.Packaged != "" {
+			s.Batches = append(s.Batches, bs)
+		}
+	}
+	var containers []*Container
+	if err := db.Order("id").Find(&containers).Error; err != nil {
+		return s, err
+	}
+	if err := LoadContainersAt(db, day, containers...); err != nil {
+		return s, err
+	}
+	for _, c := range containers {
+		s.Containers = append(s.Containers, ContainerStock{ContainerID: c.ID, Container: c.Name, Volume: c.Filled, Stock: c.Stock})
+	}
+	return s, nil
+}
+
+// parseDay parses a day given as 2006-01-02, the zero time meaning now
+func parseDay(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// ServeStock serves the beer held as of the day given by the at parameter (today if none), from /api/stock?at=2026-01-31
+func ServeStock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	day, err := parseDay(r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, "the at parameter must be a date as 2006-01-02", http.StatusBadRequest)
+		return
+	}
+	if day.IsZero() {
+		day = time.Now()
+	}
+	s, err := StockAt(DB, day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(s)
+}
+
+// stockDayFilter is the batch list filter giving the stocks as of a day
+const stockDayFilter = "StockAt"
+
+// stockDay gives the day of the batch list stock filter, the zero time if none
+func stockDay(r *http.Request) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	day, _ := parseDay(r.URL.Query().Get(fmt.Sprintf("filters[%s].Value", stockDayFilter)))
+	return day
+}
+
+// configureStockSnapshots adds the batch list filter showing the stocks as of a day, and the batches brewed up to it
+func configureStockSnapshots(batch *admin.Resource) {
+	batch.Filter(&admin.Filter{Name: stockDayFilter, Label: "Stock as of", Type: "stock_date", Handler: func(db *gorm.DB, argument *admin.FilterArgument) *gorm.DB {
+		value := argument.Value.Get("Value")
+		if value == nil {
+			return db
+		}
+		day, err := parseDay(utils.ToString(value.Value))
+		if err != nil || day.IsZero() {
+			return db
+		}
+		return db.Where("batches.date < ?", endOfDay(day))
+	}})
+}
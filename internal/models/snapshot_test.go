@@ -0,0 +1,72 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStockAt(t *testing.T) {
+	defer initTestDB(t)()
+
+	day := func(m time.Month, d int) time.Time { return time.Date(2026, m, d, 0, 0, 0, 0, time.Local) }
+	fermenter, _ := fermenterID(DB)
+	keg := Container{Name: "Keg", Volume: 50, State: StateSanitized}
+	DB.Create(&keg)
+	bottle := PackagingFormat{Name: "Bottle 33cl", Volume: 0.33}
+	DB.Create(&bottle)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100, Date: day(1, 10)}
+	DB.Create(&b)
+	DB.Create(&Batch{Recipe: Recipe{Name: "Stout"}, Step: StepConditioning, StartVolume: 50, Date: day(2, 10)})
+	DB.Create(&PackagingRun{BatchID: b.ID, Date: day(1, 31), FromID: fermenter, FormatID: bottle.ID, Volume: 20, Units: 60})
+	DB.Create(&Sale{BatchID: b.ID, Date: day(2, 1), FormatID: bottle.ID, Units: 12})
+	DB.Create(&Transfer{BatchID: b.ID, Date: day(2, 5), FromID: fermenter, ToID: keg.ID, Volume: 40})
+	DB.Create(&Sale{BatchID: b.ID, Date: day(2, 10), FromID: keg.ID, Volume: 10})
+
+	tests := []struct {
+		name       string
+		day        time.Time
+		batches    []BatchStock
+		containers []ContainerStock
+	}{
+		{"end_of_january", day(1, 31),
+			[]BatchStock{{BatchID: b.ID, Batch: "#1 IPA", Volume: 80, Stocks: []ContainerStock{{ContainerID: fermenter, Container: FermenterName, Volume: 80}}, Packaged: "Bottle 33cl: 60"}},
+			[]ContainerStock{{ContainerID: fermenter, Container: FermenterName, Volume: 80, Stock: "#1 IPA: 80"}, {ContainerID: keg.ID, Container: "Keg"}}},
+		{"end_of_february", day(2, 28),
+			[]BatchStock{
+				{BatchID: b.ID, Batch: "#1 IPA", Volume: 70, Stocks: []ContainerStock{{ContainerID: fermenter, Container: FermenterName, Volume: 40}, {ContainerID: keg.ID, Container: "Keg", Volume: 30}}, Packaged: "Bottle 33cl: 48"},
+				{BatchID: 2, Batch: "#2 Stout", Volume: 50, Stocks: []ContainerStock{{ContainerID: fermenter, Container: FermenterName, Volume: 50}}},
+			},
+			[]ContainerStock{{ContainerID: fermenter, Container: FermenterName, Volume: 90, Stock: "#1 IPA: 40, #2 Stout: 50"}, {ContainerID: keg.ID, Container: "Keg", Volume: 30, Stock: "#1 IPA: 30"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := StockAt(DB, tt.day)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s.Batches, tt.batches) {
+				t.Errorf("got batches %+v, want %+v", s.Batches, tt.batches)
+			}
+			if !reflect.DeepEqual(s.Containers, tt.containers) {
+				t.Errorf("got containers %+v, want %+v", s.Containers, tt.containers)
+			}
+		})
+	}
+
+	// API
+	rr := httptest.NewRecorder()
+	ServeStock(rr, httptest.NewRequest(http.MethodGet, "/api/stock?at=2026-01-31", nil))
+	var s StockSnapshot
+	if err := json.NewDecoder(rr.Body).Decode(&s); err != nil || s.At != "2026-01-31" || len(s.Batches) != 1 || s.Batches[0].Volume != 80 {
+		t.Errorf("got %+v (%v), want the stock of the end of january", s, err)
+	}
+	rr = httptest.NewRecorder()
+	ServeStock(rr, httptest.NewRequest(http.MethodGet, "/api/stock?at=31/01/2026", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("got status %v, want %v for a malformed date", rr.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/qor/validations"
+)
+
+// pendingChecksKey is the gorm setting holding the stock checks delayed until the end of a batch save
+const pendingChecksKey = "malt_app:pending_stock_checks"
+
+// Stock check error messages, translated by QOR with the "qor_admin.errors." prefix
+const (
+	errNotEnoughStock = "There is not enough beer in the source container"
+	errOverCapacity   = "The target container would be over capacity"
+)
+
+type pendingChecks struct {
+	records []interface{}
+}
+
+// BeforeSave checks that the batch step is unchanged, and delays the stock checks of the nested transfers and sales until the batch ledger is up to date
+func (b *Batch) BeforeSave(scope *gorm.Scope) error {
+	if err := checkStepUnchanged(scope.NewDB(), b); err != nil {
+		return err
+	}
+	scope.Set(pendingChecksKey, &pendingChecks{})
+	return nil
+}
+
+// checkStock checks the stocks after a transfer or a sale was written into the ledger, or delays the check if the record is saved with its batch.
+// As the ledger entries are written before being checked within transactions taking the database write lock as they begin (see InitDB),
+// a concurrent save waits for the first one and is checked against its entries.
+func checkStock(tx *gorm.DB, record interface{}) error {
+	if pending, ok := tx.Get(pendingChecksKey); ok {
+		if checks, ok := pending.(*pendingChecks); ok {
+			checks.records = append(checks.records, record)
+			return nil
+		}
+	}
+	return validateStock(tx, record)
+}
+
+// checkPendingStocks runs the stock checks delayed during a batch save
+func checkPendingStocks(tx *gorm.DB) error {
+	if pending, ok := tx.Get(pendingChecksKey); ok {
+		if checks, ok := pending.(*pendingChecks); ok {
+			for _, r := range checks.records {
+				if err := validateStock(tx, r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateStock checks that a transfer, a sale or a packaging run leaves its source container with a positive stock and its target container within capacity,
+// and that no more units were sold than packaged
+func validateStock(tx *gorm.DB, record interface{}) error {
+	switch r := record.(type) {
+	case *Transfer:
+		if err := validateSource(tx, r, r.BatchID, r.FromID); err != nil {
+			return err
+		}
+		return validateCapacity(tx, r, r.ToID)
+	case *Sale:
+		if r.FormatID != 0 {
+			return validateUnits(tx, r, r.BatchID, r.FormatID)
+		}
+		return validateSource(tx, r, r.BatchID, r.FromID)
+	case *PackagingRun:
+		if err := validateSource(tx, r, r.BatchID, r.FromID); err != nil {
+			return err
+		}
+		return validateUnits(tx, r, r.BatchID, r.FormatID)
+	}
+	return nil
+}
+
+// validateSource checks that the batch stock in the container is not negative
+func validateSource(tx *gorm.DB, record interface{}, batchID uint, containerID uint) error {
+	var stock struct{ Volume int }
+	if err := tx.Table("stock_entries").Select("COALESCE(SUM(volume), 0) AS volume").Where("batch_id = ? AND container_id = ?", batchID, containerID).Scan(&stock).Error; err != nil {
+		return err
+	}
+	if stock.Volume < 0 {
+		return validations.NewError(record, "From", errNotEnoughStock)
+	}
+	return nil
+}
+
+// validateCapacity checks that the volume held by the container, all batches included, does not exceed its capacity (a zero capacity is unlimited)
+func validateCapacity(tx *gorm.DB, record interface{}, containerID uint) error {
+	var container Container
+	if err := tx.First(&container, containerID).Error; err != nil {
+		return err
+	}
+	if container.Volume <= 0 {
+		return nil
+	}
+	var stock struct{ Volume int }
+	if err := tx.Table("stock_entries").Select("COALESCE(SUM(volume), 0) AS volume").Where("container_id = ?", containerID).Scan(&stock).Error; err != nil {
+		return err
+	}
+	if stock.Volume > container.Volume {
+		return validations.NewError(record, "To", errOverCapacity)
+	}
+	return nil
+}
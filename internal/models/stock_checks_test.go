@@ -0,0 +1,86 @@
+package models
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qor/validations"
+)
+
+func TestStockChecks(t *testing.T) {
+	defer initTestDB(t)()
+
+	keg := Container{Name: "Keg", Volume: 20, State: StateSanitized}
+	DB.Create(&keg)
+	var fermenter Container
+	DB.Where(Container{Name: FermenterName}).First(&fermenter)
+	b := Batch{Recipe: Recipe{Name: "IPA"}, Step: StepConditioning, StartVolume: 100}
+	DB.Create(&b)
+
+	tests := []struct {
+		name    string
+		record  interface{}
+		wantErr string
+	}{
+		{"transfer_more_than_source", &Transfer{BatchID: b.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 120}, errNotEnoughStock},
+		{"transfer_over_capacity", &Transfer{BatchID: b.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 30}, errOverCapacity},
+		{"valid_transfer", &Transfer{BatchID: b.ID, FromID: fermenter.ID, ToID: keg.ID, Volume: 20}, ""},
+		{"sale_more_than_source", &Sale{BatchID: b.ID, FromID: keg.ID, Volume: 25}, errNotEnoughStock},
+		{"valid_sale", &Sale{BatchID: b.ID, FromID: keg.ID, Volume: 15}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := DB.Create(tt.record).Error
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if verr, ok := err.(*validations.Error); !ok || verr.Message != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	// The rejected records must have left neither rows nor ledger entries
+	var got Batch
+	DB.Preload("Transfers").Preload("Sales").First(&got, b.ID)
+	LoadStock(DB, &got)
+	if len(got.Transfers) != 1 || len(got.Sales) != 1 || got.Stock != "Fermenter: 80, Keg: 5" {
+		t.Errorf("got %v transfers, %v sales and stock %v, want 1 transfer, 1 sale and stock Fermenter: 80, Keg: 5", len(got.Transfers), len(got.Sales), got.Stock)
+	}
+
+	// Transfers saved with their batch must be checked against the updated batch
+	got.StartVolume = 130
+	got.Transfers = append(got.Transfers, Transfer{FromID: fermenter.ID, ToID: keg.ID, Volume: 15})
+	got.Sales = append(got.Sales, Sale{FromID: fermenter.ID, Volume: 90})
+	if err := DB.Save(&got).Error; err != nil {
+		t.Errorf("got error %v saving a valid batch", err)
+	}
+	got.Sales = append(got.Sales, Sale{FromID: fermenter.ID, Volume: 10})
+	if err := DB.Save(&got).Error; err == nil {
+		t.Error("got no error saving a batch selling more than its stock")
+	}
+
+	// Concurrent sales must not both pass the check
+	other := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepConditioning, StartVolume: 100}
+	DB.Create(&other)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = DB.Create(&Sale{BatchID: other.ID, FromID: fermenter.ID, Volume: 60}).Error
+		}(i)
+	}
+	wg.Wait()
+	if (errs[0] == nil) == (errs[1] == nil) {
+		t.Fatalf("got errors %v, want one of the two concurrent sales of 60 out of 100 to pass", errs)
+	}
+	for _, err := range errs {
+		if err != nil && err.Error() != errNotEnoughStock {
+			t.Errorf("got error %v, want %v", err, errNotEnoughStock)
+		}
+	}
+}
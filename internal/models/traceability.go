@@ -0,0 +1,338 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/qor/admin"
+	"github.com/qor/roles"
+)
+
+// Trace is what a recall has to know from a lot, a batch or a sale : the ingredient lots, the batches they ended up in, blends included, and where the beer went
+type Trace struct {
+	Origin    string           `json:"origin"`
+	Date      time.Time        `json:"date"`
+	Lots      []TracedLot      `json:"lots"`
+	Batches   []TracedBatch    `json:"batches"`
+	Transfers []TracedTransfer `json:"transfers"`
+	Sales     []TracedSale     `json:"sales"`
+}
+
+// TracedLot is the use of an ingredient lot in a batch
+type TracedLot struct {
+	LotID        uint       `json:"lot_id"`
+	Ingredient   string     `json:"ingredient"`
+	Number       string     `json:"number"`
+	BestBefore   *time.Time `json:"best_before,omitempty"`
+	Supplier     string     `json:"supplier"`
+	Delivery     string     `json:"delivery"`
+	DeliveryDate time.Time  `json:"delivery_date"`
+	BatchID      uint       `json:"batch_id"`
+	Quantity     float64    `json:"quantity"`
+	Unit         string     `json:"unit"`
+}
+
+// TracedBatch is a batch of a trace, with the batches it was blended from and into
+type TracedBatch struct {
+	ID          uint      `json:"id"`
+	Name        string    `json:"name"`
+	Step        string    `json:"step"`
+	Date        time.Time `json:"date"`
+	BlendedFrom []uint    `json:"blended_from,omitempty"`
+	BlendedInto []uint    `json:"blended_into,omitempty"`
+	// A mixed batch without recorded blend, mixed before the blends were recorded, can't be followed: the recall has to find where it went
+	BlendNotRecorded bool `json:"blend_not_recorded,omitempty"`
+}
+
+// TracedTransfer is a transfer of a traced batch
+type TracedTransfer struct {
+	ID      uint      `json:"id"`
+	BatchID uint      `json:"batch_id"`
+	Date    time.Time `json:"date"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Volume  int       `json:"volume"`
+}
+
+// TracedSale is a sale of a traced batch
+type TracedSale struct {
+	ID      uint      `json:"id"`
+	BatchID uint      `json:"batch_id"`
+	Date    time.Time `json:"date"`
+	From    string    `json:"from"`
+	Volume  int       `json:"volume"`
+	Format  string    `json:"format,omitempty"`
+	Units   int       `json:"units,omitempty"`
+	Liters  float64   `json:"liters"`
+}
+
+// blends gives the batches each batch was blended into, from the recorded blends
+func blends(db *gorm.DB) (map[uint][]uint, error) {
+	var links []struct {
+		ParentID uint
+		ChildID  uint
+	}
+	err := db.Table("blend_sources").Select("DISTINCT blend_sources.batch_id AS parent_id, blends.batch_id AS child_id").
+		Joins("JOIN blends ON blends.id = blend_sources.blend_id AND blends.deleted_at IS NULL").
+		Where("blend_sources.deleted_at IS NULL").Order("parent_id, child_id").Scan(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	into := map[uint][]uint{}
+	for _, l := range links {
+		into[l.ParentID] = append(into[l.ParentID], l.ChildID)
+	}
+	return into, nil
+}
+
+// containsID tells if the id is in the list
+func containsID(ids []uint, id uint) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// closure adds to the ids all the ids linked to them, directly or not
+func closure(ids []uint, links map[uint][]uint) []uint {
+	for i := 0; i < len(ids); i++ {
+		for _, linked := range links[ids[i]] {
+			if !containsID(ids, linked) {
+				ids = append(ids, linked)
+			}
+		}
+	}
+	return ids
+}
+
+// reverse reverses the links
+func reverse(links map[uint][]uint) map[uint][]uint {
+	reversed := map[uint][]uint{}
+	for from, tos := range links {
+		for _, to := range tos {
+			reversed[to] = append(reversed[to], from)
+		}
+	}
+	for _, froms := range reversed {
+		sort.Slice(froms, func(i, j int) bool { return froms[i] < froms[j] })
+	}
+	return reversed
+}
+
+// TraceLot traces a lot down to the batches it was brewed into, the batches these were blended into, and their transfers and sales
+func TraceLot(db *gorm.DB, lotID uint) (Trace, error) {
+	var l Lot
+	if err := db.First(&l, lotID).Error; err != nil {
+		return Trace{}, err
+	}
+	if err := LoadLots(db, &l); err != nil {
+		return Trace{}, err
+	}
+	var batchIDs []uint
+	if err := db.Model(Consumption{}).Where("lot_id = ?", lotID).Order("batch_id").Pluck("DISTINCT batch_id", &batchIDs).Error; err != nil {
+		return Trace{}, err
+	}
+	into, err := blends(db)
+	if err != nil {
+		return Trace{}, err
+	}
+	return buildTrace(db, fmt.Sprintf("Lot %s", l.Stringify()), []uint{lotID}, nil, closure(batchIDs, into), into, nil)
+}
+
+// TraceBatch traces a batch up to the lots of its ingredients, through the batches blended into it, and down to the transfers and sales of the batches it was blended into
+func TraceBatch(db *gorm.DB, batchID uint) (Trace, error) {
+	var b Batch
+	if err := db.First(&b, batchID).Error; err != nil {
+		return Trace{}, err
+	}
+	into, err := blends(db)
+	if err != nil {
+		return Trace{}, err
+	}
+	upstream := closure([]uint{batchID}, reverse(into))
+	downstream := closure([]uint{batchID}, into)
+	return buildTrace(db, fmt.Sprintf("Batch %s", b.Stringify()), nil, upstream, downstream, into, nil)
+}
+
+// TraceSale traces a sale up to the lots of the ingredients of its batch, through the batches blended into it
+func TraceSale(db *gorm.DB, saleID uint) (Trace, error) {
+	var s Sale
+	if err := db.First(&s, saleID).Error; err != nil {
+		return Trace{}, err
+	}
+	into, err := blends(db)
+	if err != nil {
+		return Trace{}, err
+	}
+	return buildTrace(db, fmt.Sprintf("Sale #%d", s.ID), nil, closure([]uint{s.BatchID}, reverse(into)), nil, into, []uint{saleID})
+}
+
+// buildTrace gathers the uses of the given lots, or of all the lots of the upstream batches, and the transfers and sales of the downstream batches, or only the given sales
+func buildTrace(db *gorm.DB, origin string, lotIDs []uint, upstream []uint, downstream []uint, into map[uint][]uint, saleIDs []uint) (Trace, error) {
+	t := Trace{Origin: origin, Date: time.Now(), Lots: []TracedLot{}, Batches: []TracedBatch{}, Transfers: []TracedTransfer{}, Sales: []TracedSale{}}
+	batchIDs := append(append([]uint{}, upstream...), downstream...)
+
+	// Lots
+	var consumptions []Consumption
+	query := db.Order("lot_id, batch_id, id")
+	if lotIDs != nil {
+		query = query.Where("lot_id IN (?)", lotIDs)
+	} else {
+		query = query.Where("batch_id IN (?)", upstream)
+	}
+	if err := query.Find(&consumptions).Error; err != nil {
+		return t, err
+	}
+	for _, c := range consumptions {
+		var l Lot
+		var d Delivery
+		var s Supplier
+		if err := db.First(&l, c.LotID).Error; err != nil {
+			return t, err
+		}
+		if err := LoadLots(db, &l); err != nil {
+			return t, err
+		}
+		db.First(&d, l.DeliveryID)
+		db.First(&s, d.SupplierID)
+		t.Lots = append(t.Lots, TracedLot{LotID: l.ID, Ingredient: l.Ingredient.Name, Number: l.Number, BestBefore: l.BestBefore, Supplier: s.Name, Delivery: d.Reference, DeliveryDate: d.Date, BatchID: c.BatchID, Quantity: c.Quantity, Unit: l.Ingredient.Unit})
+		if !containsID(batchIDs, c.BatchID) {
+			batchIDs = append(batchIDs, c.BatchID)
+		}
+	}
+
+	// Batches
+	var batches []Batch
+	if err := db.Where("id IN (?)", batchIDs).Order("id").Find(&batches).Error; err != nil {
+		return t, err
+	}
+	from := reverse(into)
+	for _, b := range batches {
+		t.Batches = append(t.Batches, TracedBatch{ID: b.ID, Name: b.Stringify(), Step: b.Step, Date: b.Date, BlendedFrom: from[b.ID], BlendedInto: into[b.ID], BlendNotRecorded: b.Step == StepMixed && len(into[b.ID]) == 0})
+	}
+
+	// Transfers and sales
+	var containers []Container
+	if err := db.Unscoped().Find(&containers).Error; err != nil {
+		return t, err
+	}
+	name := func(id uint) string {
+		for _, c := range containers {
+			if c.ID == id {
+				return c.Name
+			}
+		}
+		return fmt.Sprintf("#%d", id)
+	}
+	var transfers []Transfer
+	if err := db.Where("batch_id IN (?)", downstream).Order("date, id").Find(&transfers).Error; err != nil {
+		return t, err
+	}
+	for _, tr := range transfers {
+		t.Transfers = append(t.Transfers, TracedTransfer{ID: tr.ID, BatchID: tr.BatchID, Date: tr.Date, From: name(tr.FromID), To: name(tr.ToID), Volume: tr.Volume})
+	}
+	var sales []Sale
+	query = db.Order("date, id")
+	if saleIDs != nil {
+		query = query.Where("id IN (?)", saleIDs)
+	} else {
+		query = query.Where("batch_id IN (?)", downstream)
+	}
+	if err := query.Preload("Format").Find(&sales).Error; err != nil {
+		return t, err
+	}
+	for _, s := range sales {
+		traced := TracedSale{ID: s.ID, BatchID: s.BatchID, Date: s.Date, Volume: s.Volume, Units: s.Units, Liters: s.Liters}
+		if s.FormatID != 0 {
+			traced.Format = s.Format.Name
+		} else {
+			traced.From = name(s.FromID)
+		}
+		t.Sales = append(t.Sales, traced)
+	}
+	return t, nil
+}
+
+// ServeTrace exports as JSON the trace of a lot, a batch or a sale, on /api/trace/{lots,batches,sales}/{id}
+func ServeTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/trace/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(parts[1], ".json"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var t Trace
+	switch parts[0] {
+	case "lots":
+		t, err = TraceLot(DB, uint(id))
+	case "batches":
+		t, err = TraceBatch(DB, uint(id))
+	case "sales":
+		t, err = TraceSale(DB, uint(id))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trace-%s-%d.json"`, strings.TrimSuffix(parts[0], "s"), id))
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	encoder.Encode(t)
+}
+
+// configureTraceability adds to the lots and the batches a printable recall report and a JSON export of their trace
+func configureTraceability(lot *admin.Resource, batch *admin.Resource) {
+	for _, r := range []struct {
+		res   *admin.Resource
+		param string
+		trace func(db *gorm.DB, id uint) (Trace, error)
+	}{
+		{lot, "lots", TraceLot},
+		{batch, "batches", TraceBatch},
+	} {
+		param, trace := r.param, r.trace
+		r.res.RegisterRoute("GET", r.res.ParamIDName()+"/recall", func(context *admin.Context) {
+			id, _ := strconv.Atoi(context.ResourceID)
+			t, err := trace(context.GetDB(), uint(id))
+			if err != nil {
+				http.NotFound(context.Writer, context.Request)
+				return
+			}
+			context.Execute("recall", struct {
+				Trace
+				Export string
+			}{t, fmt.Sprintf("/api/trace/%s/%d", param, id)})
+		}, &admin.RouteConfig{PermissionMode: roles.Read})
+		r.res.Action(&admin.Action{
+			Name:  "Recall report",
+			Modes: []string{"show", "menu_item"},
+			URL: func(record interface{}, context *admin.Context) string {
+				return context.URLFor(record) + "/recall"
+			},
+		})
+	}
+}
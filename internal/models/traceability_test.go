@@ -0,0 +1,106 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrace(t *testing.T) {
+	defer initTestDB(t)()
+
+	date := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	malt := Ingredient{Name: "Pils", Category: CategoryFermentable, Unit: "kg"}
+	DB.Create(&malt)
+	supplier := Supplier{Name: "Malterie"}
+	DB.Create(&supplier)
+	delivery := Delivery{SupplierID: supplier.ID, Date: date, Reference: "BL-1", Lots: []Lot{{IngredientID: malt.ID, Number: "L-1", Quantity: 25}, {IngredientID: malt.ID, Number: "L-2", Quantity: 25}}}
+	DB.Create(&delivery)
+	l1, l2 := delivery.Lots[0], delivery.Lots[1]
+
+	tank, keg := Container{Name: "Tank", Volume: 100, State: StateSanitized}, Container{Name: "Keg", Volume: 20, State: StateSanitized}
+	DB.Create(&tank)
+	DB.Create(&keg)
+	fermenter, _ := fermenterID(DB)
+	mixed := Batch{Recipe: Recipe{Name: "Blonde"}, Step: StepFermenting, StartVolume: 20, Date: date}
+	amber := Batch{Recipe: Recipe{Name: "Amber"}, Step: StepConditioning, StartVolume: 30, Date: date}
+	other := Batch{Recipe: Recipe{Name: "Stout"}, Step: StepConditioning, StartVolume: 30, Date: date}
+	for _, b := range []*Batch{&mixed, &amber, &other} {
+		DB.Create(b)
+	}
+	DB.Create(&Consumption{BatchID: mixed.ID, LotID: l1.ID, Quantity: 4})
+	DB.Create(&Consumption{BatchID: amber.ID, LotID: l2.ID, Quantity: 6})
+	DB.Create(&Consumption{BatchID: other.ID, LotID: l2.ID, Quantity: 6})
+	DB.Create(&Transfer{BatchID: other.ID, Date: date, FromID: fermenter, ToID: keg.ID, Volume: 20})
+	blend := Blend{Date: date, ContainerID: tank.ID, User: "USER", Sources: []BlendSource{{BatchID: mixed.ID, ContainerID: fermenter, Volume: 20}, {BatchID: amber.ID, ContainerID: fermenter, Volume: 10}}}
+	if err := DB.Create(&blend).Error; err != nil {
+		t.Fatal(err)
+	}
+	sale := Sale{BatchID: blend.BatchID, Date: date, FromID: tank.ID, Volume: 10}
+	DB.Create(&sale)
+	DB.Create(&Sale{BatchID: other.ID, Date: date, FromID: keg.ID, Volume: 10})
+
+	batchIDs := func(tr Trace) (ids []uint) {
+		for _, b := range tr.Batches {
+			ids = append(ids, b.ID)
+		}
+		return ids
+	}
+
+	// From the lot of the mixed batch down to the sale of the batch it was blended into
+	tr, err := TraceLot(DB, l1.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batchIDs(tr), []uint{mixed.ID, blend.BatchID}) || len(tr.Lots) != 1 || tr.Lots[0].Supplier != "Malterie" || len(tr.Sales) != 1 || tr.Sales[0].ID != sale.ID || tr.Sales[0].From != "Tank" {
+		t.Errorf("got trace %+v, want the mixed and blended batches and the sale from the tank", tr)
+	}
+	if !reflect.DeepEqual(tr.Batches[1].BlendedFrom, []uint{mixed.ID, amber.ID}) || tr.Batches[0].BlendNotRecorded {
+		t.Errorf("got blended from %v, want %v and %v", tr.Batches[1].BlendedFrom, mixed.ID, amber.ID)
+	}
+
+	// From the sale up to the lots of both blended batches
+	tr, err = TraceSale(DB, sale.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batchIDs(tr), []uint{mixed.ID, amber.ID, blend.BatchID}) || len(tr.Lots) != 2 || tr.Lots[0].Number != "L-1" || tr.Lots[1].Number != "L-2" || tr.Lots[1].BatchID != amber.ID || len(tr.Sales) != 1 {
+		t.Errorf("got trace %+v, want the lots of the blended batches", tr)
+	}
+
+	// From the shared lot to both batches using it, and the blend of one of them
+	tr, _ = TraceLot(DB, l2.ID)
+	if !reflect.DeepEqual(batchIDs(tr), []uint{amber.ID, other.ID, blend.BatchID}) || len(tr.Sales) != 2 || len(tr.Transfers) != 1 {
+		t.Errorf("got trace %+v, want both batches using the lot, the blend and their sales", tr)
+	}
+
+	// Batches sharing the fermenter are not blended together, and a batch mixed without recorded blend is shown as such
+	porter := Batch{Recipe: Recipe{Name: "Porter"}, Step: StepFermenting, StartVolume: 20, Date: date}
+	wheat := Batch{Recipe: Recipe{Name: "Wheat"}, Step: StepFermenting, StartVolume: 20, Date: date}
+	DB.Create(&porter)
+	DB.Create(&wheat)
+	if err := porter.ChangeStep(DB, StepMixed, "USER"); err != nil {
+		t.Fatal(err)
+	}
+	tr, _ = TraceBatch(DB, porter.ID)
+	if !reflect.DeepEqual(batchIDs(tr), []uint{porter.ID}) || !tr.Batches[0].BlendNotRecorded || len(tr.Batches[0].BlendedInto) != 0 {
+		t.Errorf("got trace %+v, want only the mixed batch, with its blend not recorded", tr)
+	}
+
+	// JSON export
+	rr := httptest.NewRecorder()
+	ServeTrace(rr, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/trace/batches/%d", mixed.ID), nil))
+	var exported Trace
+	if err := json.NewDecoder(rr.Body).Decode(&exported); err != nil || rr.Code != http.StatusOK || len(exported.Lots) != 1 || len(exported.Sales) != 1 {
+		t.Errorf("got status %v, trace %+v, error %v, want the batch trace", rr.Code, exported, err)
+	}
+	rr = httptest.NewRecorder()
+	ServeTrace(rr, httptest.NewRequest(http.MethodGet, "/api/trace/sales/999", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("got status %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,86 @@
+// Package notify delivers messages to people, such as alerts, through pluggable notifiers
+package notify
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a message to deliver
+type Message struct {
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages
+type Notifier interface {
+	Notify(m Message) error
+}
+
+// Log is a notifier writing the messages to the application log
+type Log struct{}
+
+// Notify writes the message to the application log
+func (Log) Notify(m Message) error {
+	log.Printf("%s\n%s\n", m.Subject, m.Body)
+	return nil
+}
+
+// SMTP is a notifier sending the messages by email
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string // no authentication if empty
+	Password string
+	From     string
+	To       []string
+}
+
+// SMTPFromEnv configures an SMTP notifier from the SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, SMTP_FROM and SMTP_TO (comma separated) environment variables, it is not ok if SMTP_HOST or SMTP_TO are not set
+func SMTPFromEnv() (SMTP, bool) {
+	s := SMTP{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+	for _, to := range strings.Split(os.Getenv("SMTP_TO"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			s.To = append(s.To, to)
+		}
+	}
+	if s.Port == "" {
+		s.Port = "25"
+	}
+	if s.From == "" {
+		s.From = "malt_app@localhost"
+	}
+	return s, s.Host != "" && len(s.To) > 0
+}
+
+// Notify sends the message by email to all the recipients
+func (s SMTP) Notify(m Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	headers := []string{
+		"From: " + s.From,
+		"To: " + strings.Join(s.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", m.Subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	body := strings.Join(headers, "\r\n") + "\r\n\r\n" + strings.Replace(m.Body, "\n", "\r\n", -1) + "\r\n"
+	if err := smtp.SendMail(s.Host+":"+s.Port, auth, s.From, s.To, []byte(body)); err != nil {
+		return fmt.Errorf("sending the notification by email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTPServer accepts one mail on a local port and sends its recipients and data on the returned channels
+func fakeSMTPServer(t *testing.T) (string, <-chan []string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients, data := make(chan []string, 1), make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 localhost fake SMTP")
+		var to []string
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); command {
+			case "EHLO", "HELO":
+				c.PrintfLine("250 localhost")
+			case "MAIL", "RSET", "NOOP":
+				c.PrintfLine("250 OK")
+			case "RCPT":
+				to = append(to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+				c.PrintfLine("250 OK")
+			case "DATA":
+				c.PrintfLine("354 Go ahead")
+				lines, _ := c.ReadDotLines()
+				recipients <- to
+				data <- strings.Join(lines, "\n")
+				c.PrintfLine("250 OK")
+			case "QUIT":
+				c.PrintfLine("221 Bye")
+				return
+			default:
+				c.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), recipients, data
+}
+
+func TestSMTP_Notify(t *testing.T) {
+	addr, recipients, data := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	s := SMTP{Host: host, Port: port, From: "malt_app@localhost", To: []string{"brewer@example.com", "boss@example.com"}}
+	if err := s.Notify(Message{Subject: "Temperature at 26 °C", Body: "Batch #1 IPA\nis too warm"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-recipients; len(got) != 2 || got[0] != "brewer@example.com" {
+		t.Errorf("got recipients %v, want the two of the notifier", got)
+	}
+	got := <-data
+	if !strings.Contains(got, "Subject: =?utf-8?q?Temperature_at_26_=C2=B0C?=") || !strings.Contains(got, "Batch #1 IPA\nis too warm") {
+		t.Errorf("got mail %q, want the encoded subject and the body", got)
+	}
+}
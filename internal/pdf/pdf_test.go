@@ -0,0 +1,65 @@
+package pdf
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		size float64
+		want float64
+	}{
+		{"digits", "1234.50", 10, 36.14},
+		{"letters", "Il", 10, 5},
+		{"euro", "€", 10, 5.56},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Width(tt.s, tt.size); got < tt.want-0.001 || got > tt.want+0.001 {
+				t.Errorf("Width() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	d := New()
+	p := d.AddPage()
+	p.Text(50, 50, 12, true, "Invoice (2026-0001)")
+	p.TextRight(545, 80, 10, false, "12,50 €")
+	p.Line(50, 90, 545, 90)
+	d.AddPage().Text(50, 50, 10, false, "Bière")
+	var buf bytes.Buffer
+	if _, err := d.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "%PDF-1.4") || !strings.HasSuffix(out, "%%EOF\n") {
+		t.Error("got no PDF header or trailer")
+	}
+	if !strings.Contains(out, `(Invoice \(2026-0001\)) Tj`) || !strings.Contains(out, "(Bi\xe8re) Tj") || !strings.Contains(out, "/Count 2") {
+		t.Errorf("got %q, want the escaped and encoded texts on two pages", out)
+	}
+
+	// The cross reference table must point to the objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(out)
+	if m == nil {
+		t.Fatal("got no startxref")
+	}
+	xref, _ := strconv.Atoi(m[1])
+	if !strings.HasPrefix(out[xref:], "xref\n0 9\n") {
+		t.Fatalf("got no xref table at %v", xref)
+	}
+	for i, line := range strings.Split(out[xref:], "\n")[3:11] {
+		offset, _ := strconv.Atoi(line[:10])
+		if want := strconv.Itoa(i+1) + " 0 obj"; !strings.HasPrefix(out[offset:], want) {
+			t.Errorf("got %q at offset %v, want %q", out[offset:offset+8], offset, want)
+		}
+	}
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/nicolaspernoud/malt_app/internal/auth"
 	"github.com/nicolaspernoud/malt_app/internal/mockoauth2"
 	"github.com/nicolaspernoud/malt_app/internal/models"
+	"github.com/nicolaspernoud/malt_app/internal/notify"
 
 	"github.com/alexedwards/scs/v2"
 	"github.com/jinzhu/gorm"
@@ -21,11 +24,25 @@ import (
 var (
 	sessionManager *scs.SessionManager
 	debugMode      = flag.Bool("debug", false, "Debug mode, enables mock OAuth2 server")
+	rebuildLedger  = flag.Bool("rebuild-ledger", false, "Regenerates the stock ledger from the events, transfers and sales, then exits")
+	alertInterval  = flag.Duration("alert-interval", 15*time.Minute, "Interval between two checks of the fermenting batches")
+	stallDuration  = flag.Duration("stall-duration", 48*time.Hour, "Duration without gravity change after which a fermentation is considered stalled")
+	missingAfter   = flag.Duration("missing-after", 6*time.Hour, "Duration without sensor reading after which an alert is raised")
+	kegOverdueDays = flag.Int("keg-overdue-days", 90, "Number of days after which a keg at a customer is overdue")
 )
 
 func main() {
 	// Parse flags
 	flag.Parse()
+	// Rebuild the stock ledger and exit if asked to
+	if *rebuildLedger {
+		models.InitDB("./data/business.db")
+		if err := models.RebuildLedger(models.DB); err != nil {
+			log.Fatalf("Error rebuilding the stock ledger : %v\n", err)
+		}
+		fmt.Println("Stock ledger rebuilt")
+		return
+	}
 	// Start a mock oauth2 server if debug mode is on
 	if *debugMode {
 		mockOAuth2Port := ":8090"
@@ -35,8 +52,23 @@ func main() {
 
 	// Start the server
 	httpPort := ":8081"
+	mux := createMux()
+	// Watch the fermenting batches, sending the alerts by email if SMTP is configured
+	models.AlertRules = []models.AlertRule{models.TemperatureOutOfRange(), models.GravityStalled(*stallDuration), models.ReadingMissing(*missingAfter)}
+	if s, ok := notify.SMTPFromEnv(); ok {
+		models.Notifiers = append(models.Notifiers, s)
+	}
+	go models.WatchBatches(models.DB, *alertInterval)
+	// Print the company set in the environment on the invoices
+	if i, ok := models.IssuerFromEnv(); ok {
+		models.Issuer = i
+	}
+	// Report the kegs at the customers for longer than the overdue days
+	models.KegOverdueDays = *kegOverdueDays
+	// Declare the DRM with the excise number set in the environment
+	models.ExciseNumber = os.Getenv("EXCISE_NUMBER")
 	fmt.Println("Listening on: http://localhost" + httpPort + "/admin?locale=fr-FR")
-	http.ListenAndServe(httpPort, createMux())
+	http.ListenAndServe(httpPort, mux)
 }
 
 func createMux() http.Handler {
@@ -73,6 +105,12 @@ func createMux() http.Handler {
 		}
 		http.Error(w, "method not allowed", 405)
 	})
+	mux.HandleFunc("/api/recipes/", auth.ValidateAuth(models.ServeBeerJSON))
+	mux.HandleFunc("/api/batches/", auth.ValidateAuth(models.ServeBeerJSON))
+	mux.HandleFunc("/api/sensors/", models.ServeSensorReadings)
+	mux.HandleFunc("/api/trace/", auth.ValidateAuth(models.ServeTrace))
+	mux.HandleFunc("/api/stock", auth.ValidateAuth(models.ServeStock))
+	mux.HandleFunc("/calendar/", models.ServeCalendar)
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprint(w, "OK")
 	})
@@ -114,12 +114,20 @@ func TestEndToEnd(t *testing.T) {
 	auth.Init()
 	// Try the healthcheck (must pass)
 	tester.DoRequestOnServer(t, userJar, port, "GET", "/healthcheck", "", "", 200, "OK")
+	// Try to get a recipe as BeerJSON (must fail)
+	tester.DoRequestOnServer(t, userJar, port, "GET", "/api/recipes/1.beerjson", "", "", 401, "not logged in")
+	// Try to get the stock as of a date (must fail)
+	tester.DoRequestOnServer(t, userJar, port, "GET", "/api/stock?at=2026-01-31", "", "", 401, "not logged in")
+	// Try to get a calendar feed with a wrong token (must fail)
+	tester.DoRequestOnServer(t, userJar, port, "GET", "/calendar/wrong.ics", "", "", 401, "invalid calendar feed token")
 
 	// Normal users tests (those tests checks the normal behaviour for an user)
 	// Try to login (must pass)
 	tester.DoRequestOnServer(t, userJar, port, "GET", "/admin", "", "", 200, "")
 	// Try to access something (must pass)
 	tester.DoRequestOnServer(t, userJar, port, "GET", "/admin/batches.json", "", "", 200, `[]`)
+	// Try to get an unknown batch as BeerJSON (must fail)
+	tester.DoRequestOnServer(t, userJar, port, "GET", "/api/batches/1.beerjson", "", "", 404, "404 page not found")
 
 	// Logout
 	tester.DoRequestOnServer(t, userJar, port, "GET", "/logout", "", "Logout OK", 200, "")